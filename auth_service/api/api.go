@@ -3,9 +3,13 @@ package api
 import (
 	"auth_service/database"
 	"auth_service/models"
+	"context"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 	json_utils "utils/json"
 	jwt_utils "utils/jwt"
 	redis_utils "utils/redis"
@@ -13,12 +17,19 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// TokenStore - список отзыва токенов (Redis)
+type TokenStore interface {
+	RevokeToken(token string, expiresAt time.Time) error
+	RevokeUserTokens(userHash string, ttl time.Duration) error
+	GetRevocationStats(ctx context.Context) (*redis_utils.RevocationStats, error)
+}
+
 type API struct {
 	db        database.DBAdapter
-	redis_cli *redis_utils.RedisClient
+	redis_cli TokenStore
 }
 
-func NewApi(db database.DBAdapter, redis_cli *redis_utils.RedisClient) *API {
+func NewApi(db database.DBAdapter, redis_cli TokenStore) *API {
 	return &API{db, redis_cli}
 }
 
@@ -46,14 +57,55 @@ func (api *API) HandlerAuthorize(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	token, err := jwt_utils.GenerateJWT(user.Username)
+	userInfo := jwt_utils.NewUserInfo()
+	userInfo.UserID = user.ID
+	userInfo.IsAdmin = user.IsAdmin
+	claims := jwt_utils.NewClaims(user.Username, userInfo)
+
+	// Токен от имени организации выдается только ее участникам
+	if input.Org != "" {
+		org, err := api.db.GetOrgByName(input.Org)
+		var membership *models.Membership
+		if err == nil {
+			membership, err = api.db.GetMembership(org.ID, user.ID)
+		}
+		if err != nil {
+			http.Error(w, "Not a member of organization", http.StatusForbidden)
+			return
+		}
+		claims.Org = &jwt_utils.OrgClaim{ID: org.ID, Name: org.Name, Role: membership.Role}
+	}
+
+	// С заголовком DPoP токен привязывается к ключу клиента
+	tokenType := "Bearer"
+	if proof := req.Header.Get("DPoP"); proof != "" {
+		jkt, err := jwt_utils.VerifyDPoPProof(proof, req.Method, jwt_utils.RequestURL(req), "")
+		if err != nil {
+			log.Printf("HandlerAuthorize: %v", err)
+			json_utils.SendJSONResponse(w, http.StatusBadRequest, map[string]string{
+				"error":             "invalid_dpop_proof",
+				"error_description": err.Error(),
+			})
+			return
+		}
+		claims.Cnf = &jwt_utils.Confirmation{JKT: jkt}
+		tokenType = "DPoP"
+	}
+
+	token, err := jwt_utils.SignClaims(claims)
 	if err != nil {
 		log.Printf("GenerateJWT: Error: %v", err)
 		http.Error(w, "Token generation failed", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	// История входов нужна для выгрузки персональных данных, ее сбой не мешает входу
+	login := &models.Login{IP: clientIP(req), UserAgent: req.UserAgent()}
+	if err := api.db.AddLogin(user.ID, login); err != nil {
+		log.Printf("HandlerAuthorize: failed to save login: %v", err)
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"token": token, "token_type": tokenType})
 }
 
 func (api *API) HandlerRegister(w http.ResponseWriter, req *http.Request) {
@@ -119,3 +171,142 @@ func (api *API) HandlerLogout(w http.ResponseWriter, req *http.Request) {
 	json_utils.SendJSONResponse(w, http.StatusOK, nil)
 	log.Printf("Logout token: %+v", token)
 }
+
+// HandlerDeleteAccount - удаление учетной записи. Все токены пользователя отзываются,
+// а данные в других сервисах удаляются асинхронно по событию user_deleted. Событие
+// записывается в outbox в одной транзакции с удалением и публикуется outbox.Relay.
+func (api *API) HandlerDeleteAccount(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerDeleteAccount called")
+
+	if req.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var input models.Credentials
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerDeleteAccount: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Удалить можно только свою учетную запись
+	userHash := jwt_utils.HashUsername(input.Username)
+	if userHash != claims.Subject {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	user, err := api.db.Get(input.Username)
+	if err != nil {
+		http.Error(w, "Error get user from db", http.StatusInternalServerError)
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password))
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	err = api.redis_cli.RevokeUserTokens(userHash, jwt_utils.TokenTTL)
+	if err != nil {
+		log.Printf("HandlerDeleteAccount: Error: %v", err)
+		http.Error(w, "Failed to revoke user tokens", http.StatusInternalServerError)
+		return
+	}
+
+	event := &models.OutboxEvent{
+		Stream: redis_utils.StreamUserEvents,
+		Values: map[string]interface{}{
+			"type":       redis_utils.EventUserDeleted,
+			"userhash":   userHash,
+			"deleted_at": time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	err = api.db.DeleteWithEvent(input.Username, event)
+	if err != nil {
+		log.Printf("HandlerDeleteAccount: Error: %v", err)
+		http.Error(w, "Error when delete user", http.StatusInternalServerError)
+		return
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, nil)
+	log.Printf("Deleted user %s, outbox event %d", userHash, event.ID)
+}
+
+// HandlerProfile - все данные, которые auth_service хранит о пользователе
+func (api *API) HandlerProfile(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerProfile called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerProfile: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := api.db.GetByID(claims.UserInfo.UserID)
+	if err != nil || jwt_utils.HashUsername(user.Username) != claims.Subject {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	logins, err := api.db.GetLogins(user.ID)
+	if err != nil {
+		log.Printf("HandlerProfile: Error: %v", err)
+		http.Error(w, "Error get login history from db", http.StatusInternalServerError)
+		return
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, &models.Profile{
+		ID:        user.ID,
+		Username:  user.Username,
+		CreatedAt: user.CreatedAt,
+		Logins:    logins,
+	})
+}
+
+// Вспомогательная функция для получения адреса клиента. X-Real-IP выставляет nginx;
+// X-Forwarded-For не используется: nginx дописывает адрес к значению, присланному клиентом.
+func clientIP(req *http.Request) string {
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// HandlerRevocationStats - количество действующих отзывов токенов и память Redis
+func (api *API) HandlerRevocationStats(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerRevocationStats called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := api.redis_cli.GetRevocationStats(req.Context())
+	if err != nil {
+		log.Printf("HandlerRevocationStats: Error: %v", err)
+		http.Error(w, "Failed to get revocation stats", http.StatusInternalServerError)
+		return
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, stats)
+}
@@ -3,6 +3,11 @@ package api
 import (
 	"auth_service/models"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io"
@@ -10,13 +15,22 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+	jwt_utils "utils/jwt"
+	redis_utils "utils/redis"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type MockDB struct {
-	Users map[string]*models.User
+	Users   map[string]*models.User
+	Logins  map[int64][]*models.Login
+	Orgs    map[string]*models.Organization
+	Members map[int64]map[int64]string // org_id -> user_id -> role
+	Outbox  []*models.OutboxEvent
+	FailTx  bool // DeleteWithEvent завершается ошибкой, ничего не изменив
 }
 
 func (db *MockDB) InitialzeDB() error {
@@ -56,6 +70,98 @@ func (db *MockDB) GetAll() ([]*models.User, error) {
 	return nil, nil
 }
 
+func (db *MockDB) SetAdmin(username string, isAdmin bool) error {
+	return nil
+}
+
+func (db *MockDB) GetByID(id int64) (*models.User, error) {
+	for _, user := range db.Users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, errors.New("user not found")
+}
+
+func (db *MockDB) AddLogin(userID int64, login *models.Login) error {
+	if db.Logins == nil {
+		db.Logins = make(map[int64][]*models.Login)
+	}
+	db.Logins[userID] = append(db.Logins[userID], login)
+	return nil
+}
+
+func (db *MockDB) GetLogins(userID int64) ([]*models.Login, error) {
+	return db.Logins[userID], nil
+}
+
+func (db *MockDB) DeleteWithEvent(username string, event *models.OutboxEvent) error {
+	if db.FailTx {
+		return errors.New("transaction failed")
+	}
+	if _, ok := db.Users[username]; !ok {
+		return errors.New("no rows affected")
+	}
+	delete(db.Users, username)
+	event.ID = int64(len(db.Outbox) + 1)
+	db.Outbox = append(db.Outbox, event)
+	return nil
+}
+
+func (db *MockDB) GetOutboxEvents(limit int) ([]*models.OutboxEvent, error) {
+	return db.Outbox, nil
+}
+
+func (db *MockDB) DeleteOutboxEvent(id int64) error {
+	return nil
+}
+
+func (db *MockDB) CreateOrg(name string, ownerID int64) (*models.Organization, error) {
+	return nil, nil
+}
+
+func (db *MockDB) GetOrgByName(name string) (*models.Organization, error) {
+	if org, ok := db.Orgs[name]; ok {
+		return org, nil
+	}
+	return nil, errors.New("organization not found")
+}
+
+func (db *MockDB) GetMembership(orgID int64, userID int64) (*models.Membership, error) {
+	if role, ok := db.Members[orgID][userID]; ok {
+		return &models.Membership{OrgID: orgID, UserID: userID, Role: role}, nil
+	}
+	return nil, errors.New("membership not found")
+}
+
+func (db *MockDB) GetMemberships(userID int64) ([]*models.Membership, error) {
+	return nil, nil
+}
+
+func (db *MockDB) GetOrgMembers(orgID int64) ([]*models.Membership, error) {
+	return nil, nil
+}
+
+func (db *MockDB) SetMemberRole(orgID int64, userID int64, role string) error {
+	return nil
+}
+
+func (db *MockDB) RemoveMember(orgID int64, userID int64) error {
+	return nil
+}
+
+func (db *MockDB) CreateInvite(orgID int64, userID int64, role string, invitedBy int64) (int64, error) {
+	return 0, nil
+}
+
+func (db *MockDB) GetInvites(userID int64) ([]*models.Invite, error) {
+	return nil, nil
+}
+
+func (db *MockDB) AcceptInvite(inviteID int64, userID int64) (*models.Membership, error) {
+	return nil, nil
+}
+
 func TestHandlerAuthorize(t *testing.T) {
 	log.SetOutput(io.Discard)
 
@@ -84,6 +190,7 @@ func TestHandlerAuthorize(t *testing.T) {
 		var response map[string]string
 		_ = json.NewDecoder(resp.Body).Decode(&response)
 		assert.NotNil(t, response["token"])
+		assert.Len(t, mockDB.Logins[0], 1)
 	})
 
 	t.Run("Invalid Credentials", func(t *testing.T) {
@@ -96,6 +203,54 @@ func TestHandlerAuthorize(t *testing.T) {
 		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	})
 
+	t.Run("Organization member", func(t *testing.T) {
+		mockDB.Orgs = map[string]*models.Organization{"team": {ID: 3, Name: "team"}}
+		mockDB.Members = map[int64]map[int64]string{3: {0: models.RoleViewer}}
+
+		reqBody, _ := json.Marshal(models.Credentials{Username: "testuser", Password: "password123", Org: "team"})
+		req := httptest.NewRequest(http.MethodPost, "/authorize", bytes.NewReader(reqBody))
+		w := httptest.NewRecorder()
+
+		api.HandlerAuthorize(w, req)
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var response map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&response)
+		claims, err := jwt_utils.GetJWTClaims(response["token"])
+		assert.NoError(t, err)
+		assert.Equal(t, &jwt_utils.OrgClaim{ID: 3, Name: "team", Role: models.RoleViewer}, claims.Org)
+	})
+
+	t.Run("Not an organization member", func(t *testing.T) {
+		reqBody, _ := json.Marshal(models.Credentials{Username: "testuser", Password: "password123", Org: "other"})
+		req := httptest.NewRequest(http.MethodPost, "/authorize", bytes.NewReader(reqBody))
+		w := httptest.NewRecorder()
+
+		api.HandlerAuthorize(w, req)
+		resp := w.Result()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("Admin user", func(t *testing.T) {
+		mockDB.Users["testuser"].IsAdmin = true
+		defer func() { mockDB.Users["testuser"].IsAdmin = false }()
+
+		reqBody, _ := json.Marshal(models.Credentials{Username: "testuser", Password: "password123"})
+		req := httptest.NewRequest(http.MethodPost, "/authorize", bytes.NewReader(reqBody))
+		w := httptest.NewRecorder()
+
+		api.HandlerAuthorize(w, req)
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var response map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&response)
+		claims, err := jwt_utils.GetJWTClaims(response["token"])
+		assert.NoError(t, err)
+		assert.True(t, claims.UserInfo.IsAdmin)
+	})
+
 }
 
 func TestHandlerRegister(t *testing.T) {
@@ -131,6 +286,209 @@ func TestHandlerRegister(t *testing.T) {
 
 }
 
+type memoryReplayStore map[string]bool
+
+func (s memoryReplayStore) StoreDPoPJti(jti string, ttl time.Duration) (bool, error) {
+	if s[jti] {
+		return false, nil
+	}
+	s[jti] = true
+	return true, nil
+}
+
+func TestHandlerAuthorizeDPoP(t *testing.T) {
+	log.SetOutput(io.Discard)
+	jwt_utils.InitDPoPReplayStore(memoryReplayStore{})
+
+	mockDB := &MockDB{
+		Users: map[string]*models.User{
+			"testuser": {
+				Username: "testuser",
+				Password: func() string {
+					hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+					return string(hash)
+				}(),
+			},
+		},
+	}
+	api := NewApi(mockDB, nil)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	proof := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"htm": http.MethodPost,
+		"htu": "http://example.com/authorize",
+		"iat": time.Now().Unix(),
+		"jti": "proof-1",
+	})
+	proof.Header["typ"] = "dpop+jwt"
+	proof.Header["jwk"] = map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+	signedProof, _ := proof.SignedString(key)
+
+	authorize := func() *http.Response {
+		reqBody, _ := json.Marshal(models.Credentials{Username: "testuser", Password: "password123"})
+		req := httptest.NewRequest(http.MethodPost, "/authorize", bytes.NewReader(reqBody))
+		req.Header.Set("DPoP", signedProof)
+		w := httptest.NewRecorder()
+
+		api.HandlerAuthorize(w, req)
+		return w.Result()
+	}
+
+	t.Run("Bound token", func(t *testing.T) {
+		resp := authorize()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var response map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&response)
+		assert.Equal(t, "DPoP", response["token_type"])
+
+		claims, err := jwt_utils.GetJWTClaims(response["token"])
+		assert.NoError(t, err)
+		assert.NotNil(t, claims.Cnf)
+		assert.NotEmpty(t, claims.Cnf.JKT)
+	})
+
+	t.Run("Replayed proof", func(t *testing.T) {
+		resp := authorize()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestHandlerProfile(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	mockDB := &MockDB{
+		Users: map[string]*models.User{
+			"testuser": {ID: 7, Username: "testuser"},
+		},
+		Logins: map[int64][]*models.Login{
+			7: {{IP: "10.0.0.1", UserAgent: "test"}},
+		},
+	}
+	api := NewApi(mockDB, nil)
+
+	newRequest := func(userID int64, username string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+		claims := &jwt_utils.Claims{UserInfo: jwt_utils.UserInfo{UserID: userID}}
+		claims.Subject = jwt_utils.HashUsername(username)
+		return req.WithContext(context.WithValue(req.Context(), "claims", claims))
+	}
+
+	t.Run("Own profile", func(t *testing.T) {
+		w := httptest.NewRecorder()
+
+		api.HandlerProfile(w, newRequest(7, "testuser"))
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var profile models.Profile
+		_ = json.NewDecoder(resp.Body).Decode(&profile)
+		assert.Equal(t, "testuser", profile.Username)
+		assert.Len(t, profile.Logins, 1)
+	})
+
+	t.Run("Subject mismatch", func(t *testing.T) {
+		w := httptest.NewRecorder()
+
+		api.HandlerProfile(w, newRequest(7, "otheruser"))
+		resp := w.Result()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+type MockTokenStore struct {
+	RevokedUsers map[string]bool
+}
+
+func (s *MockTokenStore) RevokeToken(token string, expiresAt time.Time) error {
+	return nil
+}
+
+func (s *MockTokenStore) RevokeUserTokens(userHash string, ttl time.Duration) error {
+	s.RevokedUsers[userHash] = true
+	return nil
+}
+
+func (s *MockTokenStore) GetRevocationStats(ctx context.Context) (*redis_utils.RevocationStats, error) {
+	return &redis_utils.RevocationStats{}, nil
+}
+
+func TestHandlerDeleteAccount(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	newRequest := func() *http.Request {
+		reqBody, _ := json.Marshal(models.Credentials{Username: "testuser", Password: "password123"})
+		req := httptest.NewRequest(http.MethodDelete, "/account", bytes.NewReader(reqBody))
+		claims := &jwt_utils.Claims{}
+		claims.Subject = jwt_utils.HashUsername("testuser")
+		return req.WithContext(context.WithValue(req.Context(), "claims", claims))
+	}
+
+	t.Run("Deleted with event", func(t *testing.T) {
+		mockDB := &MockDB{Users: map[string]*models.User{
+			"testuser": {ID: 7, Username: "testuser", Password: string(hash)},
+		}}
+		tokens := &MockTokenStore{RevokedUsers: map[string]bool{}}
+		api := NewApi(mockDB, tokens)
+		w := httptest.NewRecorder()
+
+		api.HandlerDeleteAccount(w, newRequest())
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Nil(t, mockDB.Users["testuser"])
+		assert.True(t, tokens.RevokedUsers[jwt_utils.HashUsername("testuser")])
+		assert.Len(t, mockDB.Outbox, 1)
+		assert.Equal(t, redis_utils.EventUserDeleted, mockDB.Outbox[0].Values["type"])
+		assert.Equal(t, jwt_utils.HashUsername("testuser"), mockDB.Outbox[0].Values["userhash"])
+	})
+
+	t.Run("Transaction failed", func(t *testing.T) {
+		mockDB := &MockDB{
+			Users: map[string]*models.User{
+				"testuser": {ID: 7, Username: "testuser", Password: string(hash)},
+			},
+			FailTx: true,
+		}
+		api := NewApi(mockDB, &MockTokenStore{RevokedUsers: map[string]bool{}})
+		w := httptest.NewRecorder()
+
+		api.HandlerDeleteAccount(w, newRequest())
+		resp := w.Result()
+		// Учетная запись не удалена и событие не записано: запрос можно повторить
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.NotNil(t, mockDB.Users["testuser"])
+		assert.Empty(t, mockDB.Outbox)
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"Remote address", nil, "192.0.2.1"},
+		{"Set by nginx", map[string]string{"X-Real-IP": "203.0.113.5"}, "203.0.113.5"},
+		{"Forwarded by client", map[string]string{"X-Forwarded-For": "10.0.0.1, 203.0.113.5"}, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/authorize", nil)
+			for name, v := range tt.headers {
+				req.Header.Set(name, v)
+			}
+			assert.Equal(t, tt.want, clientIP(req))
+		})
+	}
+}
+
 func TestHandlerLogout(t *testing.T) {
 	// api := NewApi(nil)
 
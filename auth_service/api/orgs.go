@@ -0,0 +1,265 @@
+package api
+
+import (
+	"auth_service/database"
+	"auth_service/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// HandlerOrgs - GET: организации пользователя, POST: создание организации (создатель становится владельцем)
+func (api *API) HandlerOrgs(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerOrgs called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerOrgs: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		memberships, err := api.db.GetMemberships(claims.UserInfo.UserID)
+		if err != nil {
+			log.Printf("HandlerOrgs: Error: %v", err)
+			http.Error(w, "Error get organizations from db", http.StatusInternalServerError)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, memberships)
+	case http.MethodPost:
+		var input models.OrgRequest
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil || input.Org == "" {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+
+		org, err := api.db.CreateOrg(input.Org, claims.UserInfo.UserID)
+		if err != nil {
+			log.Printf("HandlerOrgs: Error: %v", err)
+			http.Error(w, "Error when create organization", http.StatusInternalServerError)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, org)
+		log.Printf("Created organization: %+v", org)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerOrgMembers - GET ?org=: участники, PUT: смена роли, DELETE: исключение участника (или выход из организации)
+func (api *API) HandlerOrgMembers(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerOrgMembers called. METHOD: %s", req.Method)
+
+	if req.Method == http.MethodGet {
+		_, actor, ok := api.orgMembership(w, req, req.URL.Query().Get("org"))
+		if !ok {
+			return
+		}
+
+		members, err := api.db.GetOrgMembers(actor.OrgID)
+		if err != nil {
+			log.Printf("HandlerOrgMembers: Error: %v", err)
+			http.Error(w, "Error get members from db", http.StatusInternalServerError)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, members)
+		return
+	}
+
+	if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var input models.OrgRequest
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil || input.Username == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	org, actor, ok := api.orgMembership(w, req, input.Org)
+	if !ok {
+		return
+	}
+
+	target, err := api.db.Get(input.Username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	member, err := api.db.GetMembership(org.ID, target.ID)
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	if req.Method == http.MethodPut {
+		if !models.IsValidRole(input.Role) {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		if !canManage(actor, member.Role) || !canManage(actor, input.Role) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		err = api.db.SetMemberRole(org.ID, target.ID, input.Role)
+	} else {
+		if actor.UserID != target.ID && !canManage(actor, member.Role) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		err = api.db.RemoveMember(org.ID, target.ID)
+	}
+
+	if err != nil {
+		if err == database.ErrLastOwner {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			log.Printf("HandlerOrgMembers: Error: %v", err)
+			http.Error(w, "Error when update member", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, nil)
+	log.Printf("Organization %s: %s member %s", org.Name, req.Method, input.Username)
+}
+
+// HandlerOrgInvites - GET: приглашения пользователя, POST: приглашение в организацию
+func (api *API) HandlerOrgInvites(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerOrgInvites called. METHOD: %s", req.Method)
+
+	switch req.Method {
+	case http.MethodGet:
+		claims, err := jwt_utils.GetClaimsFromContext(req)
+		if err != nil {
+			log.Printf("HandlerOrgInvites: Error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		invites, err := api.db.GetInvites(claims.UserInfo.UserID)
+		if err != nil {
+			log.Printf("HandlerOrgInvites: Error: %v", err)
+			http.Error(w, "Error get invites from db", http.StatusInternalServerError)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, invites)
+	case http.MethodPost:
+		var input models.OrgRequest
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil || input.Username == "" {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if input.Role == "" {
+			input.Role = models.RoleMember
+		}
+		if !models.IsValidRole(input.Role) {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+
+		org, actor, ok := api.orgMembership(w, req, input.Org)
+		if !ok {
+			return
+		}
+		if !canManage(actor, input.Role) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		invitee, err := api.db.Get(input.Username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		id, err := api.db.CreateInvite(org.ID, invitee.ID, input.Role, actor.UserID)
+		if err != nil {
+			log.Printf("HandlerOrgInvites: Error: %v", err)
+			http.Error(w, "Error when create invite", http.StatusInternalServerError)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]int64{"id": id})
+		log.Printf("Organization %s: invited %s as %s", org.Name, input.Username, input.Role)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerOrgInviteAccept - принятие приглашения ?id=
+func (api *API) HandlerOrgInviteAccept(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerOrgInviteAccept called")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(req.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerOrgInviteAccept: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	membership, err := api.db.AcceptInvite(id, claims.UserInfo.UserID)
+	if err != nil {
+		if err.Error() == "no rows affected" {
+			http.Error(w, "Invite not found", http.StatusNotFound)
+		} else {
+			log.Printf("HandlerOrgInviteAccept: Error: %v", err)
+			http.Error(w, "Error when accept invite", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, membership)
+}
+
+// Организация и членство в ней текущего пользователя; при ошибке ответ уже отправлен
+func (api *API) orgMembership(w http.ResponseWriter, req *http.Request, orgName string) (*models.Organization, *models.Membership, bool) {
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("orgMembership: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	org, err := api.db.GetOrgByName(orgName)
+	if err != nil {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	membership, err := api.db.GetMembership(org.ID, claims.UserInfo.UserID)
+	if err != nil {
+		// Не раскрываем существование организации посторонним
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	return org, membership, true
+}
+
+// Может ли участник назначать роль role (или управлять участником с этой ролью)
+func canManage(actor *models.Membership, role string) bool {
+	switch actor.Role {
+	case models.RoleOwner:
+		return true
+	case models.RoleAdmin:
+		return role != models.RoleOwner
+	}
+	return false
+}
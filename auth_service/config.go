@@ -4,11 +4,15 @@ import (
 	"auth_service/database"
 	"os"
 	"strconv"
+	redis_utils "utils/redis"
 )
 
 type Config struct {
 	Port   uint64            `json:"port"`
 	DBConf database.DBConfig `json:"db"`
+
+	RedisConf            redis_utils.RedisConfig `json:"redis"`
+	RevocationFailPolicy redis_utils.FailPolicy  `json:"revocation_fail_policy"`
 }
 
 func ReadConfig() (*Config, error) {
@@ -28,5 +32,16 @@ func ReadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	redisConf, err := redis_utils.ReadRedisConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.RedisConf = *redisConf
+
+	config.RevocationFailPolicy, err = redis_utils.ParseFailPolicy(os.Getenv("REVOCATION_FAIL_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
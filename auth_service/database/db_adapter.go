@@ -24,7 +24,28 @@ type DBAdapter interface {
 	Update(id int64, item *DBItem) error
 	Delete(name string) error
 	Get(name string) (*DBItem, error)
+	GetByID(id int64) (*DBItem, error)
 	GetAll() ([]*DBItem, error)
+	SetAdmin(name string, isAdmin bool) error
+	AddLogin(userID int64, login *models.Login) error
+	GetLogins(userID int64) ([]*models.Login, error)
+
+	// Удаление учетной записи с событием в outbox и публикация событий из outbox
+	DeleteWithEvent(name string, event *models.OutboxEvent) error
+	GetOutboxEvents(limit int) ([]*models.OutboxEvent, error)
+	DeleteOutboxEvent(id int64) error
+
+	// Организации
+	CreateOrg(name string, ownerID int64) (*models.Organization, error)
+	GetOrgByName(name string) (*models.Organization, error)
+	GetMembership(orgID int64, userID int64) (*models.Membership, error)
+	GetMemberships(userID int64) ([]*models.Membership, error)
+	GetOrgMembers(orgID int64) ([]*models.Membership, error)
+	SetMemberRole(orgID int64, userID int64, role string) error
+	RemoveMember(orgID int64, userID int64) error
+	CreateInvite(orgID int64, userID int64, role string, invitedBy int64) (int64, error)
+	GetInvites(userID int64) ([]*models.Invite, error)
+	AcceptInvite(inviteID int64, userID int64) (*models.Membership, error)
 }
 
 func NewDBAdapter(dbType string, cfg *DBConfig) (DBAdapter, error) {
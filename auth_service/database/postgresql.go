@@ -1,6 +1,7 @@
 package database
 
 import (
+	"auth_service/models"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -67,6 +68,49 @@ func (p *PostgresDB) initializeTables() error {
 				id SERIAL PRIMARY KEY,
 				username VARCHAR(50) UNIQUE NOT NULL,
 				password VARCHAR(512) NOT NULL
+		);
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT false;
+
+		CREATE TABLE IF NOT EXISTS login_history (
+				id BIGSERIAL PRIMARY KEY,
+				user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				logged_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				ip TEXT NOT NULL,
+				user_agent TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS login_history_user_id_idx ON login_history (user_id, logged_at);
+
+		CREATE TABLE IF NOT EXISTS organizations (
+				id SERIAL PRIMARY KEY,
+				name VARCHAR(100) UNIQUE NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+
+		CREATE TABLE IF NOT EXISTS org_members (
+				org_id INT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+				user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				role VARCHAR(20) NOT NULL,
+				joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				PRIMARY KEY (org_id, user_id)
+		);
+		CREATE INDEX IF NOT EXISTS org_members_user_id_idx ON org_members (user_id);
+
+		CREATE TABLE IF NOT EXISTS org_invites (
+				id SERIAL PRIMARY KEY,
+				org_id INT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+				user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				role VARCHAR(20) NOT NULL,
+				invited_by INT REFERENCES users(id) ON DELETE SET NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				UNIQUE (org_id, user_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS outbox (
+				id BIGSERIAL PRIMARY KEY,
+				stream TEXT NOT NULL,
+				payload JSONB NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 		);`
 	_, err := p.db.Exec(query)
 	return err
@@ -87,10 +131,10 @@ func (p *PostgresDB) Insert(item *DBItem) (int64, error) {
 }
 
 func (p *PostgresDB) Get(name string) (*DBItem, error) {
-	query := `SELECT id, password FROM users WHERE username=$1`
+	query := `SELECT id, password, created_at, is_admin FROM users WHERE username=$1`
 	v := &DBItem{}
 
-	err := p.db.QueryRow(query, name).Scan(&v.ID, &v.Password)
+	err := p.db.QueryRow(query, name).Scan(&v.ID, &v.Password, &v.CreatedAt, &v.IsAdmin)
 	if err != nil {
 		return nil, errors.New("failed to select user from db: " + err.Error())
 	}
@@ -99,6 +143,19 @@ func (p *PostgresDB) Get(name string) (*DBItem, error) {
 	return v, nil
 }
 
+func (p *PostgresDB) GetByID(id int64) (*DBItem, error) {
+	query := `SELECT username, password, created_at, is_admin FROM users WHERE id=$1`
+	v := &DBItem{}
+
+	err := p.db.QueryRow(query, id).Scan(&v.Username, &v.Password, &v.CreatedAt, &v.IsAdmin)
+	if err != nil {
+		return nil, errors.New("failed to select user from db: " + err.Error())
+	}
+	v.ID = id
+
+	return v, nil
+}
+
 func (p *PostgresDB) GetAll() ([]*DBItem, error) {
 	query := `SELECT id, username FROM users`
 	rows, err := p.db.Query(query)
@@ -147,6 +204,24 @@ func (p *PostgresDB) Delete(name string) error {
 	return nil
 }
 
+func (p *PostgresDB) SetAdmin(name string, isAdmin bool) error {
+	result, err := p.db.Exec(`UPDATE users SET is_admin=$1 WHERE username=$2`, isAdmin, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return nil
+}
+
 func (p *PostgresDB) Update(id int64, item *DBItem) error {
 	// var jsonValue interface{} = nil
 	// if item.Value != nil {
@@ -179,3 +254,32 @@ func (p *PostgresDB) Update(id int64, item *DBItem) error {
 
 	return nil
 }
+
+func (p *PostgresDB) AddLogin(userID int64, login *models.Login) error {
+	query := `INSERT INTO login_history (user_id, ip, user_agent) VALUES ($1, $2, $3) RETURNING logged_at`
+	return p.db.QueryRow(query, userID, login.IP, login.UserAgent).Scan(&login.LoggedAt)
+}
+
+func (p *PostgresDB) GetLogins(userID int64) ([]*models.Login, error) {
+	query := `SELECT logged_at, ip, user_agent FROM login_history WHERE user_id=$1 ORDER BY logged_at`
+	rows, err := p.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logins := []*models.Login{}
+	for rows.Next() {
+		v := &models.Login{}
+		if err := rows.Scan(&v.LoggedAt, &v.IP, &v.UserAgent); err != nil {
+			return nil, err
+		}
+		logins = append(logins, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return logins, nil
+}
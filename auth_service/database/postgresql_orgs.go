@@ -0,0 +1,209 @@
+package database
+
+import (
+	"auth_service/models"
+	"database/sql"
+	"errors"
+)
+
+var ErrLastOwner = errors.New("organization must have at least one owner")
+
+func (p *PostgresDB) CreateOrg(name string, ownerID int64) (*models.Organization, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	org := &models.Organization{Name: name}
+	query := `INSERT INTO organizations (name) VALUES ($1) RETURNING id, created_at`
+	if err := tx.QueryRow(query, name).Scan(&org.ID, &org.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	query = `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(query, org.ID, ownerID, models.RoleOwner); err != nil {
+		return nil, err
+	}
+
+	return org, tx.Commit()
+}
+
+func (p *PostgresDB) GetOrgByName(name string) (*models.Organization, error) {
+	query := `SELECT id, created_at FROM organizations WHERE name=$1`
+	org := &models.Organization{Name: name}
+
+	err := p.db.QueryRow(query, name).Scan(&org.ID, &org.CreatedAt)
+	if err != nil {
+		return nil, errors.New("failed to select organization from db: " + err.Error())
+	}
+
+	return org, nil
+}
+
+const membershipQuery = `
+	SELECT m.org_id, o.name, m.user_id, u.username, m.role, m.joined_at
+	FROM org_members m
+	JOIN organizations o ON o.id = m.org_id
+	JOIN users u ON u.id = m.user_id`
+
+func (p *PostgresDB) GetMembership(orgID int64, userID int64) (*models.Membership, error) {
+	rows, err := p.queryMemberships(membershipQuery+` WHERE m.org_id=$1 AND m.user_id=$2`, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("failed to select membership from db: " + sql.ErrNoRows.Error())
+	}
+	return rows[0], nil
+}
+
+func (p *PostgresDB) GetMemberships(userID int64) ([]*models.Membership, error) {
+	return p.queryMemberships(membershipQuery+` WHERE m.user_id=$1 ORDER BY o.name`, userID)
+}
+
+func (p *PostgresDB) GetOrgMembers(orgID int64) ([]*models.Membership, error) {
+	return p.queryMemberships(membershipQuery+` WHERE m.org_id=$1 ORDER BY u.username`, orgID)
+}
+
+func (p *PostgresDB) queryMemberships(query string, args ...interface{}) ([]*models.Membership, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []*models.Membership{}
+	for rows.Next() {
+		v := &models.Membership{}
+		if err := rows.Scan(&v.OrgID, &v.OrgName, &v.UserID, &v.Username, &v.Role, &v.JoinedAt); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return memberships, nil
+}
+
+func (p *PostgresDB) SetMemberRole(orgID int64, userID int64, role string) error {
+	return p.changeMember(orgID, userID, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec(`UPDATE org_members SET role=$3 WHERE org_id=$1 AND user_id=$2`, orgID, userID, role)
+	}, role != models.RoleOwner)
+}
+
+func (p *PostgresDB) RemoveMember(orgID int64, userID int64) error {
+	return p.changeMember(orgID, userID, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec(`DELETE FROM org_members WHERE org_id=$1 AND user_id=$2`, orgID, userID)
+	}, true)
+}
+
+// Изменение участника; если изменение лишает его роли владельца, проверяем, что владелец останется
+func (p *PostgresDB) changeMember(orgID int64, userID int64, change func(tx *sql.Tx) (sql.Result, error), dropsOwner bool) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Блокируем владельцев организации, чтобы параллельные изменения не оставили ее без владельца
+	var owners int
+	var isOwner bool
+	query := `SELECT count(*), COALESCE(bool_or(user_id=$2), false) FROM (
+							SELECT user_id FROM org_members WHERE org_id=$1 AND role=$3 FOR UPDATE
+						) o`
+	if err := tx.QueryRow(query, orgID, userID, models.RoleOwner).Scan(&owners, &isOwner); err != nil {
+		return err
+	}
+	if dropsOwner && isOwner && owners == 1 {
+		return ErrLastOwner
+	}
+
+	result, err := change(tx)
+	if err != nil {
+		return err
+	}
+
+	// Проверяем, было ли изменено хотя бы одно значение
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return tx.Commit()
+}
+
+func (p *PostgresDB) CreateInvite(orgID int64, userID int64, role string, invitedBy int64) (int64, error) {
+	query := `INSERT INTO org_invites (org_id, user_id, role, invited_by) VALUES ($1, $2, $3, $4)
+						ON CONFLICT (org_id, user_id) DO UPDATE SET role=EXCLUDED.role, invited_by=EXCLUDED.invited_by, created_at=now()
+						RETURNING id`
+	var id int64
+	err := p.db.QueryRow(query, orgID, userID, role, invitedBy).Scan(&id)
+	return id, err
+}
+
+func (p *PostgresDB) GetInvites(userID int64) ([]*models.Invite, error) {
+	query := `SELECT i.id, i.org_id, o.name, u.username, i.role, i.created_at
+						FROM org_invites i
+						JOIN organizations o ON o.id = i.org_id
+						JOIN users u ON u.id = i.user_id
+						WHERE i.user_id=$1 ORDER BY i.created_at`
+	rows, err := p.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []*models.Invite{}
+	for rows.Next() {
+		v := &models.Invite{}
+		if err := rows.Scan(&v.ID, &v.OrgID, &v.OrgName, &v.Username, &v.Role, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invites, nil
+}
+
+func (p *PostgresDB) AcceptInvite(inviteID int64, userID int64) (*models.Membership, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var orgID int64
+	var role string
+	query := `DELETE FROM org_invites WHERE id=$1 AND user_id=$2 RETURNING org_id, role`
+	err = tx.QueryRow(query, inviteID, userID).Scan(&orgID, &role)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no rows affected")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query = `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)
+					 ON CONFLICT (org_id, user_id) DO NOTHING`
+	if _, err := tx.Exec(query, orgID, userID, role); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return p.GetMembership(orgID, userID)
+}
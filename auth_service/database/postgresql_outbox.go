@@ -0,0 +1,74 @@
+package database
+
+import (
+	"auth_service/models"
+	"encoding/json"
+	"errors"
+)
+
+// DeleteWithEvent - удаляет пользователя и в той же транзакции записывает событие в outbox,
+// поэтому событие не теряется, даже если публикация не удалась
+func (p *PostgresDB) DeleteWithEvent(name string, event *models.OutboxEvent) error {
+	values, err := json.Marshal(event.Values)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM users WHERE username=$1`, name)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	query := `INSERT INTO outbox (stream, payload) VALUES ($1, $2) RETURNING id, created_at`
+	if err := tx.QueryRow(query, event.Stream, values).Scan(&event.ID, &event.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *PostgresDB) GetOutboxEvents(limit int) ([]*models.OutboxEvent, error) {
+	query := `SELECT id, stream, payload, created_at FROM outbox ORDER BY id LIMIT $1`
+	rows, err := p.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*models.OutboxEvent{}
+	for rows.Next() {
+		v := &models.OutboxEvent{}
+		var payload []byte
+		if err := rows.Scan(&v.ID, &v.Stream, &payload, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &v.Values); err != nil {
+			return nil, err
+		}
+		events = append(events, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (p *PostgresDB) DeleteOutboxEvent(id int64) error {
+	_, err := p.db.Exec(`DELETE FROM outbox WHERE id=$1`, id)
+	return err
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"auth_service/api"
 	"auth_service/database"
+	"auth_service/outbox"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,19 +15,37 @@ import (
 )
 
 func main() {
+	// Права администратора назначаются только из командной строки, не через API
+	grantAdmin := flag.String("grant-admin", "", "make the user an administrator and exit")
+	revokeAdmin := flag.String("revoke-admin", "", "remove administrator rights from the user and exit")
+	flag.Parse()
+
 	config, err := ReadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("Loaded Config: %+v", config)
 
+	if *grantAdmin != "" || *revokeAdmin != "" {
+		if err := setAdmin(config, *grantAdmin, *revokeAdmin); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Printf("Init Redis client")
-	r_addr := os.Getenv("REDIS_HOST")
-	r_port := os.Getenv("REDIS_PORT")
-	redis_cli := redis_utils.InitRedisClient(r_addr+":"+r_port, "")
+	redis_cli, err := redis_utils.NewRedisClient(&config.RedisConf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Start token revocation cache, fail policy: %s", config.RevocationFailPolicy)
+	revocations := redis_utils.NewRevocationCache(redis_cli, config.RevocationFailPolicy)
+	go revocations.Run(context.Background())
 
 	secret := os.Getenv("JWT_SECRET")
 	jwt_utils.InitJwtSecret(secret)
+	jwt_utils.InitDPoPReplayStore(redis_cli)
 
 	db_adapter, err := database.NewDBAdapter("postgres", &config.DBConf)
 	if err != nil {
@@ -39,14 +60,50 @@ func main() {
 		log.Fatal(err)
 	}
 
+	log.Printf("Start outbox relay")
+	go outbox.NewRelay(db_adapter, redis_cli).Run(context.Background())
+
 	api := api.NewApi(db_adapter, redis_cli)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/authorize", api.HandlerAuthorize)
 	mux.HandleFunc("/register", api.HandlerRegister)
-	mux.Handle("/logout", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerLogout), redis_cli))
+	mux.Handle("/logout", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerLogout), revocations))
+	// Профиль для выгрузки данных mock_service читает с делегированным токеном
+	mux.Handle("/profile", jwt_utils.DelegatedMiddleware(http.HandlerFunc(api.HandlerProfile), revocations, jwt_utils.ProfileAudience))
+	mux.Handle("/account", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerDeleteAccount), revocations))
+	mux.Handle("/orgs", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerOrgs), revocations))
+	mux.Handle("/orgs/members", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerOrgMembers), revocations))
+	mux.Handle("/orgs/invites", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerOrgInvites), revocations))
+	mux.Handle("/orgs/invites/accept", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerOrgInviteAccept), revocations))
+	mux.Handle("/admin/revocations", jwt_utils.JwtMiddleware(jwt_utils.AdminMiddleware(http.HandlerFunc(api.HandlerRevocationStats)), revocations))
 
 	port := fmt.Sprintf("%d", config.Port)
 	log.Printf("Starting server on port " + port)
 	log.Fatal(http.ListenAndServe(":"+port, mux))
 }
+
+func setAdmin(config *Config, grant string, revoke string) error {
+	db_adapter, err := database.NewDBAdapter("postgres", &config.DBConf)
+	if err != nil {
+		return err
+	}
+	if err := db_adapter.InitialzeDB(); err != nil {
+		return err
+	}
+	defer db_adapter.FinishDB()
+
+	if grant != "" {
+		if err := db_adapter.SetAdmin(grant, true); err != nil {
+			return fmt.Errorf("failed to grant admin to %s: %v", grant, err)
+		}
+		log.Printf("User %s is now an administrator", grant)
+	}
+	if revoke != "" {
+		if err := db_adapter.SetAdmin(revoke, false); err != nil {
+			return fmt.Errorf("failed to revoke admin from %s: %v", revoke, err)
+		}
+		log.Printf("User %s is no longer an administrator", revoke)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// Событие, записанное в outbox вместе с изменением данных и еще не опубликованное
+type OutboxEvent struct {
+	ID        int64                  `json:"id"`
+	Stream    string                 `json:"stream"`
+	Values    map[string]interface{} `json:"values"`
+	CreatedAt time.Time              `json:"created_at"`
+}
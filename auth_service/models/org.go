@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+	jwt_utils "utils/jwt"
+)
+
+// Роли участников организации; те же значения проверяет mock_service
+const (
+	RoleOwner  = jwt_utils.OrgRoleOwner
+	RoleAdmin  = jwt_utils.OrgRoleAdmin
+	RoleMember = jwt_utils.OrgRoleMember
+	RoleViewer = jwt_utils.OrgRoleViewer
+)
+
+func IsValidRole(role string) bool {
+	switch role {
+	case RoleOwner, RoleAdmin, RoleMember, RoleViewer:
+		return true
+	}
+	return false
+}
+
+type Organization struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Membership struct {
+	OrgID    int64     `json:"org_id"`
+	OrgName  string    `json:"org_name"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type Invite struct {
+	ID        int64     `json:"id"`
+	OrgID     int64     `json:"org_id"`
+	OrgName   string    `json:"org_name"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Запросы к API организаций
+type OrgRequest struct {
+	Org      string `json:"org"`
+	Username string `json:"username,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
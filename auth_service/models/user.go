@@ -1,12 +1,32 @@
 package models
 
+import "time"
+
 type User struct {
-	ID       int64  `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	CreatedAt time.Time `json:"created_at"`
+	IsAdmin   bool      `json:"is_admin"` // назначается только вне API: auth_service -grant-admin
 }
 
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Org      string `json:"org,omitempty"` // организация, от имени которой выдается токен
+}
+
+// Запись истории входов
+type Login struct {
+	LoggedAt  time.Time `json:"logged_at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// Все, что сервис хранит о пользователе (без хэша пароля)
+type Profile struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	Logins    []*Login  `json:"logins"`
 }
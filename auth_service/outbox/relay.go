@@ -0,0 +1,85 @@
+package outbox
+
+import (
+	"auth_service/database"
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	redis_utils "utils/redis"
+)
+
+const (
+	relayInterval  = 2 * time.Second
+	relayBatchSize = 100
+)
+
+// Publisher - куда публикуются события (Redis Streams)
+type Publisher interface {
+	PublishEvent(stream string, values map[string]interface{}) (string, error)
+}
+
+// Relay - публикует события из outbox и удаляет опубликованные. Событие удаляется
+// только после публикации, поэтому при сбое оно может быть опубликовано повторно:
+// обработчики событий должны быть идемпотентными. ID события в outbox публикуется
+// в поле event_id, по нему обработчик узнает повтор с новым ID в потоке.
+type Relay struct {
+	db        database.DBAdapter
+	publisher Publisher
+}
+
+func NewRelay(db database.DBAdapter, publisher Publisher) *Relay {
+	return &Relay{
+		db:        db,
+		publisher: publisher,
+	}
+}
+
+// Run - блокирует до отмены ctx
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+
+	for {
+		// Полная пачка - возможно, в outbox есть еще
+		for r.relay() == relayBatchSize {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Возвращает число опубликованных событий; на первой ошибке останавливается,
+// чтобы не нарушать порядок событий
+func (r *Relay) relay() int {
+	events, err := r.db.GetOutboxEvents(relayBatchSize)
+	if err != nil {
+		log.Printf("Outbox: Error: %v", err)
+		return 0
+	}
+
+	for i, event := range events {
+		values := make(map[string]interface{}, len(event.Values)+1)
+		for k, v := range event.Values {
+			values[k] = v
+		}
+		values[redis_utils.EventIDField] = strconv.FormatInt(event.ID, 10)
+
+		id, err := r.publisher.PublishEvent(event.Stream, values)
+		if err != nil {
+			log.Printf("Outbox: Error publishing event %d: %v", event.ID, err)
+			return i
+		}
+		if err := r.db.DeleteOutboxEvent(event.ID); err != nil {
+			log.Printf("Outbox: Error: %v", err)
+			return i
+		}
+		log.Printf("Outbox: event %d published to %s as %s", event.ID, event.Stream, id)
+	}
+	return len(events)
+}
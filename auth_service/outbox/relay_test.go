@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"auth_service/database"
+	"auth_service/models"
+	"errors"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	redis_utils "utils/redis"
+)
+
+type mockDB struct {
+	database.DBAdapter
+	events []*models.OutboxEvent
+}
+
+func (db *mockDB) GetOutboxEvents(limit int) ([]*models.OutboxEvent, error) {
+	events := append([]*models.OutboxEvent{}, db.events...)
+	if len(events) > limit {
+		return events[:limit], nil
+	}
+	return events, nil
+}
+
+func (db *mockDB) DeleteOutboxEvent(id int64) error {
+	for i, event := range db.events {
+		if event.ID == id {
+			db.events = append(db.events[:i], db.events[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no rows affected")
+}
+
+type mockPublisher struct {
+	published []int64
+	eventIDs  []string
+	failAfter int // сколько публикаций успешны; -1 - все
+}
+
+func (p *mockPublisher) PublishEvent(stream string, values map[string]interface{}) (string, error) {
+	if p.failAfter >= 0 && len(p.published) >= p.failAfter {
+		return "", errors.New("redis unavailable")
+	}
+	p.published = append(p.published, values["id"].(int64))
+	p.eventIDs = append(p.eventIDs, values[redis_utils.EventIDField].(string))
+	return "1-0", nil
+}
+
+func newEvents(n int) []*models.OutboxEvent {
+	events := make([]*models.OutboxEvent, n)
+	for i := range events {
+		id := int64(i + 1)
+		events[i] = &models.OutboxEvent{ID: id, Stream: "events", Values: map[string]interface{}{"id": id}}
+	}
+	return events
+}
+
+func TestRelay(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	t.Run("Publishes and deletes events in order", func(t *testing.T) {
+		db := &mockDB{events: newEvents(3)}
+		first := db.events[0]
+		publisher := &mockPublisher{failAfter: -1}
+
+		assert.Equal(t, 3, NewRelay(db, publisher).relay())
+		assert.Equal(t, []int64{1, 2, 3}, publisher.published)
+		assert.Equal(t, []string{"1", "2", "3"}, publisher.eventIDs)
+		assert.Empty(t, db.events)
+		// Событие в outbox не меняется
+		assert.NotContains(t, first.Values, redis_utils.EventIDField)
+	})
+
+	t.Run("Keeps events after publish failure", func(t *testing.T) {
+		db := &mockDB{events: newEvents(3)}
+		publisher := &mockPublisher{failAfter: 1}
+		relay := NewRelay(db, publisher)
+
+		assert.Equal(t, 1, relay.relay())
+		assert.Len(t, db.events, 2)
+		assert.Equal(t, int64(2), db.events[0].ID)
+
+		// После восстановления публикация продолжается с первого неопубликованного события
+		publisher.failAfter = -1
+		assert.Equal(t, 2, relay.relay())
+		assert.Equal(t, []int64{1, 2, 3}, publisher.published)
+		assert.Empty(t, db.events)
+	})
+}
@@ -1,22 +1,43 @@
 package api
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mock_service/blobstore"
 	"mock_service/database"
+	"mock_service/events"
+	"mock_service/takeout"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	json_utils "utils/json"
 	jwt_utils "utils/jwt"
 )
 
+// Максимальный размер тела записи в POST и PUT /data
+const maxItemBodySize = 1 << 20
+
 type API struct {
-	db database.DBAdapter
+	db      database.DBAdapter
+	takeout *takeout.Manager
+	schemas *schemaCache
+	feed    *events.Feed
+	blobs   blobstore.Store
+	// Проверка отзыва токенов открытых потоков событий
+	revocations jwt_utils.TokenRevocationChecker
+	// Ограничения размера вложений
+	attachments AttachmentConfig
 }
 
-func NewApi(db database.DBAdapter) *API {
-	return &API{db}
+func NewApi(db database.DBAdapter, revocations jwt_utils.TokenRevocationChecker, takeout *takeout.Manager,
+	feed *events.Feed, blobs blobstore.Store, attachments AttachmentConfig) *API {
+	return &API{db: db, revocations: revocations, takeout: takeout, schemas: newSchemaCache(), feed: feed,
+		blobs: blobs, attachments: attachments}
 }
 
 func (api *API) HandlerData(w http.ResponseWriter, req *http.Request) {
@@ -29,6 +50,8 @@ func (api *API) HandlerData(w http.ResponseWriter, req *http.Request) {
 		api.handleCreate(w, req)
 	case http.MethodPut:
 		api.handleUpdate(w, req)
+	case http.MethodPatch:
+		api.handlePatch(w, req)
 	case http.MethodDelete:
 		api.handleDelete(w, req)
 	default:
@@ -38,9 +61,12 @@ func (api *API) HandlerData(w http.ResponseWriter, req *http.Request) {
 
 func (api *API) handleCreate(w http.ResponseWriter, req *http.Request) {
 	var item database.DBItem
-	if err := json_utils.DecodeJSONBody(req, &item); err != nil {
+	if !decodeItemBody(w, req, &item) {
 		return
 	}
+	if c := req.PathValue("c"); c != "" {
+		item.Collection = c
+	}
 
 	claims, err := jwt_utils.GetClaimsFromContext(req)
 	if err != nil {
@@ -49,7 +75,20 @@ func (api *API) handleCreate(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	id, err := api.db.Insert(&item, claims.Subject)
+	if !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !api.validateItem(w, ownerHash(claims), 0, &item) {
+		return
+	}
+
+	id, err := api.db.Insert(&item, ownerHash(claims))
+	if errors.Is(err, database.ErrInvalidItem) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("handleCreate: Error: %v", err)
 		http.Error(w, "Failed to insert item", http.StatusInternalServerError)
@@ -68,7 +107,7 @@ func (api *API) handleUpdate(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var item database.DBItem
-	if err := json_utils.DecodeJSONBody(req, &item); err != nil {
+	if !decodeItemBody(w, req, &item) {
 		return
 	}
 
@@ -79,10 +118,29 @@ func (api *API) handleUpdate(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = api.db.Update(id, &item, claims.Subject)
+	if !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !api.validateItem(w, ownerHash(claims), id, &item) {
+		return
+	}
+
+	expectedVersion, ok := parseIfMatch(req)
+	if !ok {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	err = api.db.Update(id, &item, ownerHash(claims), expectedVersion)
 	if err != nil {
-		if err.Error() == "no rows affected" {
-			http.Error(w, "Item not found", http.StatusNotFound)
+		if err == database.ErrVersionMismatch {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		} else if errors.Is(err, database.ErrInvalidItem) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if err.Error() == "no rows affected" {
+			api.sendAccessError(w, id, ownerHash(claims))
 		} else {
 			log.Printf("handleUpdate: Error: %v", err)
 			http.Error(w, "Failed to update item", http.StatusInternalServerError)
@@ -108,10 +166,23 @@ func (api *API) handleDelete(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = api.db.Delete(id, claims.Subject)
+	if !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	expectedVersion, ok := parseIfMatch(req)
+	if !ok {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	err = api.db.Delete(id, ownerHash(claims), expectedVersion)
 	if err != nil {
-		if err.Error() == "no rows affected" {
-			http.Error(w, "Item not found", http.StatusNotFound)
+		if err == database.ErrVersionMismatch {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		} else if err.Error() == "no rows affected" {
+			api.sendAccessError(w, id, ownerHash(claims))
 		} else {
 			log.Printf("handleDelete: Error: %v", err)
 			http.Error(w, "Failed to delete item", http.StatusInternalServerError)
@@ -138,41 +209,276 @@ func (api *API) handleGet(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	item, err := api.db.Get(id, claims.Subject)
+	if req.URL.Query().Has("version") {
+		api.handleGetRevision(w, req, id, ownerHash(claims))
+		return
+	}
+
+	item, err := api.db.Get(id, ownerHash(claims))
+	if errors.Is(err, database.ErrNotFound) {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Printf("handleGet: Error in Get - %v", err)
 		http.Error(w, "Failed to get item", http.StatusInternalServerError)
 		return
 	}
 
+	etag := itemETag(item.Version)
+	w.Header().Set("ETag", etag)
+	if matchesIfNoneMatch(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	json_utils.SendJSONResponse(w, http.StatusOK, item)
 	log.Println("handleGet: finished successfully")
 }
 
+// HandlerList - список записей. Без limit и after - все записи массивом, как раньше
+// (массив отдается потоком по страницам); с ними - страница {items, next}.
+// Параметры: limit, after (курсор), prefix, created_after, created_before (RFC 3339),
+// sort (id, name, created_at, updated_at; "-" перед полем - по убыванию), shared=true, collection.
+// Фильтры по value: contains (JSON, value @> contains), has_key (можно несколько),
+// jsonpath (предикат, value @? jsonpath), where=путь.через.точку:оператор:значение
+// (операторы eq, ne, gt, gte, lt, lte; можно несколько).
 func (api *API) HandlerList(w http.ResponseWriter, req *http.Request) {
 	log.Println("HandlerList called")
 
 	claims, err := jwt_utils.GetClaimsFromContext(req)
 	if err != nil {
-		log.Printf("handleUpdate: Error: %v", err)
+		log.Printf("HandlerList: Error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	items, err := api.db.GetAll(claims.Subject)
+	opts, err := parseListOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := req.URL.Query()
+	paginated := query.Has("limit") || query.Has("after")
+	if !paginated {
+		opts.Limit = database.MaxListLimit
+	}
+
+	// Первая страница запрашивается до начала ответа, чтобы ошибки фильтров вернуть как 400
+	items, next, err := api.db.GetAll(ownerHash(claims), opts)
 	if err != nil {
+		if err == database.ErrInvalidCursor || errors.Is(err, database.ErrInvalidFilter) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		log.Printf("HandlerList: Error in GetAll - %v", err)
 		http.Error(w, "Failed to get item list", http.StatusInternalServerError)
 		return
 	}
 
-	json_utils.SendJSONResponse(w, http.StatusOK, items)
+	if !paginated {
+		// Ответ уже начат, поэтому при ошибке массив просто обрывается
+		if err := api.streamList(w, ownerHash(claims), opts, items, next); err != nil {
+			log.Printf("HandlerList: Error: %v", err)
+			return
+		}
+		log.Println("HandlerList: finished successfully")
+		return
+	}
+
+	page := listPage{Items: items}
+	if page.Items == nil {
+		page.Items = []*database.DBItem{}
+	}
+	if next != "" {
+		query.Set("after", next)
+		page.Next = req.URL.Path + "?" + query.Encode()
+	}
+	json_utils.SendJSONResponse(w, http.StatusOK, page)
 	log.Println("HandlerList: finished successfully")
 }
 
+// Пишет JSON-массив из первой страницы items и всех следующих страниц, начиная с курсора next
+func (api *API) streamList(w http.ResponseWriter, userHash string, opts *database.ListOptions, items []*database.DBItem, next string) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	out := bufio.NewWriter(w)
+	out.WriteString("[")
+	first := true
+	write := func(item *database.DBItem) error {
+		if !first {
+			out.WriteString(",")
+		}
+		first = false
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+
+	for _, item := range items {
+		if err := write(item); err != nil {
+			return err
+		}
+	}
+	if next != "" {
+		rest := *opts
+		rest.After = next
+		if err := api.eachItem(userHash, &rest, write); err != nil {
+			return err
+		}
+	}
+	out.WriteString("]\n")
+	return out.Flush()
+}
+
+type listPage struct {
+	Items []*database.DBItem `json:"items"`
+	Next  string             `json:"next,omitempty"` // ссылка на следующую страницу
+}
+
+func parseListOptions(req *http.Request) (*database.ListOptions, error) {
+	query := req.URL.Query()
+	opts := &database.ListOptions{
+		After:      query.Get("after"),
+		NamePrefix: query.Get("prefix"),
+		Shared:     query.Get("shared") == "true",
+		Collection: query.Get("collection"),
+		HasKeys:    query["has_key"],
+		JSONPath:   query.Get("jsonpath"),
+	}
+
+	if v := query.Get("contains"); v != "" {
+		if !json.Valid([]byte(v)) {
+			return nil, fmt.Errorf("invalid contains")
+		}
+		opts.Contains = json.RawMessage(v)
+	}
+
+	for _, v := range query["where"] {
+		parts := strings.SplitN(v, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid where, expected path:op:value")
+		}
+		opts.Where = append(opts.Where, database.ValueFilter{
+			Path:  strings.Split(parts[0], "."),
+			Op:    parts[1],
+			Value: parts[2],
+		})
+	}
+
+	if c := req.PathValue("c"); c != "" {
+		opts.Collection = c
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		opts.Limit = limit
+	}
+
+	sort := query.Get("sort")
+	if strings.HasPrefix(sort, "-") {
+		opts.Desc = true
+		sort = sort[1:]
+	}
+	switch sort {
+	case "", database.SortByID, database.SortByName, database.SortByCreatedAt, database.SortByUpdatedAt:
+		opts.Sort = sort
+	default:
+		return nil, fmt.Errorf("invalid sort field")
+	}
+
+	for name, dst := range map[string]**time.Time{
+		"created_after":  &opts.CreatedAfter,
+		"created_before": &opts.CreatedBefore,
+	} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", name)
+			}
+			*dst = &t
+		}
+	}
+
+	return opts, nil
+}
+
+// Проверка записи по привязанной схеме; при ошибке ответ уже отправлен
+func (api *API) validateItem(w http.ResponseWriter, userHash string, id int64, item *database.DBItem) bool {
+	se, err := api.checkItem(userHash, id, item)
+	if err != nil {
+		log.Printf("validateItem: Error: %v", err)
+		http.Error(w, "Failed to validate item", http.StatusInternalServerError)
+		return false
+	}
+	if se != nil {
+		sendSchemaError(w, se)
+		return false
+	}
+	return true
+}
+
+// Тело записи не больше maxItemBodySize; при ошибке ответ уже отправлен
+func decodeItemBody(w http.ResponseWriter, req *http.Request, item *database.DBItem) bool {
+	req.Body = http.MaxBytesReader(w, req.Body, maxItemBodySize)
+	err := json_utils.DecodeJSONBody(req, item)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Запись не изменилась: ее нет или у пользователя недостаточно прав
+func (api *API) sendAccessError(w http.ResponseWriter, id int64, userHash string) {
+	if _, err := api.db.Get(id, userHash); err == nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	http.Error(w, "Item not found", http.StatusNotFound)
+}
+
+// Владелец записей, от имени которого выполняется запрос: пользователь или,
+// если токен выдан от имени организации, сама организация.
+// Записи организации хранятся в _user2items под идентификатором "org:<id>".
+func ownerHash(claims *jwt_utils.Claims) string {
+	if claims.Org != nil {
+		return fmt.Sprintf("org:%d", claims.Org.ID)
+	}
+	return claims.Subject
+}
+
+// Наблюдатели организации могут только читать ее записи
+func canWrite(claims *jwt_utils.Claims) bool {
+	return claims.Org == nil || claims.Org.Role != jwt_utils.OrgRoleViewer
+}
+
+// Операции уровня владельца (передача владения, окончательное удаление, вебхуки)
+// в организации доступны только ее владельцам и администраторам
+func canManage(claims *jwt_utils.Claims) bool {
+	return claims.Org == nil || claims.Org.Role == jwt_utils.OrgRoleOwner || claims.Org.Role == jwt_utils.OrgRoleAdmin
+}
+
 // Вспомогательная функция для парсинга параметра ID из URL.
 func parseIDParam(req *http.Request) (int64, error) {
 	idParam := req.URL.Query().Get("id")
+	// В маршрутах вида /collections/{c}/items/{id} ID - часть пути
+	if v := req.PathValue("id"); v != "" {
+		idParam = v
+	}
 	if idParam == "" {
 		return 0, fmt.Errorf("ID parameter is required")
 	}
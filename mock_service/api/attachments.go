@@ -0,0 +1,378 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mock_service/blobstore"
+	"mock_service/database"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// AttachmentConfig - ограничения размера вложений
+type AttachmentConfig struct {
+	MaxSize int64 `json:"max_size"` // одно вложение, байт
+	Quota   int64 `json:"quota"`    // все вложения, загруженные пользователем, байт
+}
+
+const (
+	maxAttachmentNameLength = 255
+	// Сколько загруженный объект ждет прикрепления к записи, прежде чем его удалит сборщик
+	attachmentUploadGuard = time.Hour
+)
+
+// HandlerAttachments - /data/{id}/attachments. GET: вложения записи, POST: загрузка вложения.
+// Загрузка принимает multipart/form-data (поле "file", имя - из имени файла или ?name=)
+// или само содержимое в теле запроса с ?name=. Вложение с тем же именем заменяется.
+func (api *API) HandlerAttachments(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerAttachments called. METHOD: %s", req.Method)
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerAttachments: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		attachments, err := api.db.GetAttachments(id, ownerHash(claims))
+		if err != nil {
+			if err.Error() == "no rows affected" {
+				http.Error(w, "Item not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("HandlerAttachments: Error in GetAttachments - %v", err)
+			http.Error(w, "Failed to get attachments", http.StatusInternalServerError)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, attachments)
+	case http.MethodPost:
+		if !canWrite(claims) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		api.handleUpload(w, req, id, ownerHash(claims))
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerAttachment - /data/{id}/attachments/{name}. GET: содержимое вложения, DELETE: удаление.
+func (api *API) HandlerAttachment(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerAttachment called. METHOD: %s", req.Method)
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := req.PathValue("name")
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerAttachment: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		api.handleDownload(w, req, id, ownerHash(claims), name)
+	case http.MethodDelete:
+		if !canWrite(claims) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		err := api.db.DeleteAttachment(id, ownerHash(claims), name)
+		if err != nil {
+			if err.Error() == "no rows affected" {
+				api.sendAttachmentAccessError(w, id, ownerHash(claims))
+				return
+			}
+			log.Printf("HandlerAttachment: Error in DeleteAttachment - %v", err)
+			http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Attachment deleted successfully"})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *API) handleUpload(w http.ResponseWriter, req *http.Request, id int64, userHash string) {
+	// Права проверяются до чтения тела, чтобы не принимать файл впустую
+	item, err := api.db.Get(id, userHash)
+	if err != nil {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+	if item.Permission == database.PermissionRead {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	usage, err := api.db.GetAttachmentUsage(userHash)
+	if err != nil {
+		log.Printf("handleUpload: Error in GetAttachmentUsage - %v", err)
+		http.Error(w, "Failed to upload attachment", http.StatusInternalServerError)
+		return
+	}
+	limit := min(api.attachments.MaxSize, max(api.attachments.Quota-usage, 0))
+	if req.ContentLength > limit && !isMultipart(req) {
+		sendSizeError(w, req.ContentLength, api.attachments.MaxSize)
+		return
+	}
+
+	name, contentType, body, err := uploadSource(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateAttachmentName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Содержимое сначала сохраняется во временный файл: размер и SHA-256 нужны
+	// до записи в хранилище (S3 проверяет по ним тело запроса)
+	tmp, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		log.Printf("handleUpload: Error: %v", err)
+		http.Error(w, "Failed to upload attachment", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, limit+1))
+	if err != nil {
+		log.Printf("handleUpload: Error reading body - %v", err)
+		http.Error(w, "Failed to read attachment", http.StatusBadRequest)
+		return
+	}
+	if size > limit {
+		sendSizeError(w, size, api.attachments.MaxSize)
+		return
+	}
+
+	if contentType == "" {
+		contentType, err = sniffContentType(tmp)
+		if err != nil {
+			log.Printf("handleUpload: Error: %v", err)
+			http.Error(w, "Failed to upload attachment", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		log.Printf("handleUpload: Error: %v", err)
+		http.Error(w, "Failed to upload attachment", http.StatusInternalServerError)
+		return
+	}
+
+	attachment := &database.Attachment{
+		ItemID:      id,
+		Name:        name,
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+	}
+	if err := api.storeAttachment(req, userHash, attachment, tmp); err != nil {
+		switch {
+		case errors.Is(err, database.ErrQuotaExceeded):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case err.Error() == "no rows affected":
+			api.sendAccessError(w, id, userHash)
+		default:
+			log.Printf("handleUpload: Error: %v", err)
+			http.Error(w, "Failed to upload attachment", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/data/%d/attachments/%s", id, url.PathEscape(name)))
+	json_utils.SendJSONResponse(w, http.StatusCreated, attachment)
+	log.Printf("handleUpload: attachment %q (%d bytes) uploaded to item %d", name, size, id)
+}
+
+// Записывает содержимое в хранилище и прикрепляет к записи. До прикрепления объект
+// защищен от сборщика на attachmentUploadGuard, после неудачи удаляется сразу.
+func (api *API) storeAttachment(req *http.Request, userHash string, attachment *database.Attachment, content io.Reader) error {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	attachment.BlobKey = hex.EncodeToString(key)
+
+	if err := api.db.ScheduleBlobGC(attachment.BlobKey, attachmentUploadGuard); err != nil {
+		return err
+	}
+
+	blob := &blobstore.Blob{Size: attachment.Size, ContentType: attachment.ContentType, SHA256: attachment.SHA256}
+	if err := api.blobs.Put(req.Context(), attachment.BlobKey, content, blob); err != nil {
+		return err
+	}
+
+	if err := api.db.CreateAttachment(userHash, attachment, api.attachments.Quota); err != nil {
+		if delErr := api.blobs.Delete(req.Context(), attachment.BlobKey); delErr != nil {
+			log.Printf("storeAttachment: Error deleting blob %s - %v", attachment.BlobKey, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (api *API) handleDownload(w http.ResponseWriter, req *http.Request, id int64, userHash string, name string) {
+	attachment, err := api.db.GetAttachment(id, userHash, name)
+	if err != nil {
+		if err.Error() == "no rows affected" {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("handleDownload: Error in GetAttachment - %v", err)
+		http.Error(w, "Failed to get attachment", http.StatusInternalServerError)
+		return
+	}
+
+	// Содержимое неизменно, пока не совпадает хэш
+	etag := `"` + attachment.SHA256 + `"`
+	w.Header().Set("ETag", etag)
+	if matchesIfNoneMatch(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	content, err := api.blobs.Get(req.Context(), attachment.BlobKey)
+	if err != nil {
+		log.Printf("handleDownload: Error reading blob %s - %v", attachment.BlobKey, err)
+		http.Error(w, "Failed to get attachment", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	// Браузер не должен исполнять загруженный пользователем HTML как страницу сервиса
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, content); err != nil {
+		log.Printf("handleDownload: Error: %v", err)
+	}
+}
+
+// Вложение не удалено: нет записи, недостаточно прав или нет вложения
+func (api *API) sendAttachmentAccessError(w http.ResponseWriter, id int64, userHash string) {
+	item, err := api.db.Get(id, userHash)
+	if err != nil {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+	if item.Permission == database.PermissionRead {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	http.Error(w, "Attachment not found", http.StatusNotFound)
+}
+
+func isMultipart(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// Имя, тип и содержимое загружаемого файла. Тип "" - определить по содержимому.
+func uploadSource(req *http.Request) (string, string, io.Reader, error) {
+	name := req.URL.Query().Get("name")
+	if !isMultipart(req) {
+		return name, req.Header.Get("Content-Type"), req.Body, nil
+	}
+
+	// Части читаются потоком, без буферизации всей формы в памяти
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return "", "", nil, errors.New("invalid multipart body")
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", "", nil, errors.New(`multipart field "file" is required`)
+		}
+		if err != nil {
+			return "", "", nil, errors.New("invalid multipart body")
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		if name == "" {
+			name = part.FileName()
+		}
+		return name, partContentType(part), part, nil
+	}
+}
+
+// Браузеры отправляют application/octet-stream, если тип файла неизвестен
+func partContentType(part *multipart.Part) string {
+	contentType := part.Header.Get("Content-Type")
+	if contentType == "application/octet-stream" {
+		return ""
+	}
+	return contentType
+}
+
+func sniffContentType(f *os.File) (string, error) {
+	buf := make([]byte, 512)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+func validateAttachmentName(name string) error {
+	if name == "" {
+		return errors.New("attachment name is required")
+	}
+	if len(name) > maxAttachmentNameLength {
+		return fmt.Errorf("attachment name is longer than %d bytes", maxAttachmentNameLength)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return errors.New("attachment name must not be a path")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return errors.New("attachment name must not contain control characters")
+		}
+	}
+	return nil
+}
+
+// Превышен размер одного вложения или квота пользователя
+func sendSizeError(w http.ResponseWriter, size int64, maxSize int64) {
+	if size > maxSize {
+		http.Error(w, fmt.Sprintf("attachment is larger than %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, database.ErrQuotaExceeded.Error(), http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mock_service/database"
+	"net/http"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// Режимы пакетной обработки
+const (
+	batchModeAtomic      = "atomic"      // все операции или ни одной
+	batchModeIndependent = "independent" // ошибка операции отменяет только ее
+)
+
+// Ограничения размера пакета
+const (
+	maxBatchOperations = 10000
+	maxBatchBodySize   = 32 << 20
+)
+
+// Операции пакета
+const (
+	batchOpCreate = "create"
+	batchOpUpdate = "update"
+	batchOpDelete = "delete"
+)
+
+type batchOperation struct {
+	Op      string          `json:"op"`
+	ID      int64           `json:"id,omitempty"`      // для update и delete
+	Version int64           `json:"version,omitempty"` // ожидаемая версия записи, 0 - не проверять
+	Item    database.DBItem `json:"item"`              // для create и update
+}
+
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+// Результат операции; Status - HTTP-код, который вернул бы одиночный запрос
+type batchResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	ID     int64  `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Violations []schemaViolation `json:"violations,omitempty"` // при несоответствии схеме
+}
+
+type batchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []batchResult `json:"results"`
+}
+
+// HandlerBatch - POST /data/batch: создание, изменение и удаление записей в одной транзакции.
+// В режиме atomic первая ошибка отменяет весь пакет, в режиме independent - только свою операцию.
+func (api *API) HandlerBatch(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerBatch called")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var input batchRequest
+	req.Body = http.MaxBytesReader(w, req.Body, maxBatchBodySize)
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := validateBatch(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerBatch: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	response, status, err := api.runBatch(&input, ownerHash(claims))
+	if err != nil {
+		log.Printf("HandlerBatch: Error: %v", err)
+		http.Error(w, "Failed to process batch", http.StatusInternalServerError)
+		return
+	}
+
+	json_utils.SendJSONResponse(w, status, response)
+	log.Printf("HandlerBatch: %d operations, mode %s, committed: %v", len(input.Operations), input.Mode, response.Committed)
+}
+
+func validateBatch(input *batchRequest) error {
+	if input.Mode == "" {
+		input.Mode = batchModeAtomic
+	}
+	if input.Mode != batchModeAtomic && input.Mode != batchModeIndependent {
+		return fmt.Errorf("unknown mode %s", input.Mode)
+	}
+	if len(input.Operations) == 0 || len(input.Operations) > maxBatchOperations {
+		return fmt.Errorf("batch must contain from 1 to %d operations", maxBatchOperations)
+	}
+
+	for i, op := range input.Operations {
+		switch op.Op {
+		case batchOpCreate:
+		case batchOpUpdate, batchOpDelete:
+			if op.ID <= 0 {
+				return fmt.Errorf("operation %d: id is required", i)
+			}
+		default:
+			return fmt.Errorf("operation %d: unknown op %s", i, op.Op)
+		}
+	}
+	return nil
+}
+
+// Возвращает ответ и его HTTP-код; ошибка - сбой самой транзакции
+func (api *API) runBatch(input *batchRequest, owner string) (*batchResponse, int, error) {
+	tx, err := api.db.BeginTx()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	response := &batchResponse{Results: make([]batchResult, 0, len(input.Operations))}
+	for i := range input.Operations {
+		if input.Mode == batchModeIndependent {
+			if err := tx.Savepoint("batch_op"); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		result := api.runBatchOperation(tx, &input.Operations[i], owner)
+		result.Index = i
+		response.Results = append(response.Results, result)
+
+		failed := result.Status != http.StatusOK
+		if input.Mode == batchModeAtomic {
+			if failed {
+				// Пакет не применяется; код ответа - код операции, из-за которой он отменен
+				return response, result.Status, nil
+			}
+			continue
+		}
+
+		if failed {
+			err = tx.RollbackTo("batch_op")
+		} else {
+			err = tx.Release("batch_op")
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	response.Committed = true
+	return response, http.StatusOK, nil
+}
+
+func (api *API) runBatchOperation(tx database.DBTx, op *batchOperation, owner string) batchResult {
+	result := batchResult{ID: op.ID}
+	if op.Op != batchOpDelete {
+		se, err := api.checkItem(owner, op.ID, &op.Item)
+		if err != nil {
+			log.Printf("HandlerBatch: operation %s failed: %v", op.Op, err)
+			result.Status, result.Error = http.StatusInternalServerError, "Internal error"
+			return result
+		}
+		if se != nil {
+			result.Status, result.Error, result.Violations = http.StatusUnprocessableEntity, se.Error, se.Violations
+			return result
+		}
+	}
+
+	var err error
+	switch op.Op {
+	case batchOpCreate:
+		result.ID, err = tx.Insert(&op.Item, owner)
+	case batchOpUpdate:
+		err = tx.Update(op.ID, &op.Item, owner, op.Version)
+	case batchOpDelete:
+		err = tx.Delete(op.ID, owner, op.Version)
+	}
+
+	switch {
+	case err == nil:
+		result.Status = http.StatusOK
+	case err == database.ErrVersionMismatch:
+		result.Status, result.Error = http.StatusPreconditionFailed, err.Error()
+	case errors.Is(err, database.ErrInvalidItem):
+		result.Status, result.Error = http.StatusBadRequest, err.Error()
+	case err.Error() == "no rows affected":
+		result.Status, result.Error = http.StatusNotFound, "Item not found"
+	default:
+		log.Printf("HandlerBatch: operation %s failed: %v", op.Op, err)
+		result.Status, result.Error = http.StatusInternalServerError, "Internal error"
+	}
+	return result
+}
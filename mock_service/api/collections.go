@@ -0,0 +1,192 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"mock_service/database"
+	"net/http"
+	"strings"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+type collectionRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Schema      string `json:"schema"`
+}
+
+// HandlerCollections - GET: коллекции владельца, POST: создание коллекции
+func (api *API) HandlerCollections(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerCollections called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerCollections: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		collections, err := api.db.GetCollections(ownerHash(claims))
+		if err != nil {
+			log.Printf("HandlerCollections: Error in GetCollections - %v", err)
+			http.Error(w, "Failed to get collections", http.StatusInternalServerError)
+			return
+		}
+		if collections == nil {
+			collections = []*database.Collection{}
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, collections)
+	case http.MethodPost:
+		var input collectionRequest
+		if err := json_utils.DecodeJSONBody(req, &input); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		// Имя коллекции - часть пути /collections/{c}
+		if input.Name == "" || strings.Contains(input.Name, "/") {
+			http.Error(w, "Invalid collection name", http.StatusBadRequest)
+			return
+		}
+		if !canWrite(claims) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		collection := &database.Collection{Name: input.Name, Description: input.Description, Schema: input.Schema}
+		if err := api.db.CreateCollection(ownerHash(claims), collection); err != nil {
+			sendCollectionError(w, "CreateCollection", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, collection)
+		log.Printf("HandlerCollections: collection %s created", collection.Name)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerCollection - /collections/{c}. GET: коллекция, PUT: описание и схема, DELETE: удаление пустой коллекции
+func (api *API) HandlerCollection(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerCollection called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerCollection: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner := ownerHash(claims)
+	name := req.PathValue("c")
+
+	if req.Method != http.MethodGet && !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		collection, err := api.db.GetCollection(owner, name)
+		if err != nil {
+			sendCollectionError(w, "GetCollection", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, collection)
+	case http.MethodPut:
+		var input collectionRequest
+		if err := json_utils.DecodeJSONBody(req, &input); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+
+		collection := &database.Collection{Name: name, Description: input.Description, Schema: input.Schema}
+		if err := api.db.UpdateCollection(owner, collection); err != nil {
+			sendCollectionError(w, "UpdateCollection", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Collection updated successfully"})
+	case http.MethodDelete:
+		if name == database.DefaultCollection {
+			http.Error(w, "Default collection cannot be deleted", http.StatusConflict)
+			return
+		}
+		if err := api.db.DeleteCollection(owner, name); err != nil {
+			sendCollectionError(w, "DeleteCollection", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Collection deleted successfully"})
+		log.Printf("HandlerCollection: collection %s deleted", name)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerCollectionItems - /collections/{c}/items. GET: записи коллекции (параметры как у /list), POST: создание записи
+func (api *API) HandlerCollectionItems(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerCollectionItems called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerCollectionItems: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := api.db.GetCollection(ownerHash(claims), req.PathValue("c")); err != nil {
+		sendCollectionError(w, "GetCollection", err)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		api.HandlerList(w, req)
+	case http.MethodPost:
+		api.handleCreate(w, req)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerCollectionItem - /collections/{c}/items/{id}, те же методы, что у /data
+func (api *API) HandlerCollectionItem(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerCollectionItem called. METHOD: %s", req.Method)
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerCollectionItem: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	item, err := api.db.Get(id, ownerHash(claims))
+	if err != nil || item.Collection != req.PathValue("c") {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	api.HandlerData(w, req)
+}
+
+func sendCollectionError(w http.ResponseWriter, op string, err error) {
+	switch {
+	case err == database.ErrAlreadyExists:
+		http.Error(w, "Collection already exists", http.StatusConflict)
+	case err == database.ErrNotEmpty:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, database.ErrInvalidItem):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err.Error() == "no rows affected":
+		http.Error(w, "Collection not found", http.StatusNotFound)
+	default:
+		log.Printf("%s: Error: %v", op, err)
+		http.Error(w, "Failed to process collection", http.StatusInternalServerError)
+	}
+}
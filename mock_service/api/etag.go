@@ -0,0 +1,47 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ETag записи - ее версия
+func itemETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// Версия из If-Match. 0 - заголовка нет или "*", проверять не нужно.
+// ok=false - заголовок не соответствует ни одной версии.
+func parseIfMatch(req *http.Request) (int64, bool) {
+	header := strings.TrimSpace(req.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+
+	// Для If-Match нужно строгое сравнение, слабые теги не подходят
+	if !strings.HasPrefix(header, `"`) || !strings.HasSuffix(header, `"`) || len(header) < 2 {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// Совпадает ли If-None-Match с ETag (слабое сравнение, допускается список тегов)
+func matchesIfNoneMatch(req *http.Request, etag string) bool {
+	header := req.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mock_service/database"
+	"mock_service/events"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+const (
+	// Сколько пропущенных событий читается за один запрос при возобновлении
+	eventsReplayPage = 500
+	// Интервал пустых сообщений, по которым прокси и клиент видят, что соединение живо
+	eventsKeepalive = 30 * time.Second
+	// Как часто открытый поток проверяет, не отозван ли токен
+	eventsRevocationCheck = 10 * time.Second
+	wsWriteTimeout        = 10 * time.Second
+)
+
+var (
+	errSlowSubscriber = errors.New("subscriber is too slow")
+	errTokenExpired   = errors.New("token expired")
+	errTokenRevoked   = errors.New("token is revoked")
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{jwt_utils.TokenSubprotocol},
+}
+
+// HandlerEventsToken - POST: токен для подключения к ленте из браузера, где EventSource и
+// WebSocket не передают заголовок Authorization. Действует только для /events и /events/ws,
+// истекает и отзывается вместе с токеном запроса. Для токенов DPoP не выдается: клиент
+// с ключом подключается с заголовками Authorization и DPoP.
+func (api *API) HandlerEventsToken(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerEventsToken called")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerEventsToken: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	parent, err := jwt_utils.GetTokenFromContext(req)
+	if err != nil {
+		log.Printf("HandlerEventsToken: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := jwt_utils.GenerateAudienceJWT(claims, parent, events.TokenAudience)
+	if err == jwt_utils.ErrTokenBound {
+		http.Error(w, "Stream tokens are not issued for DPoP-bound tokens", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("HandlerEventsToken: Error in GenerateAudienceJWT - %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"token": token}
+	if claims.ExpiresAt != nil {
+		response["expires_at"] = claims.ExpiresAt.Time
+	}
+	json_utils.SendJSONResponse(w, http.StatusOK, response)
+}
+
+// HandlerEvents - лента изменений записей пользователя в формате Server-Sent Events.
+// Возобновление: заголовок Last-Event-ID или параметр last_event_id.
+// Поток закрывается, когда токен истекает или отзывается.
+func (api *API) HandlerEvents(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerEvents called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerEvents: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, err := jwt_utils.GetTokenFromContext(req)
+	if err != nil {
+		log.Printf("HandlerEvents: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	lastID, err := parseLastEventID(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Отключает буферизацию ответа в nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("HandlerEvents: Error: %v", err)
+		return
+	}
+
+	send := func(e *database.ItemEvent) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	keepalive := func() error {
+		if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	err = api.streamEvents(req.Context(), claims, token, lastID, send, keepalive)
+	log.Printf("HandlerEvents: stream closed: %v", err)
+}
+
+// HandlerEventsWS - та же лента через WebSocket, по одному JSON-сообщению на событие.
+// Возобновление: параметр last_event_id.
+func (api *API) HandlerEventsWS(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerEventsWS called")
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerEventsWS: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, err := jwt_utils.GetTokenFromContext(req)
+	if err != nil {
+		log.Printf("HandlerEventsWS: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	lastID, err := parseLastEventID(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// При ошибке Upgrade сам отправляет ответ клиенту
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Printf("HandlerEventsWS: Error in Upgrade - %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	// Сообщения от клиента не ожидаются, но чтение нужно для обработки close и pong
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e *database.ItemEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteJSON(e)
+	}
+	keepalive := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+	}
+
+	err = api.streamEvents(ctx, claims, token, lastID, send, keepalive)
+	switch err {
+	case errSlowSubscriber:
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+	case errTokenExpired, errTokenRevoked:
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+	}
+	log.Printf("HandlerEventsWS: stream closed: %v", err)
+}
+
+// streamEvents - передает события, пропущенные после lastID, затем новые, до отмены ctx,
+// ошибки отправки, истечения или отзыва токена
+func (api *API) streamEvents(ctx context.Context, claims *jwt_utils.Claims, token string, lastID int64,
+	send func(*database.ItemEvent) error, keepalive func() error) error {
+	userHash := ownerHash(claims)
+
+	// Подписка оформляется до чтения пропущенных событий, чтобы ничего не потерять;
+	// события, уже отправленные из таблицы, отбрасываются по ID
+	sub := api.feed.Subscribe(userHash)
+	defer api.feed.Unsubscribe(sub)
+
+	replayed := lastID
+	sent := make(map[int64]bool)
+	replay := func(events []*database.ItemEvent) error {
+		for _, e := range events {
+			if err := send(e); err != nil {
+				return err
+			}
+			sent[e.ID] = true
+			replayed = max(replayed, e.ID)
+		}
+		return nil
+	}
+	if lastID > 0 {
+		// События с меньшим ID, зафиксированные после lastID; клиент мог получить часть из них
+		late, err := api.db.GetLateEvents(userHash, lastID, eventsReplayPage)
+		if err != nil {
+			return err
+		}
+		if err := replay(late); err != nil {
+			return err
+		}
+		for {
+			events, err := api.db.GetEvents(userHash, replayed, eventsReplayPage)
+			if err != nil {
+				return err
+			}
+			if err := replay(events); err != nil {
+				return err
+			}
+			if len(events) < eventsReplayPage {
+				break
+			}
+		}
+	}
+
+	ticker := time.NewTicker(eventsKeepalive)
+	defer ticker.Stop()
+	check := time.NewTicker(eventsRevocationCheck)
+	defer check.Stop()
+
+	var expired <-chan time.Time
+	if claims.ExpiresAt != nil {
+		timer := time.NewTimer(time.Until(claims.ExpiresAt.Time))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-sub.Events:
+			if !ok {
+				return errSlowSubscriber
+			}
+			// Событие с ID не больше replayed, но не из таблицы - зафиксировано позже
+			if sent[e.ID] {
+				continue
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := keepalive(); err != nil {
+				return err
+			}
+		case <-check.C:
+			if err := api.checkStreamToken(claims, token); err != nil {
+				return err
+			}
+		case <-expired:
+			return errTokenExpired
+		}
+	}
+}
+
+// checkStreamToken - errTokenRevoked, если токен потока отозван (сам, вместе со всеми
+// токенами пользователя или вместе с токеном, из которого выпущен)
+func (api *API) checkStreamToken(claims *jwt_utils.Claims, token string) error {
+	revoked, err := api.revocations.IsTokenRevoked(token)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		if revoked, err = jwt_utils.IsUserTokenRevoked(api.revocations, claims); err != nil {
+			return err
+		}
+	}
+	if !revoked {
+		if revoked, err = jwt_utils.IsParentTokenRevoked(api.revocations, claims); err != nil {
+			return err
+		}
+	}
+	if revoked {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+func parseLastEventID(req *http.Request) (int64, error) {
+	v := req.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = req.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("invalid last event id")
+	}
+	return id, nil
+}
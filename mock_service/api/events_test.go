@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"mock_service/events"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt_utils "utils/jwt"
+)
+
+// Заглушка списка отозванных токенов: токены хранятся по хэшу, как в redis
+type revokedTokens map[string]bool
+
+func (r revokedTokens) IsTokenRevoked(token string) (bool, error) {
+	return r[jwt_utils.HashToken(token)], nil
+}
+
+func (r revokedTokens) IsTokenHashRevoked(hash string) (bool, error) {
+	return r[hash], nil
+}
+
+func (r revokedTokens) IsUserRevoked(userHash string, issuedAt time.Time) (bool, error) {
+	return false, nil
+}
+
+func requestStreamToken(api *API, claims *jwt_utils.Claims, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/events/token", nil)
+	ctx := context.WithValue(req.Context(), "claims", claims)
+	req = req.WithContext(context.WithValue(ctx, "token", token))
+	w := httptest.NewRecorder()
+	api.HandlerEventsToken(w, req)
+	return w
+}
+
+func TestStreamTokenRevokedWithParent(t *testing.T) {
+	jwt_utils.InitJwtSecret("test-secret")
+	revoked := revokedTokens{}
+	api := NewApi(nil, revoked, nil, nil, nil, AttachmentConfig{})
+
+	claims := jwt_utils.NewClaims("alice", jwt_utils.NewUserInfo())
+	parent, err := jwt_utils.SignClaims(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := requestStreamToken(api, claims, parent)
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %q", w.Code, w.Body.String())
+	}
+	streamClaims, err := jwt_utils.GetJWTClaims(response.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streamClaims.Audience) != 1 || streamClaims.Audience[0] != events.TokenAudience {
+		t.Fatalf("audience = %v", streamClaims.Audience)
+	}
+
+	if err := api.checkStreamToken(streamClaims, response.Token); err != nil {
+		t.Fatalf("checkStreamToken() before logout = %v", err)
+	}
+	// Выход с исходным токеном закрывает потоки, открытые с выпущенным из него
+	revoked[jwt_utils.HashToken(parent)] = true
+	if err := api.checkStreamToken(streamClaims, response.Token); err != errTokenRevoked {
+		t.Fatalf("checkStreamToken() after logout = %v, want errTokenRevoked", err)
+	}
+}
+
+func TestStreamTokenNotIssuedForDPoP(t *testing.T) {
+	jwt_utils.InitJwtSecret("test-secret")
+	api := NewApi(nil, revokedTokens{}, nil, nil, nil, AttachmentConfig{})
+
+	claims := &jwt_utils.Claims{Cnf: &jwt_utils.Confirmation{JKT: "thumbprint"}}
+	claims.Subject = "alice"
+	if w := requestStreamToken(api, claims, "token"); w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"mock_service/database"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt_utils "utils/jwt"
+)
+
+// Форматы выгрузки и загрузки записей
+const (
+	formatNDJSON = "ndjson" // одна запись в формате JSON на строку
+	formatCSV    = "csv"    // поля value развернуты в колонки value.<путь>
+)
+
+// Колонки CSV перед колонками value
+var csvColumns = []string{"id", "name", "collection", "version", "created_at", "updated_at", "expires_at"}
+
+// Префикс колонок value. Путь - ключи вложенных объектов через точку; точка и обратная
+// косая черта в самих ключах экранируются обратной косой чертой.
+const csvValuePrefix = "value."
+
+// HandlerExport - GET /export: записи пользователя потоком в формате format (ndjson, csv;
+// по умолчанию по заголовку Accept, иначе ndjson). Параметры: collection, shared=true.
+func (api *API) HandlerExport(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerExport called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format, err := exportFormat(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerExport: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	opts := &database.ListOptions{
+		Limit:      database.MaxListLimit,
+		Shared:     req.URL.Query().Get("shared") == "true",
+		Collection: req.URL.Query().Get("collection"),
+	}
+
+	if format == formatCSV {
+		err = api.exportCSV(w, ownerHash(claims), opts)
+	} else {
+		err = api.exportNDJSON(w, ownerHash(claims), opts)
+	}
+	// Ответ уже начат, поэтому при ошибке выгрузка просто обрывается
+	if err != nil {
+		log.Printf("HandlerExport: Error: %v", err)
+		return
+	}
+	log.Printf("HandlerExport: export in %s finished", format)
+}
+
+func exportFormat(req *http.Request) (string, error) {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = formatNDJSON
+		if strings.Contains(req.Header.Get("Accept"), "text/csv") {
+			format = formatCSV
+		}
+	}
+	if format != formatNDJSON && format != formatCSV {
+		return "", errors.New("format must be ndjson or csv")
+	}
+	return format, nil
+}
+
+// Обходит все записи по страницам
+func (api *API) eachItem(userHash string, opts *database.ListOptions, fn func(*database.DBItem) error) error {
+	page := *opts
+	for {
+		items, next, err := api.db.GetAll(userHash, &page)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		page.After = next
+	}
+}
+
+func setExportHeaders(w http.ResponseWriter, contentType string, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+}
+
+func (api *API) exportNDJSON(w http.ResponseWriter, userHash string, opts *database.ListOptions) error {
+	setExportHeaders(w, "application/x-ndjson", "items.ndjson")
+
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	err := api.eachItem(userHash, opts, func(item *database.DBItem) error {
+		return enc.Encode(item)
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Колонки value заранее неизвестны, поэтому записи читаются дважды: сначала собираются
+// пути, затем выгружаются строки. Ключи, появившиеся между проходами, не выгружаются.
+func (api *API) exportCSV(w http.ResponseWriter, userHash string, opts *database.ListOptions) error {
+	paths := map[string]bool{}
+	err := api.eachItem(userHash, opts, func(item *database.DBItem) error {
+		for path := range flattenValue(item.Value) {
+			paths[path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to export items", http.StatusInternalServerError)
+		return err
+	}
+
+	valueColumns := make([]string, 0, len(paths))
+	for path := range paths {
+		valueColumns = append(valueColumns, path)
+	}
+	sort.Strings(valueColumns)
+
+	setExportHeaders(w, "text/csv; charset=utf-8", "items.csv")
+
+	out := csv.NewWriter(w)
+	header := append([]string{}, csvColumns...)
+	for _, path := range valueColumns {
+		header = append(header, csvValuePrefix+path)
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(header))
+	err = api.eachItem(userHash, opts, func(item *database.DBItem) error {
+		record[0] = strconv.FormatInt(item.ID, 10)
+		record[1] = item.Name
+		record[2] = item.Collection
+		record[3] = strconv.FormatInt(item.Version, 10)
+		record[4] = item.CreatedAt.Format(time.RFC3339Nano)
+		record[5] = item.UpdatedAt.Format(time.RFC3339Nano)
+		record[6] = ""
+		if item.ExpiresAt != nil {
+			record[6] = item.ExpiresAt.Format(time.RFC3339Nano)
+		}
+
+		cells := flattenValue(item.Value)
+		for i, path := range valueColumns {
+			record[len(csvColumns)+i] = cells[path]
+		}
+		return out.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Путь каждого значения value (непустые объекты разворачиваются) и его ячейка CSV
+func flattenValue(value map[string]interface{}) map[string]string {
+	cells := map[string]string{}
+	flattenInto(cells, "", value)
+	return cells
+}
+
+func flattenInto(cells map[string]string, prefix string, value map[string]interface{}) {
+	for key, v := range value {
+		path := prefix + escapePathKey(key)
+		if obj, ok := v.(map[string]interface{}); ok && len(obj) > 0 {
+			flattenInto(cells, path+".", obj)
+			continue
+		}
+		cells[path] = csvCell(v)
+	}
+}
+
+// Ячейка - JSON значения; строка пишется как есть, если ее нельзя принять за JSON.
+// Пустая ячейка означает отсутствие ключа.
+func csvCell(v interface{}) string {
+	if s, ok := v.(string); ok && s != "" && !json.Valid([]byte(s)) {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func escapePathKey(key string) string {
+	return strings.NewReplacer(`\`, `\\`, ".", `\.`).Replace(key)
+}
+
+// Разбивает путь колонки value на ключи с учетом экранирования
+func splitPath(path string) ([]string, error) {
+	var keys []string
+	var key strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			if i+1 == len(path) {
+				return nil, errors.New("dangling escape in column " + csvValuePrefix + path)
+			}
+			i++
+			key.WriteByte(path[i])
+		case '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(path[i])
+		}
+	}
+	return append(keys, key.String()), nil
+}
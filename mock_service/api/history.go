@@ -0,0 +1,228 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mock_service/database"
+	"net/http"
+	"strconv"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// Разница между двумя ревизиями записи
+type revisionDiff struct {
+	ID   int64           `json:"id"`
+	From int64           `json:"from"`
+	To   int64           `json:"to"`
+	Name *nameChange     `json:"name,omitempty"`
+	Diff json.RawMessage `json:"diff"` // JSON Merge Patch (RFC 7396), переводящий value из from в to
+}
+
+type nameChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// HandlerHistory - список ревизий записи ?id=
+func (api *API) HandlerHistory(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerHistory called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerHistory: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	revisions, err := api.db.GetHistory(id, ownerHash(claims))
+	if err != nil {
+		if err.Error() == "no rows affected" {
+			http.Error(w, "Item not found", http.StatusNotFound)
+		} else {
+			log.Printf("HandlerHistory: Error in GetHistory - %v", err)
+			http.Error(w, "Failed to get item history", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, revisions)
+}
+
+// HandlerHistoryDiff - разница между ревизиями ?id=&from=&to=
+func (api *API) HandlerHistoryDiff(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerHistoryDiff called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseVersionParam(req, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseVersionParam(req, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerHistoryDiff: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var revisions [2]*database.Revision
+	for i, version := range []int64{from, to} {
+		revisions[i], err = api.db.GetRevision(id, ownerHash(claims), version)
+		if err != nil {
+			sendRevisionError(w, err)
+			return
+		}
+	}
+
+	original, _ := json.Marshal(revisions[0].Value)
+	modified, _ := json.Marshal(revisions[1].Value)
+	diff, err := jsonpatch.CreateMergePatch(original, modified)
+	if err != nil {
+		log.Printf("HandlerHistoryDiff: Error: %v", err)
+		http.Error(w, "Failed to diff revisions", http.StatusInternalServerError)
+		return
+	}
+
+	result := revisionDiff{ID: id, From: from, To: to, Diff: diff}
+	if revisions[0].Name != revisions[1].Name {
+		result.Name = &nameChange{From: revisions[0].Name, To: revisions[1].Name}
+	}
+	json_utils.SendJSONResponse(w, http.StatusOK, result)
+}
+
+// HandlerHistoryRestore - восстанавливает ревизию ?id=&version= как новую версию записи
+func (api *API) HandlerHistoryRestore(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerHistoryRestore called")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, err := parseVersionParam(req, "version")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerHistoryRestore: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	expectedVersion, ok := parseIfMatch(req)
+	if !ok {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	revision, err := api.db.GetRevision(id, ownerHash(claims), version)
+	if err != nil {
+		sendRevisionError(w, err)
+		return
+	}
+
+	item := &database.DBItem{Name: revision.Name, Value: revision.Value}
+	if !api.validateItem(w, ownerHash(claims), id, item) {
+		return
+	}
+
+	err = api.db.Update(id, item, ownerHash(claims), expectedVersion)
+	if err != nil {
+		if err == database.ErrVersionMismatch {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		} else if err.Error() == "no rows affected" {
+			api.sendAccessError(w, id, ownerHash(claims))
+		} else {
+			log.Printf("HandlerHistoryRestore: Error: %v", err)
+			http.Error(w, "Failed to restore item", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Item restored successfully"})
+	log.Printf("HandlerHistoryRestore: item %d restored to version %d", id, version)
+}
+
+// GET /data?id=&version= - запись в одной из прошлых версий
+func (api *API) handleGetRevision(w http.ResponseWriter, req *http.Request, id int64, userHash string) {
+	version, err := parseVersionParam(req, "version")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	revision, err := api.db.GetRevision(id, userHash, version)
+	if err != nil {
+		sendRevisionError(w, err)
+		return
+	}
+
+	// Ревизии неизменны, поэтому ETag тот же, что был у записи в этой версии
+	etag := itemETag(revision.Version)
+	w.Header().Set("ETag", etag)
+	if matchesIfNoneMatch(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	json_utils.SendJSONResponse(w, http.StatusOK, revision)
+}
+
+func sendRevisionError(w http.ResponseWriter, err error) {
+	if err.Error() == "no rows affected" {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("GetRevision: Error: %v", err)
+	http.Error(w, "Failed to get revision", http.StatusInternalServerError)
+}
+
+func parseVersionParam(req *http.Request, name string) (int64, error) {
+	version, err := strconv.ParseInt(req.URL.Query().Get(name), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return version, nil
+}
@@ -0,0 +1,292 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt_utils "utils/jwt"
+	redis_utils "utils/redis"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// Ответ, отданный повторно по ключу идемпотентности
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	// Сколько ключ занят запросом, который еще выполняется; пока запрос идет, ключ
+	// продлевается, после падения процесса освободится через это время
+	idempotencyPendingTTL = time.Minute
+	// Запись результата не зависит от запроса: клиент мог уже отключиться
+	idempotencyStoreTimeout = 5 * time.Second
+	// Ответы больше этого размера не сохраняются, ключ освобождается
+	maxIdempotentResponseSize = 10 << 20
+)
+
+// Заголовки ответа, которые сохраняются вместе с телом
+var idempotentHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// idempotencyRecord - состояние ключа в Redis: Token у выполняющегося запроса,
+// остальные поля - у завершенного
+type idempotencyRecord struct {
+	Token       string            `json:"token,omitempty"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	Status      int               `json:"status,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+// Idempotency - повтор POST с тем же заголовком Idempotency-Key не выполняет запрос снова,
+// а возвращает сохраненный ответ. Ключ действует ttl и принадлежит владельцу записей;
+// тот же ключ с другим запросом - 422, пока первый запрос выполняется - 409.
+type Idempotency struct {
+	redis      *redis_utils.RedisClient
+	ttl        time.Duration
+	pendingTTL time.Duration
+}
+
+func NewIdempotency(redis *redis_utils.RedisClient, ttl time.Duration) *Idempotency {
+	return &Idempotency{redis: redis, ttl: ttl, pendingTTL: idempotencyPendingTTL}
+}
+
+// Wrap - ставится после JwtMiddleware: ключи хранятся отдельно для каждого владельца
+func (i *Idempotency) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(idempotencyHeader)
+		if req.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !isValidIdempotencyKey(key) {
+			http.Error(w, "invalid Idempotency-Key", http.StatusBadRequest)
+			return
+		}
+
+		claims, err := jwt_utils.GetClaimsFromContext(req)
+		if err != nil {
+			log.Printf("Idempotency: Error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		i.serve(w, req, next, "idem:"+ownerHash(claims)+":"+key)
+	})
+}
+
+func (i *Idempotency) serve(w http.ResponseWriter, req *http.Request, next http.Handler, redisKey string) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Printf("Idempotency: Error: %v", err)
+		http.Error(w, "Failed to process request", http.StatusInternalServerError)
+		return
+	}
+	pending, err := json.Marshal(&idempotencyRecord{Token: hex.EncodeToString(token)})
+	if err != nil {
+		log.Printf("Idempotency: Error: %v", err)
+		http.Error(w, "Failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	acquired, err := i.redis.CacheSetNX(req.Context(), redisKey, pending, i.pendingTTL)
+	if err != nil {
+		// Без хранилища повтор нельзя отличить от нового запроса
+		log.Printf("Idempotency: Error: %v", err)
+		http.Error(w, "Idempotency store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !acquired {
+		i.replay(w, req, redisKey)
+		return
+	}
+
+	// Тело хэшируется по мере чтения, чтобы не мешать потоковой обработке (/import)
+	fingerprint := requestHash(req)
+	body := &hashingBody{ReadCloser: req.Body, hash: fingerprint}
+	req.Body = body
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	stop := i.keepPending(redisKey, string(pending))
+	next.ServeHTTP(rec, req)
+	// Обработчик мог прочитать тело не до конца
+	_, drainErr := io.Copy(io.Discard, body)
+	stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+	defer cancel()
+
+	// Ответ с ошибкой сервера не окончательный: повтор должен выполниться заново.
+	// Без полного хэша тела повтор нельзя сравнить с запросом.
+	if rec.status >= http.StatusInternalServerError || rec.overflow || drainErr != nil {
+		if err := i.redis.ReleaseLock(ctx, redisKey, string(pending)); err != nil {
+			log.Printf("Idempotency: Error: %v", err)
+		}
+		return
+	}
+
+	record := &idempotencyRecord{
+		Fingerprint: hex.EncodeToString(fingerprint.Sum(nil)),
+		Status:      rec.status,
+		Header:      map[string]string{},
+		Body:        rec.body.Bytes(),
+	}
+	for _, name := range idempotentHeaders {
+		if v := rec.Header().Get(name); v != "" {
+			record.Header[name] = v
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Idempotency: Error storing response: %v", err)
+		return
+	}
+	// Ключ мог истечь и достаться другому запросу: его ответ не перезаписываем
+	stored, err := i.redis.CacheCompareAndSet(ctx, redisKey, pending, data, i.ttl)
+	if err != nil {
+		log.Printf("Idempotency: Error storing response: %v", err)
+		return
+	}
+	if !stored {
+		log.Printf("Idempotency: pending key for %s was lost, response not stored", req.URL.Path)
+	}
+}
+
+// keepPending - продлевает ключ выполняющегося запроса, пока не вызвана stop
+func (i *Idempotency) keepPending(redisKey, pending string) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(i.pendingTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+			held, err := i.redis.ExtendLock(ctx, redisKey, pending, i.pendingTTL)
+			cancel()
+			if err != nil {
+				log.Printf("Idempotency: Error: %v", err)
+				continue
+			}
+			if !held {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// Ключ уже занят: возвращает сохраненный ответ, если запрос тот же
+func (i *Idempotency) replay(w http.ResponseWriter, req *http.Request, redisKey string) {
+	data, err := i.redis.CacheGet(req.Context(), redisKey)
+	if err != nil {
+		log.Printf("Idempotency: Error: %v", err)
+		http.Error(w, "Idempotency store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var record idempotencyRecord
+	if data != nil {
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("Idempotency: Error: %v", err)
+			http.Error(w, "Failed to process request", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Первый запрос еще выполняется или только что завершился ошибкой - клиент повторит позже
+	if data == nil || record.Token != "" {
+		http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+		return
+	}
+
+	fingerprint := requestHash(req)
+	if _, err := io.Copy(fingerprint, req.Body); err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	if hex.EncodeToString(fingerprint.Sum(nil)) != record.Fingerprint {
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+
+	for name, v := range record.Header {
+		w.Header().Set(name, v)
+	}
+	w.Header().Set(idempotencyReplayedHeader, "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+	log.Printf("Idempotency: response replayed for %s", req.URL.Path)
+}
+
+func isValidIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Хэш запроса: метод, путь с параметрами и тело (дописывается при чтении)
+func requestHash(req *http.Request) hash.Hash {
+	h := sha256.New()
+	io.WriteString(h, req.Method+" "+req.URL.RequestURI()+"\n")
+	return h
+}
+
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	return n, err
+}
+
+// responseRecorder - передает ответ клиенту и копирует его для повторов
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if !r.overflow {
+		if r.body.Len()+len(p) > maxIdempotentResponseSize {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	jwt_utils "utils/jwt"
+	redis_utils "utils/redis"
+)
+
+const testIdempotencyKey = "idem:alice:k1"
+
+func newTestIdempotency(t *testing.T) (*Idempotency, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	redis, err := redis_utils.NewRedisClient(&redis_utils.RedisConfig{Addrs: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatalf("NewRedisClient: %v", err)
+	}
+	return NewIdempotency(redis, time.Hour), mr
+}
+
+// Обработчик создания: тело ответа повторяет тело запроса
+func countingHandler(calls *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		body, _ := io.ReadAll(req.Body)
+		w.Header().Set("Location", "/data?id="+strconv.Itoa(int(n)))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+}
+
+func idempotentRequest(t *testing.T, handler http.Handler, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	claims := &jwt_utils.Claims{}
+	claims.Subject = "alice"
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(idempotencyHeader, "k1")
+	req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	i, _ := newTestIdempotency(t)
+	var calls int32
+	handler := i.Wrap(countingHandler(&calls))
+
+	first := idempotentRequest(t, handler, "/data", `{"name":"a"}`)
+	second := idempotentRequest(t, handler, "/data", `{"name":"a"}`)
+
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != `{"name":"a"}` {
+		t.Fatalf("replayed response = %d %q", second.Code, second.Body.String())
+	}
+	if second.Header().Get("Location") != first.Header().Get("Location") || second.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Fatalf("replayed headers = %v", second.Header())
+	}
+	if first.Header().Get(idempotencyReplayedHeader) != "" {
+		t.Fatal("first response marked as replayed")
+	}
+}
+
+func TestIdempotencyDifferentRequest(t *testing.T) {
+	i, _ := newTestIdempotency(t)
+	var calls int32
+	handler := i.Wrap(countingHandler(&calls))
+
+	idempotentRequest(t, handler, "/data", `{"name":"a"}`)
+	for _, tt := range []struct{ path, body string }{
+		{"/data", `{"name":"b"}`},
+		{"/data/batch", `{"name":"a"}`},
+	} {
+		if w := idempotentRequest(t, handler, tt.path, tt.body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("POST %s %s: status = %d, want 422", tt.path, tt.body, w.Code)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	i, _ := newTestIdempotency(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls int32
+	handler := i.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		countingHandler(&calls).ServeHTTP(w, req)
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		idempotentRequest(t, handler, "/data", `{"name":"a"}`)
+	}()
+	<-started
+
+	if w := idempotentRequest(t, handler, "/data", `{"name":"a"}`); w.Code != http.StatusConflict {
+		t.Fatalf("status while first request runs = %d, want 409", w.Code)
+	}
+	close(release)
+	wg.Wait()
+
+	if w := idempotentRequest(t, handler, "/data", `{"name":"a"}`); w.Code != http.StatusCreated || calls != 1 {
+		t.Fatalf("status after first request = %d, handler calls = %d", w.Code, calls)
+	}
+}
+
+func TestIdempotencyServerErrorReleasesKey(t *testing.T) {
+	i, mr := newTestIdempotency(t)
+	var calls int32
+	handler := i.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "Failed", http.StatusInternalServerError)
+	}))
+
+	idempotentRequest(t, handler, "/data", `{}`)
+	if mr.Exists(testIdempotencyKey) {
+		t.Fatal("key kept after server error")
+	}
+	idempotentRequest(t, handler, "/data", `{}`)
+	if calls != 2 {
+		t.Fatalf("handler called %d times, want 2", calls)
+	}
+}
+
+func TestIdempotencyKeepsPendingKey(t *testing.T) {
+	i, mr := newTestIdempotency(t)
+	i.pendingTTL = 30 * time.Millisecond
+
+	var calls int32
+	handler := i.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Запрос идет дольше pendingTTL
+		for n := 0; n < 5; n++ {
+			mr.FastForward(25 * time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+		}
+		if ttl := mr.TTL(testIdempotencyKey); ttl != i.pendingTTL {
+			t.Errorf("pending key TTL = %s, want %s", ttl, i.pendingTTL)
+		}
+		countingHandler(&calls).ServeHTTP(w, req)
+	}))
+
+	idempotentRequest(t, handler, "/data", `{"name":"a"}`)
+	if w := idempotentRequest(t, handler, "/data", `{"name":"a"}`); w.Code != http.StatusCreated || calls != 1 {
+		t.Fatalf("replay status = %d, handler calls = %d", w.Code, calls)
+	}
+	if ttl := mr.TTL(testIdempotencyKey); ttl != time.Hour {
+		t.Fatalf("stored response TTL = %s, want 1h", ttl)
+	}
+}
+
+func TestIdempotencyDoesNotOverwriteNewOwner(t *testing.T) {
+	i, mr := newTestIdempotency(t)
+	const other = `{"token":"other"}`
+
+	var calls int32
+	handler := i.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Ключ истек, его занял другой запрос
+		mr.Set(testIdempotencyKey, other)
+		countingHandler(&calls).ServeHTTP(w, req)
+	}))
+
+	if w := idempotentRequest(t, handler, "/data", `{"name":"a"}`); w.Code != http.StatusCreated {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if got, _ := mr.Get(testIdempotencyKey); got != other {
+		t.Fatalf("key = %q, want record of the new owner", got)
+	}
+}
@@ -0,0 +1,473 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mock_service/database"
+	"net/http"
+	"strings"
+	"time"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+const (
+	maxImportLineSize = 1 << 20
+	// Сколько строк фиксируется одной транзакцией (при проверке - отменяется)
+	importChunkSize = 500
+	// Сколько ошибок строк попадает в отчет
+	maxImportErrors = 1000
+)
+
+// Строка загрузки; остальные поля выгрузки (id, version, даты) не используются
+type importLine struct {
+	Name       string                 `json:"name"`
+	Value      map[string]interface{} `json:"value"`
+	Collection string                 `json:"collection"`
+	ExpiresAt  *time.Time             `json:"expires_at"`
+}
+
+type importError struct {
+	Line  int    `json:"line"`
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error"`
+
+	Violations []schemaViolation `json:"violations,omitempty"` // при несоответствии схеме
+}
+
+type importResponse struct {
+	DryRun bool `json:"dry_run"`
+	Total  int  `json:"total"`
+	// Сколько первых строк обработано окончательно: при повторе загрузки их можно пропустить
+	Committed int `json:"committed"`
+	// Созданные и измененные записи в зафиксированных транзакциях
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Failed  int `json:"failed"`
+
+	Errors          []importError `json:"errors"`
+	ErrorsTruncated bool          `json:"errors_truncated,omitempty"`
+	// Ошибка, из-за которой загрузка остановилась; строки до нее обработаны
+	Error string `json:"error,omitempty"`
+}
+
+// Строки текущей транзакции: в ответ они попадают после ее фиксации
+type importChunk struct {
+	tx      database.DBTx // nil - транзакция еще не начата
+	lines   int
+	created int
+	updated int
+}
+
+// lineError - ошибка одной строки, после нее чтение продолжается
+type lineError struct {
+	err error
+}
+
+func (e *lineError) Error() string { return e.err.Error() }
+
+// importReader - читает строки загрузки по одной; io.EOF - строки закончились
+type importReader interface {
+	next() (int, *database.DBItem, error)
+}
+
+// HandlerImport - POST /import: создание записей из потока NDJSON или CSV (формат выгрузки
+// /export; format=ndjson|csv или по Content-Type). upsert=true изменяет запись владельца
+// с тем же именем (и коллекцией, если она указана) вместо создания новой. dry_run=true
+// проверяет строки, ничего не сохраняя. Ошибка строки не отменяет остальные строки.
+// Строки фиксируются пачками по importChunkSize; если загрузка прервалась, committed
+// показывает, сколько строк уже сохранено. Ответ 400 - не сохранено ничего.
+func (api *API) HandlerImport(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerImport called")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerImport: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	reader, err := newImportReader(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := req.URL.Query()
+	response := &importResponse{DryRun: query.Get("dry_run") == "true", Errors: []importError{}}
+	err = api.runImport(reader, ownerHash(claims), query.Get("upsert") == "true", response)
+
+	status := http.StatusOK
+	switch {
+	case err != nil:
+		log.Printf("HandlerImport: Error: %v", err)
+		response.Error = "Failed to import items"
+		status = http.StatusInternalServerError
+	case response.Error != "" && response.Committed == 0:
+		status = http.StatusBadRequest
+	}
+	json_utils.SendJSONResponse(w, status, response)
+	log.Printf("HandlerImport: %d lines, created %d, updated %d, failed %d, dry run: %v",
+		response.Total, response.Created, response.Updated, response.Failed, response.DryRun)
+}
+
+func newImportReader(req *http.Request) (importReader, error) {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		format = formatNDJSON
+		if mediaType == "text/csv" {
+			format = formatCSV
+		}
+	}
+
+	switch format {
+	case formatNDJSON:
+		scanner := bufio.NewScanner(req.Body)
+		scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+		return &ndjsonReader{scanner: scanner}, nil
+	case formatCSV:
+		return newCSVReader(req.Body)
+	default:
+		return nil, errors.New("format must be ndjson or csv")
+	}
+}
+
+// Ошибка - сбой транзакции; ошибки чтения попадают в response.Error, строки до них
+// сохраняются. При проверке строки видят только строки своей пачки.
+func (api *API) runImport(reader importReader, owner string, upsert bool, response *importResponse) error {
+	var chunk importChunk
+	defer func() {
+		if chunk.tx != nil {
+			chunk.tx.Rollback()
+		}
+	}()
+
+	for {
+		line, item, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		var le *lineError
+		if err != nil && !errors.As(err, &le) {
+			response.Error = fmt.Sprintf("line %d: %v", line, err)
+			break
+		}
+
+		response.Total++
+		chunk.lines++
+		if err != nil {
+			addImportError(response, importError{Line: line, Error: err.Error()})
+		} else if err := api.importItem(&chunk, owner, line, item, upsert, response); err != nil {
+			return err
+		}
+
+		if chunk.lines == importChunkSize {
+			if err := endImportChunk(&chunk, response); err != nil {
+				return err
+			}
+		}
+	}
+	return endImportChunk(&chunk, response)
+}
+
+// Фиксирует строки пачки, при проверке - отменяет их
+func endImportChunk(chunk *importChunk, response *importResponse) error {
+	if tx := chunk.tx; tx != nil {
+		chunk.tx = nil
+		var err error
+		if response.DryRun {
+			err = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	response.Created += chunk.created
+	response.Updated += chunk.updated
+	if !response.DryRun {
+		response.Committed += chunk.lines
+	}
+	*chunk = importChunk{}
+	return nil
+}
+
+// Создает или изменяет запись в точке сохранения: ошибка отменяет только эту строку.
+// Ошибка - сбой транзакции.
+func (api *API) importItem(chunk *importChunk, owner string, line int, item *database.DBItem, upsert bool,
+	response *importResponse) error {
+	if chunk.tx == nil {
+		tx, err := api.db.BeginTx()
+		if err != nil {
+			return err
+		}
+		chunk.tx = tx
+	}
+	tx := chunk.tx
+
+	if err := tx.Savepoint("import_line"); err != nil {
+		return err
+	}
+
+	created, failure := api.writeImportItem(tx, owner, item, upsert)
+	if failure != nil {
+		failure.Line, failure.Name = line, item.Name
+		addImportError(response, *failure)
+		return tx.RollbackTo("import_line")
+	}
+
+	if created {
+		chunk.created++
+	} else {
+		chunk.updated++
+	}
+	return tx.Release("import_line")
+}
+
+func (api *API) writeImportItem(tx database.DBTx, owner string, item *database.DBItem, upsert bool) (bool, *importError) {
+	var id int64
+	if upsert {
+		ids, err := tx.FindByName(owner, item.Name, item.Collection, 2)
+		if err != nil {
+			return false, internalImportError(err)
+		}
+		if len(ids) > 1 {
+			return false, &importError{Error: "more than one item with this name"}
+		}
+		if len(ids) == 1 {
+			id = ids[0]
+		}
+	}
+
+	se, err := api.checkItem(owner, id, item)
+	if err != nil {
+		return false, internalImportError(err)
+	}
+	if se != nil {
+		return false, &importError{Error: se.Error, Violations: se.Violations}
+	}
+
+	if id == 0 {
+		_, err = tx.Insert(item, owner)
+	} else {
+		err = tx.Update(id, item, owner, 0)
+	}
+	switch {
+	case err == nil:
+		return id == 0, nil
+	case errors.Is(err, database.ErrInvalidItem):
+		return false, &importError{Error: err.Error()}
+	default:
+		return false, internalImportError(err)
+	}
+}
+
+func internalImportError(err error) *importError {
+	log.Printf("HandlerImport: Error: %v", err)
+	return &importError{Error: "Internal error"}
+}
+
+func addImportError(response *importResponse, e importError) {
+	response.Failed++
+	if len(response.Errors) == maxImportErrors {
+		response.ErrorsTruncated = true
+		return
+	}
+	response.Errors = append(response.Errors, e)
+}
+
+func newImportItem(line *importLine) (*database.DBItem, error) {
+	if line.Name == "" {
+		return nil, &lineError{errors.New("name is required")}
+	}
+	if line.Value == nil {
+		line.Value = map[string]interface{}{}
+	}
+	return &database.DBItem{
+		Name:       line.Name,
+		Value:      line.Value,
+		Collection: line.Collection,
+		ExpiresAt:  line.ExpiresAt,
+	}, nil
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *ndjsonReader) next() (int, *database.DBItem, error) {
+	for r.scanner.Scan() {
+		r.line++
+		text := strings.TrimSpace(r.scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var line importLine
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			return r.line, nil, &lineError{errors.New("invalid JSON")}
+		}
+		item, err := newImportItem(&line)
+		return r.line, item, err
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = fmt.Errorf("line is longer than %d bytes", maxImportLineSize)
+		}
+		return r.line + 1, nil, err
+	}
+	return r.line, nil, io.EOF
+}
+
+type csvReader struct {
+	reader *csv.Reader
+	header []string
+	// Ключи колонок value; nil - колонка не из value
+	paths [][]string
+}
+
+func newCSVReader(body io.Reader) (*csvReader, error) {
+	reader := csv.NewReader(body)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("CSV header is required")
+	}
+
+	r := &csvReader{reader: reader, header: header, paths: make([][]string, len(header))}
+	hasName := false
+	for i, column := range header {
+		switch {
+		case strings.HasPrefix(column, csvValuePrefix):
+			path, err := splitPath(strings.TrimPrefix(column, csvValuePrefix))
+			if err != nil {
+				return nil, err
+			}
+			r.paths[i] = path
+		case column == "name":
+			hasName = true
+		case isCSVColumn(column):
+		default:
+			return nil, fmt.Errorf("unknown column %s", column)
+		}
+	}
+	if !hasName {
+		return nil, errors.New("column name is required")
+	}
+	return r, nil
+}
+
+func isCSVColumn(column string) bool {
+	for _, c := range csvColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *csvReader) next() (int, *database.DBItem, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return 0, nil, io.EOF
+	}
+	if err != nil {
+		line := 0
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			line = pe.StartLine
+		}
+		// Лишние или недостающие колонки портят только свою строку
+		if errors.Is(err, csv.ErrFieldCount) {
+			return line, nil, &lineError{errors.New("wrong number of columns")}
+		}
+		return line, nil, err
+	}
+	line, _ := r.reader.FieldPos(0)
+
+	item := &importLine{Value: map[string]interface{}{}}
+	for i, cell := range record {
+		if r.paths[i] != nil {
+			if cell == "" {
+				continue
+			}
+			if err := setPath(item.Value, r.paths[i], parseCSVCell(cell)); err != nil {
+				return line, nil, &lineError{err}
+			}
+			continue
+		}
+
+		switch r.header[i] {
+		case "name":
+			item.Name = cell
+		case "collection":
+			item.Collection = cell
+		case "expires_at":
+			if cell == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, cell)
+			if err != nil {
+				return line, nil, &lineError{errors.New("expires_at must be an RFC 3339 time")}
+			}
+			item.ExpiresAt = &t
+		}
+	}
+
+	dbItem, err := newImportItem(item)
+	return line, dbItem, err
+}
+
+// Обратное к csvCell
+func parseCSVCell(cell string) interface{} {
+	var v interface{}
+	if json.Unmarshal([]byte(cell), &v) == nil {
+		return v
+	}
+	return cell
+}
+
+func setPath(value map[string]interface{}, path []string, v interface{}) error {
+	for _, key := range path[:len(path)-1] {
+		existing, ok := value[key]
+		if !ok {
+			next := map[string]interface{}{}
+			value[key] = next
+			value = next
+			continue
+		}
+		next, ok := existing.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("column %s conflicts with another column", csvValuePrefix+strings.Join(path, "."))
+		}
+		value = next
+	}
+
+	key := path[len(path)-1]
+	if _, ok := value[key]; ok {
+		return fmt.Errorf("column %s conflicts with another column", csvValuePrefix+strings.Join(path, "."))
+	}
+	value[key] = v
+	return nil
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mock_service/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt_utils "utils/jwt"
+)
+
+// Заглушка БД для загрузки: записи в памяти, изменения транзакции видны только ей до Commit
+type importTestDB struct {
+	database.DBAdapter
+
+	items     []*database.DBItem // ID записи - индекс + 1
+	commits   int
+	rollbacks int
+	maxWrites int // больше всего строк в одной транзакции
+	begins    int
+	maxBegins int // 0 - без ограничения
+}
+
+func (db *importTestDB) BeginTx() (database.DBTx, error) {
+	if db.maxBegins != 0 && db.begins == db.maxBegins {
+		return nil, errors.New("connection refused")
+	}
+	db.begins++
+	return &importTestTx{db: db, items: append([]*database.DBItem(nil), db.items...)}, nil
+}
+
+func (db *importTestDB) GetSchemaForItem(userHash string, itemID int64, name string, collection string) (*database.Schema, error) {
+	return nil, nil
+}
+
+type importTestTx struct {
+	database.DBTx
+
+	db     *importTestDB
+	items  []*database.DBItem
+	saved  []*database.DBItem
+	writes int
+}
+
+func (tx *importTestTx) Insert(item *database.DBItem, userHash string) (int64, error) {
+	if item.Name == "invalid" {
+		return 0, fmt.Errorf("%w: name is reserved", database.ErrInvalidItem)
+	}
+	tx.writes++
+	c := *item
+	tx.items = append(tx.items, &c)
+	return int64(len(tx.items)), nil
+}
+
+func (tx *importTestTx) Update(id int64, item *database.DBItem, userHash string, expectedVersion int64) error {
+	tx.writes++
+	c := *tx.items[id-1]
+	c.Value = item.Value
+	tx.items[id-1] = &c
+	return nil
+}
+
+func (tx *importTestTx) FindByName(userHash string, name string, collection string, limit int) ([]int64, error) {
+	var ids []int64
+	for i, item := range tx.items {
+		if item.Name == name && (collection == "" || item.Collection == collection) && len(ids) < limit {
+			ids = append(ids, int64(i+1))
+		}
+	}
+	return ids, nil
+}
+
+func (tx *importTestTx) Savepoint(name string) error {
+	tx.saved = append([]*database.DBItem(nil), tx.items...)
+	return nil
+}
+
+func (tx *importTestTx) RollbackTo(name string) error {
+	tx.items = tx.saved
+	return nil
+}
+
+func (tx *importTestTx) Release(name string) error { return nil }
+
+func (tx *importTestTx) Commit() error {
+	tx.db.items = tx.items
+	tx.db.commits++
+	tx.db.maxWrites = max(tx.db.maxWrites, tx.writes)
+	return nil
+}
+
+func (tx *importTestTx) Rollback() error {
+	tx.db.rollbacks++
+	tx.db.maxWrites = max(tx.db.maxWrites, tx.writes)
+	return nil
+}
+
+func importLines(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, `{"name":"item-%d","value":{"n":%d}}`+"\n", i, i)
+	}
+	return b.String()
+}
+
+func runTestImport(t *testing.T, db *importTestDB, query, body string) (int, *importResponse) {
+	t.Helper()
+	api := NewApi(db, nil, nil, nil, nil, AttachmentConfig{})
+
+	claims := &jwt_utils.Claims{}
+	claims.Subject = "alice"
+	req := httptest.NewRequest(http.MethodPost, "/import?"+query, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+	w := httptest.NewRecorder()
+	api.HandlerImport(w, req)
+
+	var response importResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, &response
+}
+
+func TestImportChunks(t *testing.T) {
+	db := &importTestDB{}
+	status, response := runTestImport(t, db, "", importLines(2*importChunkSize+1))
+
+	if status != http.StatusOK || response.Error != "" {
+		t.Fatalf("status = %d, error = %q", status, response.Error)
+	}
+	if response.Total != 2*importChunkSize+1 || response.Created != response.Total || response.Committed != response.Total {
+		t.Fatalf("response = %+v", response)
+	}
+	if db.commits != 3 || db.maxWrites != importChunkSize {
+		t.Fatalf("commits = %d, max lines per transaction = %d; want 3, %d", db.commits, db.maxWrites, importChunkSize)
+	}
+	if len(db.items) != response.Total {
+		t.Fatalf("%d items saved, want %d", len(db.items), response.Total)
+	}
+}
+
+func TestImportUpsert(t *testing.T) {
+	db := &importTestDB{items: []*database.DBItem{
+		{Name: "a", Value: map[string]interface{}{"v": float64(0)}},
+		{Name: "dup"},
+		{Name: "dup"},
+	}}
+	body := `{"name":"a","value":{"v":1}}
+{"name":"b","value":{"v":1}}
+{"name":"b","value":{"v":2}}
+{"name":"dup"}
+{"name":"invalid"}
+{"value":{}}
+`
+	status, response := runTestImport(t, db, "upsert=true", body)
+
+	if status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	// Вторая строка b изменяет запись, созданную первой
+	if response.Total != 6 || response.Created != 1 || response.Updated != 2 || response.Failed != 3 {
+		t.Fatalf("response = %+v", response)
+	}
+	wantErrors := map[int]string{4: "more than one item with this name", 5: "name is reserved", 6: "name is required"}
+	for _, e := range response.Errors {
+		if !strings.Contains(e.Error, wantErrors[e.Line]) || wantErrors[e.Line] == "" {
+			t.Errorf("line %d error = %q, want %q", e.Line, e.Error, wantErrors[e.Line])
+		}
+	}
+
+	if len(db.items) != 4 || db.items[0].Value["v"] != float64(1) || db.items[3].Value["v"] != float64(2) {
+		t.Fatalf("items after import = %+v", db.items)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	db := &importTestDB{items: []*database.DBItem{{Name: "item-1"}}}
+	status, response := runTestImport(t, db, "dry_run=true&upsert=true", importLines(importChunkSize+10))
+
+	if status != http.StatusOK || !response.DryRun {
+		t.Fatalf("status = %d, response = %+v", status, response)
+	}
+	if response.Created != importChunkSize+9 || response.Updated != 1 || response.Committed != 0 {
+		t.Fatalf("response = %+v", response)
+	}
+	// Проверка тоже идет пачками, и каждая пачка отменяется
+	if db.commits != 0 || db.rollbacks != 2 || db.maxWrites != importChunkSize {
+		t.Fatalf("commits = %d, rollbacks = %d, max lines per transaction = %d", db.commits, db.rollbacks, db.maxWrites)
+	}
+	if len(db.items) != 1 {
+		t.Fatalf("dry run saved %d items", len(db.items)-1)
+	}
+}
+
+func TestImportReadError(t *testing.T) {
+	tooLong := `{"name":"x","value":{"s":"` + strings.Repeat("a", maxImportLineSize) + `"}}` + "\n"
+
+	t.Run("Lines before the error are saved", func(t *testing.T) {
+		db := &importTestDB{}
+		status, response := runTestImport(t, db, "", importLines(importChunkSize+1)+tooLong)
+
+		if status != http.StatusOK || response.Error == "" {
+			t.Fatalf("status = %d, error = %q; want 200 with error", status, response.Error)
+		}
+		if response.Committed != importChunkSize+1 || len(db.items) != importChunkSize+1 {
+			t.Fatalf("committed = %d, saved = %d", response.Committed, len(db.items))
+		}
+	})
+
+	t.Run("Nothing saved", func(t *testing.T) {
+		db := &importTestDB{}
+		status, response := runTestImport(t, db, "", tooLong)
+
+		if status != http.StatusBadRequest || response.Error == "" || response.Committed != 0 {
+			t.Fatalf("status = %d, response = %+v", status, response)
+		}
+	})
+}
+
+func TestImportBeginTxFailure(t *testing.T) {
+	// Первая пачка сохранена, вторая транзакция не начинается
+	db := &importTestDB{maxBegins: 1}
+	status, response := runTestImport(t, db, "", importLines(importChunkSize+1))
+
+	if status != http.StatusInternalServerError || response.Error == "" {
+		t.Fatalf("status = %d, response = %+v", status, response)
+	}
+	if response.Committed != importChunkSize || response.Created != importChunkSize || len(db.items) != importChunkSize {
+		t.Fatalf("committed = %d, created = %d, saved = %d", response.Committed, response.Created, len(db.items))
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"mock_service/database"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	jwt_utils "utils/jwt"
+)
+
+// Заглушка БД для списка: n записей, страницы по pageSize, курсор - ID последней записи
+type listTestDB struct {
+	database.DBAdapter
+
+	n        int
+	pageSize int
+	calls    int
+}
+
+func (db *listTestDB) GetAll(userHash string, opts *database.ListOptions) ([]*database.DBItem, string, error) {
+	db.calls++
+	if opts.JSONPath == "bad" {
+		return nil, "", database.ErrInvalidFilter
+	}
+	start := 0
+	if opts.After != "" {
+		start, _ = strconv.Atoi(opts.After)
+	}
+	var items []*database.DBItem
+	for id := start + 1; id <= db.n && len(items) < db.pageSize; id++ {
+		items = append(items, &database.DBItem{ID: int64(id), Name: "item-" + strconv.Itoa(id)})
+	}
+	next := ""
+	if start+len(items) < db.n {
+		next = strconv.Itoa(start + len(items))
+	}
+	return items, next, nil
+}
+
+func runTestList(db *listTestDB, query string) *httptest.ResponseRecorder {
+	api := NewApi(db, nil, nil, nil, nil, AttachmentConfig{})
+
+	claims := &jwt_utils.Claims{}
+	claims.Subject = "alice"
+	req := httptest.NewRequest(http.MethodGet, "/data/list?"+query, nil)
+	req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+	w := httptest.NewRecorder()
+	api.HandlerList(w, req)
+	return w
+}
+
+func TestListStreamsAllPages(t *testing.T) {
+	for _, n := range []int{0, 1, 5, 7} {
+		db := &listTestDB{n: n, pageSize: 3}
+		w := runTestList(db, "")
+
+		var items []*database.DBItem
+		if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+			t.Fatalf("n=%d: invalid response %q: %v", n, w.Body.String(), err)
+		}
+		if w.Code != http.StatusOK || items == nil || len(items) != n {
+			t.Fatalf("n=%d: status = %d, %d items", n, w.Code, len(items))
+		}
+		for i, item := range items {
+			if item.ID != int64(i+1) {
+				t.Fatalf("n=%d: item %d has ID %d", n, i, item.ID)
+			}
+		}
+		if want := max(1, (n+2)/3); db.calls != want {
+			t.Errorf("n=%d: GetAll called %d times, want %d", n, db.calls, want)
+		}
+	}
+}
+
+func TestListPage(t *testing.T) {
+	db := &listTestDB{n: 5, pageSize: 3}
+	w := runTestList(db, "limit=3")
+
+	var page listPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	if len(page.Items) != 3 || page.Next != "/data/list?after=3&limit=3" || db.calls != 1 {
+		t.Fatalf("page = %+v, GetAll calls = %d", page, db.calls)
+	}
+}
+
+func TestListInvalidFilter(t *testing.T) {
+	w := runTestList(&listTestDB{n: 5, pageSize: 3}, "jsonpath=bad")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+}
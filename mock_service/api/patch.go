@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mock_service/database"
+	"net/http"
+	"strconv"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// Типы тела PATCH-запроса
+const (
+	contentTypeMergePatch = "application/merge-patch+json" // RFC 7396
+	contentTypeJSONPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+// Максимальный размер патча
+const maxPatchSize = 1 << 20
+
+// Патч корректен, но не применяется к текущему значению записи
+var errPatchFailed = errors.New("patch failed")
+
+// Результат патча не соответствует схеме записи
+var errSchemaViolation = errors.New("value does not match schema")
+
+// PATCH /data?id= - частичное изменение value записи. Параметры ttl (секунды, отрицательный -
+// бессрочно) и expires_at (RFC 3339) меняют срок жизни вместе с value; патч {} меняет только его.
+func (api *API) handlePatch(w http.ResponseWriter, req *http.Request) {
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expiry, err := parseExpiryParams(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if contentType != contentTypeMergePatch && contentType != contentTypeJSONPatch {
+		w.Header().Set("Accept-Patch", contentTypeMergePatch+", "+contentTypeJSONPatch)
+		http.Error(w, "Unsupported patch type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPatchSize+1))
+	if err != nil || len(body) > maxPatchSize || !json.Valid(body) {
+		http.Error(w, "Invalid patch document", http.StatusBadRequest)
+		return
+	}
+
+	var apply func(doc []byte) ([]byte, error)
+	if contentType == contentTypeJSONPatch {
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			http.Error(w, "Invalid patch document", http.StatusBadRequest)
+			return
+		}
+		apply = patch.Apply
+	} else {
+		apply = func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, body)
+		}
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("handlePatch: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	expectedVersion, ok := parseIfMatch(req)
+	if !ok {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	// Схема определяется именем записи, которое патч не меняет
+	var schema *boundSchema
+	if current, err := api.db.Get(id, ownerHash(claims)); err == nil {
+		schema, err = api.itemSchema(ownerHash(claims), id, current.Name, "")
+		if err != nil {
+			log.Printf("handlePatch: Error: %v", err)
+			http.Error(w, "Failed to validate item", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var violations *schemaError
+	item, err := api.db.Patch(id, ownerHash(claims), expectedVersion, expiry, func(value []byte) ([]byte, error) {
+		patched, err := apply(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errPatchFailed, err)
+		}
+		// value записи всегда объект
+		var object map[string]interface{}
+		if err := json.Unmarshal(patched, &object); err != nil || object == nil {
+			return nil, fmt.Errorf("%w: value must be a JSON object", errPatchFailed)
+		}
+		if violations = schema.validate(object); violations != nil {
+			return nil, errSchemaViolation
+		}
+		return patched, nil
+	})
+	if err != nil {
+		switch {
+		case err == database.ErrVersionMismatch:
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		case err == errSchemaViolation:
+			sendSchemaError(w, violations)
+		case errors.Is(err, errPatchFailed):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, database.ErrInvalidItem):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err.Error() == "no rows affected":
+			api.sendAccessError(w, id, ownerHash(claims))
+		default:
+			log.Printf("handlePatch: Error: %v", err)
+			http.Error(w, "Failed to patch item", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("ETag", itemETag(item.Version))
+	json_utils.SendJSONResponse(w, http.StatusOK, item)
+	log.Println("handlePatch: item patched successfully")
+}
+
+// Срок жизни из параметров ttl и expires_at
+func parseExpiryParams(req *http.Request) (database.ExpiryChange, error) {
+	var expiry database.ExpiryChange
+	query := req.URL.Query()
+	if v := query.Get("ttl"); v != "" {
+		ttl, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ttl == 0 {
+			return expiry, errors.New("invalid ttl")
+		}
+		expiry.TTL = ttl
+	}
+	if v := query.Get("expires_at"); v != "" {
+		expiresAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return expiry, errors.New("invalid expires_at")
+		}
+		expiry.ExpiresAt = &expiresAt
+	}
+	return expiry, nil
+}
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mock_service/database"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// Нарушение схемы в value записи
+type schemaViolation struct {
+	InstanceLocation string `json:"instance_location"` // JSON Pointer на поле value
+	KeywordLocation  string `json:"keyword_location"`  // ключевое слово схемы, которое не выполнено
+	Message          string `json:"message"`
+}
+
+// Тело ответа 422
+type schemaError struct {
+	Error      string            `json:"error"`
+	Schema     string            `json:"schema"`
+	Violations []schemaViolation `json:"violations"`
+}
+
+// Скомпилированная схема, привязанная к записи
+type boundSchema struct {
+	name   string
+	schema *jsonschema.Schema
+}
+
+type compiledSchema struct {
+	updatedAt time.Time
+	schema    *jsonschema.Schema
+}
+
+// Кэш скомпилированных схем; схема перекомпилируется после изменения
+type schemaCache struct {
+	mu       sync.Mutex
+	compiled map[int64]*compiledSchema
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{compiled: make(map[int64]*compiledSchema)}
+}
+
+func (c *schemaCache) get(s *database.Schema) (*jsonschema.Schema, error) {
+	c.mu.Lock()
+	cached, ok := c.compiled[s.ID]
+	c.mu.Unlock()
+	if ok && cached.updatedAt.Equal(s.UpdatedAt) {
+		return cached.schema, nil
+	}
+
+	schema, err := compileSchema(s.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.compiled[s.ID] = &compiledSchema{updatedAt: s.UpdatedAt, schema: schema}
+	c.mu.Unlock()
+	return schema, nil
+}
+
+// Адрес, под которым схема добавляется в компилятор; не файловый, чтобы в ошибках не было путей сервера
+const schemaResourceURL = "mem://schemas/schema.json"
+
+// compileSchema - компилирует схему (по умолчанию draft 2020-12). Внешние $ref запрещены.
+func compileSchema(raw json.RawMessage) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external references are not allowed: %s", s)
+	}
+	if err := compiler.AddResource(schemaResourceURL, bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(schemaResourceURL)
+}
+
+// Схема, которой должна соответствовать запись; nil, если схема не привязана
+func (api *API) itemSchema(userHash string, itemID int64, name string, collection string) (*boundSchema, error) {
+	s, err := api.db.GetSchemaForItem(userHash, itemID, name, collection)
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	schema, err := api.schemas.get(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile schema %s: %v", s.Name, err)
+	}
+	return &boundSchema{name: s.Name, schema: schema}, nil
+}
+
+// validate - nil, если value соответствует схеме
+func (b *boundSchema) validate(value map[string]interface{}) *schemaError {
+	if b == nil {
+		return nil
+	}
+
+	err := b.schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+
+	result := &schemaError{Error: "value does not match schema", Schema: b.name}
+	if ve, ok := err.(*jsonschema.ValidationError); ok {
+		collectViolations(ve, &result.Violations)
+	} else {
+		result.Violations = append(result.Violations, schemaViolation{Message: err.Error()})
+	}
+	return result
+}
+
+// В ответ попадают только конечные ошибки дерева, без общих "doesn't validate with ..."
+func collectViolations(ve *jsonschema.ValidationError, violations *[]schemaViolation) {
+	if len(ve.Causes) == 0 {
+		*violations = append(*violations, schemaViolation{
+			InstanceLocation: ve.InstanceLocation,
+			KeywordLocation:  ve.KeywordLocation,
+			Message:          ve.Message,
+		})
+		return
+	}
+	for _, cause := range ve.Causes {
+		collectViolations(cause, violations)
+	}
+}
+
+// checkItem - проверяет запись перед созданием (id = 0) или изменением. При изменении
+// недостающие имя и value берутся из текущей записи. nil - запись соответствует схеме.
+func (api *API) checkItem(userHash string, id int64, item *database.DBItem) (*schemaError, error) {
+	name, value := item.Name, item.Value
+	if id != 0 && (name == "" || value == nil) {
+		current, err := api.db.Get(id, userHash)
+		if err != nil {
+			// Записи нет - это сообщит само изменение
+			return nil, nil
+		}
+		if name == "" {
+			name = current.Name
+		}
+		if value == nil {
+			value = current.Value
+		}
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	collection := item.Collection
+	if id == 0 && collection == "" {
+		collection = database.DefaultCollection
+	}
+
+	schema, err := api.itemSchema(userHash, id, name, collection)
+	if err != nil {
+		return nil, err
+	}
+	return schema.validate(value), nil
+}
+
+func sendSchemaError(w http.ResponseWriter, se *schemaError) {
+	json_utils.SendJSONResponse(w, http.StatusUnprocessableEntity, se)
+}
+
+type schemaRequest struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+// HandlerSchemas - GET: список схем или схема ?name=, POST: создание, PUT ?name=: замена, DELETE ?name=: удаление
+func (api *API) HandlerSchemas(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerSchemas called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerSchemas: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner := ownerHash(claims)
+	name := req.URL.Query().Get("name")
+
+	if req.Method != http.MethodGet && !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if name == "" {
+			schemas, err := api.db.GetSchemas(owner)
+			if err != nil {
+				log.Printf("HandlerSchemas: Error in GetSchemas - %v", err)
+				http.Error(w, "Failed to get schemas", http.StatusInternalServerError)
+				return
+			}
+			if schemas == nil {
+				schemas = []*database.Schema{}
+			}
+			json_utils.SendJSONResponse(w, http.StatusOK, schemas)
+			return
+		}
+		schema, err := api.db.GetSchema(owner, name)
+		if err != nil {
+			sendSchemaDBError(w, "GetSchema", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, schema)
+	case http.MethodPost, http.MethodPut:
+		var input schemaRequest
+		if err := json_utils.DecodeJSONBody(req, &input); err != nil || len(input.Schema) == 0 {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if req.Method == http.MethodPut {
+			input.Name = name
+		}
+		if input.Name == "" {
+			http.Error(w, "Schema name is required", http.StatusBadRequest)
+			return
+		}
+		if _, err := compileSchema(input.Schema); err != nil {
+			http.Error(w, "Invalid schema: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		schema := &database.Schema{Name: input.Name, Schema: input.Schema}
+		if req.Method == http.MethodPost {
+			err = api.db.CreateSchema(owner, schema)
+		} else {
+			err = api.db.UpdateSchema(owner, schema)
+		}
+		if err != nil {
+			sendSchemaDBError(w, "SaveSchema", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, schema)
+		log.Printf("HandlerSchemas: schema %s saved", schema.Name)
+	case http.MethodDelete:
+		if err := api.db.DeleteSchema(owner, name); err != nil {
+			sendSchemaDBError(w, "DeleteSchema", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Schema deleted successfully"})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerSchemaBindings - GET: привязки схем, POST: привязка схемы к имени записи, DELETE ?item_name=: отвязка
+func (api *API) HandlerSchemaBindings(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerSchemaBindings called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerSchemaBindings: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner := ownerHash(claims)
+
+	if req.Method != http.MethodGet && !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		bindings, err := api.db.GetSchemaBindings(owner)
+		if err != nil {
+			log.Printf("HandlerSchemaBindings: Error in GetSchemaBindings - %v", err)
+			http.Error(w, "Failed to get schema bindings", http.StatusInternalServerError)
+			return
+		}
+		if bindings == nil {
+			bindings = []*database.SchemaBinding{}
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, bindings)
+	case http.MethodPost:
+		var binding database.SchemaBinding
+		if err := json_utils.DecodeJSONBody(req, &binding); err != nil || binding.Schema == "" || binding.ItemName == "" {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if err := api.db.BindSchema(owner, &binding); err != nil {
+			sendSchemaDBError(w, "BindSchema", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, binding)
+		log.Printf("HandlerSchemaBindings: schema %s bound to %s", binding.Schema, binding.ItemName)
+	case http.MethodDelete:
+		if err := api.db.UnbindSchema(owner, req.URL.Query().Get("item_name")); err != nil {
+			sendSchemaDBError(w, "UnbindSchema", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Schema unbound successfully"})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sendSchemaDBError(w http.ResponseWriter, op string, err error) {
+	switch {
+	case err == database.ErrAlreadyExists:
+		http.Error(w, "Schema already exists", http.StatusConflict)
+	case err.Error() == "no rows affected":
+		http.Error(w, "Schema not found", http.StatusNotFound)
+	default:
+		log.Printf("%s: Error: %v", op, err)
+		http.Error(w, "Failed to process schema", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"mock_service/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Заглушка БД для проверки схем: записи и схемы по имени записи
+type schemaTestDB struct {
+	database.DBAdapter
+	items   map[int64]*database.DBItem
+	schemas map[string]*database.Schema // имя записи -> схема
+	lookups []string                    // коллекции, переданные в GetSchemaForItem
+}
+
+func (db *schemaTestDB) Get(id int64, userHash string) (*database.DBItem, error) {
+	if item, ok := db.items[id]; ok {
+		return item, nil
+	}
+	return nil, errors.New("no rows affected")
+}
+
+func (db *schemaTestDB) GetSchemaForItem(userHash string, itemID int64, name string, collection string) (*database.Schema, error) {
+	db.lookups = append(db.lookups, collection)
+	return db.schemas[name], nil
+}
+
+const testPersonSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"address": {
+			"type": "object",
+			"required": ["city"],
+			"properties": {"city": {"type": "string"}}
+		},
+		"tags": {"type": "array", "items": {"type": "string"}}
+	},
+	"additionalProperties": false
+}`
+
+func decodeValue(t *testing.T, raw string) map[string]interface{} {
+	t.Helper()
+	var value map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		t.Fatalf("invalid test value %s: %v", raw, err)
+	}
+	return value
+}
+
+func TestCompileSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr string
+	}{
+		{name: "valid", schema: testPersonSchema},
+		{name: "empty schema", schema: `{}`},
+		{name: "boolean schema", schema: `true`},
+		{name: "local ref", schema: `{"$defs": {"s": {"type": "string"}}, "$ref": "#/$defs/s"}`},
+		{name: "not json", schema: `{"type":`, wantErr: "invalid"},
+		{name: "unknown type", schema: `{"type": "strin"}`, wantErr: "strin"},
+		{name: "invalid keyword value", schema: `{"minLength": -1}`, wantErr: "minLength"},
+		{name: "external ref", schema: `{"$ref": "https://example.com/schema.json"}`, wantErr: "external references are not allowed"},
+		{name: "file ref", schema: `{"$ref": "file:///etc/passwd"}`, wantErr: "external references are not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := compileSchema(json.RawMessage(tt.schema))
+			if tt.wantErr == "" {
+				if err != nil || schema == nil {
+					t.Fatalf("compileSchema() = %v, %v; want schema", schema, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("compileSchema() succeeded, want error containing %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("compileSchema() error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBoundSchemaValidate(t *testing.T) {
+	schema, err := compileSchema(json.RawMessage(testPersonSchema))
+	if err != nil {
+		t.Fatalf("compileSchema: %v", err)
+	}
+	bound := &boundSchema{name: "person", schema: schema}
+
+	tests := []struct {
+		name  string
+		value string
+		want  []schemaViolation // только InstanceLocation и KeywordLocation; nil - значение соответствует схеме
+	}{
+		{name: "valid", value: `{"name": "Ann", "age": 30}`},
+		{name: "valid nested", value: `{"name": "Ann", "age": 30, "address": {"city": "Omsk"}, "tags": ["a"]}`},
+		{
+			name:  "missing required",
+			value: `{"name": "Ann"}`,
+			want:  []schemaViolation{{InstanceLocation: "", KeywordLocation: "/required"}},
+		},
+		{
+			name:  "wrong type",
+			value: `{"name": "Ann", "age": "thirty"}`,
+			want:  []schemaViolation{{InstanceLocation: "/age", KeywordLocation: "/properties/age/type"}},
+		},
+		{
+			name:  "not integer",
+			value: `{"name": "Ann", "age": 30.5}`,
+			want:  []schemaViolation{{InstanceLocation: "/age", KeywordLocation: "/properties/age/type"}},
+		},
+		{
+			name:  "minimum",
+			value: `{"name": "Ann", "age": -1}`,
+			want:  []schemaViolation{{InstanceLocation: "/age", KeywordLocation: "/properties/age/minimum"}},
+		},
+		{
+			name:  "nested required",
+			value: `{"name": "Ann", "age": 30, "address": {}}`,
+			want:  []schemaViolation{{InstanceLocation: "/address", KeywordLocation: "/properties/address/required"}},
+		},
+		{
+			name:  "array item",
+			value: `{"name": "Ann", "age": 30, "tags": ["a", 1]}`,
+			want:  []schemaViolation{{InstanceLocation: "/tags/1", KeywordLocation: "/properties/tags/items/type"}},
+		},
+		{
+			name:  "additional property",
+			value: `{"name": "Ann", "age": 30, "extra": true}`,
+			want:  []schemaViolation{{InstanceLocation: "", KeywordLocation: "/additionalProperties"}},
+		},
+		{
+			name:  "several violations",
+			value: `{"name": "", "age": -1}`,
+			want: []schemaViolation{
+				{InstanceLocation: "/name", KeywordLocation: "/properties/name/minLength"},
+				{InstanceLocation: "/age", KeywordLocation: "/properties/age/minimum"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			se := bound.validate(decodeValue(t, tt.value))
+			if tt.want == nil {
+				if se != nil {
+					t.Fatalf("validate() = %+v, want nil", se)
+				}
+				return
+			}
+			if se == nil {
+				t.Fatalf("validate() = nil, want violations %+v", tt.want)
+			}
+			if se.Schema != "person" || se.Error == "" {
+				t.Errorf("validate() schema = %q, error = %q", se.Schema, se.Error)
+			}
+			for _, want := range tt.want {
+				if !hasViolation(se.Violations, want) {
+					t.Errorf("violation %+v not found in %+v", want, se.Violations)
+				}
+			}
+			if len(se.Violations) != len(tt.want) {
+				t.Errorf("got %d violations %+v, want %d", len(se.Violations), se.Violations, len(tt.want))
+			}
+		})
+	}
+}
+
+func hasViolation(violations []schemaViolation, want schemaViolation) bool {
+	for _, v := range violations {
+		if v.InstanceLocation == want.InstanceLocation && v.KeywordLocation == want.KeywordLocation && v.Message != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBoundSchemaValidateNil(t *testing.T) {
+	var bound *boundSchema
+	if se := bound.validate(map[string]interface{}{"any": 1}); se != nil {
+		t.Fatalf("validate() on nil schema = %+v, want nil", se)
+	}
+}
+
+func TestCheckItem(t *testing.T) {
+	db := &schemaTestDB{
+		items: map[int64]*database.DBItem{
+			1: {ID: 1, Name: "person", Value: map[string]interface{}{"name": "Ann", "age": float64(30)}},
+			2: {ID: 2, Name: "note", Value: map[string]interface{}{"text": "free form"}},
+		},
+		schemas: map[string]*database.Schema{
+			"person": {ID: 1, Name: "person", Schema: json.RawMessage(testPersonSchema), UpdatedAt: time.Now()},
+		},
+	}
+	api := &API{db: db, schemas: newSchemaCache()}
+
+	tests := []struct {
+		name           string
+		id             int64
+		item           *database.DBItem
+		wantViolations bool
+		wantCollection string // коллекция, по которой искалась схема; "" - поиска не было
+	}{
+		{
+			name:           "create valid",
+			item:           &database.DBItem{Name: "person", Value: decodeValue(t, `{"name": "Bob", "age": 1}`)},
+			wantCollection: database.DefaultCollection,
+		},
+		{
+			name:           "create invalid",
+			item:           &database.DBItem{Name: "person", Value: decodeValue(t, `{"name": "Bob"}`)},
+			wantViolations: true,
+			wantCollection: database.DefaultCollection,
+		},
+		{
+			name:           "create in collection",
+			item:           &database.DBItem{Name: "person", Value: decodeValue(t, `{"name": "Bob", "age": 1}`), Collection: "work"},
+			wantCollection: "work",
+		},
+		{
+			name:           "create without schema",
+			item:           &database.DBItem{Name: "note", Value: decodeValue(t, `{"anything": [1, 2]}`)},
+			wantCollection: database.DefaultCollection,
+		},
+		{
+			name: "create without value",
+			item: &database.DBItem{Name: "person"},
+		},
+		{
+			name:           "update value only checks current name",
+			id:             1,
+			item:           &database.DBItem{Value: decodeValue(t, `{"name": "Ann"}`)},
+			wantViolations: true,
+		},
+		{
+			name: "update name only checks current value",
+			id:   2,
+			item: &database.DBItem{Name: "person"},
+			// текущий value записи 2 не подходит под схему person
+			wantViolations: true,
+		},
+		{
+			name: "update valid",
+			id:   1,
+			item: &database.DBItem{Value: decodeValue(t, `{"name": "Ann", "age": 31}`)},
+		},
+		{
+			name: "update missing item",
+			id:   42,
+			item: &database.DBItem{Value: decodeValue(t, `{"name": "Ann"}`)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.lookups = nil
+			se, err := api.checkItem("user", tt.id, tt.item)
+			if err != nil {
+				t.Fatalf("checkItem() error = %v", err)
+			}
+			if (se != nil) != tt.wantViolations {
+				t.Fatalf("checkItem() = %+v, want violations: %v", se, tt.wantViolations)
+			}
+			if tt.wantCollection != "" && (len(db.lookups) != 1 || db.lookups[0] != tt.wantCollection) {
+				t.Errorf("schema looked up in %v, want %q", db.lookups, tt.wantCollection)
+			}
+		})
+	}
+}
+
+func TestCheckItemInvalidStoredSchema(t *testing.T) {
+	db := &schemaTestDB{schemas: map[string]*database.Schema{
+		"broken": {ID: 1, Name: "broken", Schema: json.RawMessage(`{"type": "strin"}`)},
+	}}
+	api := &API{db: db, schemas: newSchemaCache()}
+
+	_, err := api.checkItem("user", 0, &database.DBItem{Name: "broken", Value: map[string]interface{}{}})
+	if err == nil || !strings.Contains(err.Error(), "failed to compile schema broken") {
+		t.Fatalf("checkItem() error = %v, want compile error", err)
+	}
+}
+
+func TestSchemaCacheRecompilesUpdatedSchema(t *testing.T) {
+	cache := newSchemaCache()
+	updated := time.Now()
+	s := &database.Schema{ID: 1, Schema: json.RawMessage(`{"type": "string"}`), UpdatedAt: updated}
+
+	first, err := cache.get(s)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if again, _ := cache.get(s); again != first {
+		t.Fatalf("unchanged schema was recompiled")
+	}
+
+	s.Schema = json.RawMessage(`{"type": "integer"}`)
+	s.UpdatedAt = updated.Add(time.Second)
+	second, err := cache.get(s)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if second == first {
+		t.Fatalf("updated schema was not recompiled")
+	}
+	if err := second.Validate(float64(1)); err != nil {
+		t.Fatalf("recompiled schema rejects integer: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"mock_service/database"
+	"net/http"
+	"strconv"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+type searchPage struct {
+	Results []*database.SearchResult `json:"results"`
+	Next    string                   `json:"next,omitempty"` // ссылка на следующую страницу
+}
+
+// HandlerSearch - полнотекстовый поиск по имени и value записей.
+// Параметры: q (слова; "слово*" - поиск по префиксу), limit, offset, shared=true, collection.
+// Фрагменты в snippet - HTML: текст записи экранирован, совпадения выделены <mark>.
+func (api *API) HandlerSearch(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerSearch called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerSearch: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := req.URL.Query()
+	opts := &database.SearchOptions{
+		Query:      query.Get("q"),
+		Shared:     query.Get("shared") == "true",
+		Collection: query.Get("collection"),
+	}
+	if opts.Query == "" {
+		http.Error(w, "q parameter is required", http.StatusBadRequest)
+		return
+	}
+	for name, dst := range map[string]*int{"limit": &opts.Limit, "offset": &opts.Offset} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+	if opts.Limit == 0 {
+		opts.Limit = database.DefaultListLimit
+	}
+	if opts.Limit > database.MaxListLimit {
+		opts.Limit = database.MaxListLimit
+	}
+
+	results, err := api.db.Search(ownerHash(claims), opts)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidFilter) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("HandlerSearch: Error in Search - %v", err)
+		http.Error(w, "Failed to search items", http.StatusInternalServerError)
+		return
+	}
+
+	page := searchPage{Results: results}
+	if page.Results == nil {
+		page.Results = []*database.SearchResult{}
+	}
+	// Полная страница - возможно, есть следующая
+	if len(results) == opts.Limit {
+		query.Set("offset", strconv.Itoa(opts.Offset+opts.Limit))
+		page.Next = req.URL.Path + "?" + query.Encode()
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, page)
+	log.Println("HandlerSearch: finished successfully")
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"log"
+	"mock_service/database"
+	"net/http"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+type shareRequest struct {
+	Username   string `json:"username"`
+	Permission string `json:"permission"`
+}
+
+// HandlerShare - доступы к записи ?id=. GET: список, POST: выдать или изменить доступ,
+// DELETE ?username=: отозвать доступ (получатель может отказаться от своего)
+func (api *API) HandlerShare(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerShare called. METHOD: %s", req.Method)
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerShare: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner := ownerHash(claims)
+
+	switch req.Method {
+	case http.MethodGet:
+		shares, err := api.db.GetShares(id, owner)
+		if err != nil {
+			if err.Error() == "no rows affected" {
+				http.Error(w, "Item not found", http.StatusNotFound)
+			} else {
+				log.Printf("HandlerShare: Error in GetShares - %v", err)
+				http.Error(w, "Failed to get shares", http.StatusInternalServerError)
+			}
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, shares)
+	case http.MethodPost:
+		var input shareRequest
+		if err := json_utils.DecodeJSONBody(req, &input); err != nil || input.Username == "" {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if input.Permission == "" {
+			input.Permission = database.PermissionRead
+		}
+		if !database.IsValidPermission(input.Permission) {
+			http.Error(w, "Invalid permission", http.StatusBadRequest)
+			return
+		}
+		if !canWrite(claims) || (input.Permission == database.PermissionOwner && !canManage(claims)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		share := &database.Share{
+			UserHash:   jwt_utils.HashUsername(input.Username),
+			Username:   input.Username,
+			Permission: input.Permission,
+		}
+		if share.UserHash == owner {
+			http.Error(w, "Cannot share item with yourself", http.StatusBadRequest)
+			return
+		}
+
+		err = api.db.ShareItem(id, owner, share)
+		if err != nil {
+			if err.Error() == "no rows affected" {
+				// Записи нет, она не принадлежит пользователю или получатель уже ее владелец
+				http.Error(w, "Item not found", http.StatusNotFound)
+			} else {
+				log.Printf("HandlerShare: Error in ShareItem - %v", err)
+				http.Error(w, "Failed to share item", http.StatusInternalServerError)
+			}
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, share)
+		log.Printf("HandlerShare: item %d shared with %s (%s)", id, input.Username, input.Permission)
+	case http.MethodDelete:
+		username := req.URL.Query().Get("username")
+		if username == "" {
+			http.Error(w, "username parameter is required", http.StatusBadRequest)
+			return
+		}
+		if !canWrite(claims) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		err = api.db.RevokeShare(id, owner, jwt_utils.HashUsername(username))
+		if err != nil {
+			switch {
+			case err == database.ErrLastOwner:
+				http.Error(w, err.Error(), http.StatusConflict)
+			case err.Error() == "no rows affected":
+				http.Error(w, "Share not found", http.StatusNotFound)
+			default:
+				log.Printf("HandlerShare: Error in RevokeShare - %v", err)
+				http.Error(w, "Failed to revoke share", http.StatusInternalServerError)
+			}
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Share revoked successfully"})
+		log.Printf("HandlerShare: item %d share revoked for %s", id, username)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"io"
+	"log"
+	"mock_service/takeout"
+	"net/http"
+	"time"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// HandlerTakeout - POST запускает выгрузку всех данных пользователя, GET ?id= возвращает ее состояние.
+func (api *API) HandlerTakeout(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerTakeout called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerTakeout: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		// Токен клиента может быть привязан к его ключу (DPoP), поэтому в auth_service
+		// идем с собственным короткоживущим токеном от имени пользователя
+		token, err := jwt_utils.GenerateDelegatedJWT(claims, "mock_service", jwt_utils.ProfileAudience, time.Minute)
+		if err != nil {
+			log.Printf("HandlerTakeout: Error: %v", err)
+			http.Error(w, "Failed to start export", http.StatusInternalServerError)
+			return
+		}
+
+		job, err := api.takeout.Start(claims.Subject, "Bearer "+token)
+		if err != nil {
+			log.Printf("HandlerTakeout: Error: %v", err)
+			http.Error(w, "Failed to start export", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Location", "/takeout?id="+job.ID)
+		json_utils.SendJSONResponse(w, http.StatusAccepted, job)
+		log.Printf("HandlerTakeout: export %s started", job.ID)
+	case http.MethodGet:
+		job, ok := api.takeout.Get(req.URL.Query().Get("id"), claims.Subject)
+		if !ok {
+			http.Error(w, "Export not found", http.StatusNotFound)
+			return
+		}
+
+		json_utils.SendJSONResponse(w, http.StatusOK, job)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerTakeoutDownload - скачивание готового архива
+func (api *API) HandlerTakeoutDownload(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerTakeoutDownload called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerTakeoutDownload: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	job, ok := api.takeout.Get(req.URL.Query().Get("id"), claims.Subject)
+	if !ok {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if job.Status != takeout.StatusDone {
+		http.Error(w, "Export is not ready", http.StatusConflict)
+		return
+	}
+
+	f, err := api.takeout.Open(job)
+	if err != nil {
+		log.Printf("HandlerTakeoutDownload: Error: %v", err)
+		http.Error(w, "Failed to open export", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="takeout-`+job.ID+`.zip"`)
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("HandlerTakeoutDownload: Error: %v", err)
+	}
+}
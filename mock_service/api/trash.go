@@ -0,0 +1,103 @@
+package api
+
+import (
+	"log"
+	"mock_service/database"
+	"net/http"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// HandlerTrash - GET: записи в корзине, DELETE ?id=: окончательное удаление записи
+func (api *API) HandlerTrash(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerTrash called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerTrash: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		items, err := api.db.GetTrash(ownerHash(claims))
+		if err != nil {
+			log.Printf("HandlerTrash: Error in GetTrash - %v", err)
+			http.Error(w, "Failed to get trash", http.StatusInternalServerError)
+			return
+		}
+		if items == nil {
+			items = []*database.DBItem{}
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, items)
+	case http.MethodDelete:
+		id, err := parseIDParam(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !canManage(claims) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		err = api.db.DeletePermanently(id, ownerHash(claims))
+		if err != nil {
+			if err.Error() == "no rows affected" {
+				http.Error(w, "Item not found in trash", http.StatusNotFound)
+			} else {
+				log.Printf("HandlerTrash: Error in DeletePermanently - %v", err)
+				http.Error(w, "Failed to delete item", http.StatusInternalServerError)
+			}
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Item deleted permanently"})
+		log.Printf("HandlerTrash: item %d deleted permanently", id)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerTrashRestore - восстановление записи ?id= из корзины
+func (api *API) HandlerTrashRestore(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerTrashRestore called")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerTrashRestore: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !canWrite(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	err = api.db.RestoreItem(id, ownerHash(claims))
+	if err != nil {
+		if err.Error() == "no rows affected" {
+			http.Error(w, "Item not found in trash", http.StatusNotFound)
+		} else {
+			log.Printf("HandlerTrashRestore: Error in RestoreItem - %v", err)
+			http.Error(w, "Failed to restore item", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Item restored successfully"})
+	log.Printf("HandlerTrashRestore: item %d restored", id)
+}
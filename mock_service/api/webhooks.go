@@ -0,0 +1,299 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"mock_service/database"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	json_utils "utils/json"
+	jwt_utils "utils/jwt"
+)
+
+// Сколько доставок отдается в журнале по умолчанию
+const defaultDeliveriesLimit = 100
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"` // по умолчанию true
+}
+
+// HandlerWebhooks - GET: вебхуки пользователя, POST: регистрация вебхука {url, events, active}.
+// Секрет подписи возвращается только в ответе на POST.
+func (api *API) HandlerWebhooks(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerWebhooks called. METHOD: %s", req.Method)
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerWebhooks: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		webhooks, err := api.db.GetWebhooks(ownerHash(claims))
+		if err != nil {
+			log.Printf("HandlerWebhooks: Error in GetWebhooks - %v", err)
+			http.Error(w, "Failed to get webhooks", http.StatusInternalServerError)
+			return
+		}
+		if webhooks == nil {
+			webhooks = []*database.Webhook{}
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, webhooks)
+	case http.MethodPost:
+		webhook, err := decodeWebhook(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !canManage(claims) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Printf("HandlerWebhooks: Error generating secret - %v", err)
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+
+		if err := api.db.CreateWebhook(ownerHash(claims), webhook); err != nil {
+			log.Printf("HandlerWebhooks: Error in CreateWebhook - %v", err)
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, webhook)
+		log.Printf("HandlerWebhooks: webhook %d created", webhook.ID)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerWebhook - /webhooks/{id}. GET: вебхук, PUT: замена url, events и active, DELETE: удаление
+func (api *API) HandlerWebhook(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HandlerWebhook called. METHOD: %s", req.Method)
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerWebhook: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner := ownerHash(claims)
+
+	if req.Method != http.MethodGet && !canManage(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		webhook, err := api.db.GetWebhook(owner, id)
+		if err != nil {
+			sendWebhookError(w, "GetWebhook", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, webhook)
+	case http.MethodPut:
+		webhook, err := decodeWebhook(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		webhook.ID = id
+
+		if err := api.db.UpdateWebhook(owner, webhook); err != nil {
+			sendWebhookError(w, "UpdateWebhook", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Webhook updated successfully"})
+	case http.MethodDelete:
+		if err := api.db.DeleteWebhook(owner, id); err != nil {
+			sendWebhookError(w, "DeleteWebhook", err)
+			return
+		}
+		json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Webhook deleted successfully"})
+		log.Printf("HandlerWebhook: webhook %d deleted", id)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlerWebhookDeliveries - /webhooks/{id}/deliveries. Журнал доставок от новых к старым,
+// параметры: status (pending, delivered, dead), limit.
+func (api *API) HandlerWebhookDeliveries(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerWebhookDeliveries called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("HandlerWebhookDeliveries: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner := ownerHash(claims)
+
+	query := req.URL.Query()
+	status := query.Get("status")
+	switch status {
+	case "", database.DeliveryPending, database.DeliveryDelivered, database.DeliveryDead:
+	default:
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+	limit := defaultDeliveriesLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, database.MaxListLimit)
+	}
+
+	// Пустой журнал чужого или несуществующего вебхука не отличить от пустого своего
+	if _, err := api.db.GetWebhook(owner, id); err != nil {
+		sendWebhookError(w, "GetWebhook", err)
+		return
+	}
+
+	deliveries, err := api.db.GetWebhookDeliveries(owner, id, status, limit)
+	if err != nil {
+		sendWebhookError(w, "GetWebhookDeliveries", err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*database.WebhookDelivery{}
+	}
+	json_utils.SendJSONResponse(w, http.StatusOK, deliveries)
+}
+
+// HandlerWebhookDelivery - /webhooks/{id}/deliveries/{delivery}: доставка с журналом попыток
+func (api *API) HandlerWebhookDelivery(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerWebhookDelivery called")
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, deliveryID, claims, ok := parseDeliveryRequest(w, req)
+	if !ok {
+		return
+	}
+
+	delivery, err := api.db.GetWebhookDelivery(ownerHash(claims), id, deliveryID)
+	if err != nil {
+		sendWebhookError(w, "GetWebhookDelivery", err)
+		return
+	}
+	json_utils.SendJSONResponse(w, http.StatusOK, delivery)
+}
+
+// HandlerWebhookRedeliver - /webhooks/{id}/deliveries/{delivery}/redeliver: повторная отправка
+// доставки в любом состоянии, в том числе dead
+func (api *API) HandlerWebhookRedeliver(w http.ResponseWriter, req *http.Request) {
+	log.Println("HandlerWebhookRedeliver called")
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, deliveryID, claims, ok := parseDeliveryRequest(w, req)
+	if !ok {
+		return
+	}
+	if !canManage(claims) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := api.db.RedeliverWebhook(ownerHash(claims), id, deliveryID); err != nil {
+		sendWebhookError(w, "RedeliverWebhook", err)
+		return
+	}
+	json_utils.SendJSONResponse(w, http.StatusOK, map[string]string{"message": "Delivery scheduled"})
+	log.Printf("HandlerWebhookRedeliver: delivery %d of webhook %d scheduled", deliveryID, id)
+}
+
+func parseDeliveryRequest(w http.ResponseWriter, req *http.Request) (int64, int64, *jwt_utils.Claims, bool) {
+	id, err := parseIDParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, 0, nil, false
+	}
+	deliveryID, err := strconv.ParseInt(req.PathValue("delivery"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid delivery id", http.StatusBadRequest)
+		return 0, 0, nil, false
+	}
+
+	claims, err := jwt_utils.GetClaimsFromContext(req)
+	if err != nil {
+		log.Printf("parseDeliveryRequest: Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, 0, nil, false
+	}
+	return id, deliveryID, claims, true
+}
+
+func decodeWebhook(req *http.Request) (*database.Webhook, error) {
+	var input webhookRequest
+	if err := json_utils.DecodeJSONBody(req, &input); err != nil {
+		return nil, errors.New("invalid input")
+	}
+
+	u, err := url.Parse(input.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("url must be an absolute http or https URL")
+	}
+	for _, eventType := range input.Events {
+		if !database.IsValidEventType(eventType) {
+			return nil, errors.New("unknown event type " + eventType)
+		}
+	}
+
+	webhook := &database.Webhook{URL: input.URL, Events: input.Events, Active: true}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+	return webhook, nil
+}
+
+func sendWebhookError(w http.ResponseWriter, op string, err error) {
+	if err.Error() == "no rows affected" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("%s: Error: %v", op, err)
+	http.Error(w, "Failed to process webhook", http.StatusInternalServerError)
+}
@@ -0,0 +1,74 @@
+package blobstore
+
+import (
+	"context"
+	"log"
+	"mock_service/database"
+	"time"
+)
+
+const (
+	gcInterval  = time.Minute
+	gcBatchSize = 100
+	gcLease     = 5 * time.Minute
+)
+
+// Collector - удаляет из хранилища объекты, которые больше не прикреплены к записям
+// или так и не были прикреплены
+type Collector struct {
+	db    database.DBAdapter
+	store Store
+}
+
+func NewCollector(db database.DBAdapter, store Store) *Collector {
+	return &Collector{
+		db:    db,
+		store: store,
+	}
+}
+
+// Run - блокирует до отмены ctx
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+
+	for {
+		// Полная пачка - возможно, в очереди есть еще
+		for c.collect(ctx) == gcBatchSize {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Collector) collect(ctx context.Context) int {
+	keys, err := c.db.ClaimBlobGC(gcBatchSize, gcLease)
+	if err != nil {
+		log.Printf("Blob GC: Error: %v", err)
+		return 0
+	}
+
+	// Ключи, которые не удалось удалить, вернутся в очередь после gcLease
+	var deleted []string
+	for _, key := range keys {
+		if err := c.store.Delete(ctx, key); err != nil {
+			log.Printf("Blob GC: Error deleting %s: %v", key, err)
+			continue
+		}
+		deleted = append(deleted, key)
+	}
+	if len(deleted) == 0 {
+		return len(keys)
+	}
+
+	if err := c.db.CompleteBlobGC(deleted); err != nil {
+		log.Printf("Blob GC: Error: %v", err)
+		return 0
+	}
+	log.Printf("Blob GC: %d blobs deleted", len(deleted))
+	return len(keys)
+}
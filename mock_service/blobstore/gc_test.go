@@ -0,0 +1,82 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mock_service/database"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Заглушка БД: очередь удаления и подтвержденные ключи
+type gcQueueDB struct {
+	database.DBAdapter
+
+	queue     []string
+	completed []string
+}
+
+func (db *gcQueueDB) ClaimBlobGC(limit int, lease time.Duration) ([]string, error) {
+	n := min(limit, len(db.queue))
+	keys := db.queue[:n]
+	db.queue = db.queue[n:]
+	return keys, nil
+}
+
+func (db *gcQueueDB) CompleteBlobGC(blobKeys []string) error {
+	db.completed = append(db.completed, blobKeys...)
+	return nil
+}
+
+// Заглушка хранилища: запоминает удаления, ключи из failing удалить нельзя
+type deletingStore struct {
+	Store
+
+	deleted []string
+	failing map[string]bool
+}
+
+func (s *deletingStore) Delete(ctx context.Context, key string) error {
+	if s.failing[key] {
+		return errors.New("unavailable")
+	}
+	s.deleted = append(s.deleted, key)
+	return nil
+}
+
+func (s *deletingStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return nil, ErrNotFound
+}
+
+func TestCollectorCompletesDeletedBlobs(t *testing.T) {
+	db := &gcQueueDB{queue: []string{"a", "b", "c"}}
+	store := &deletingStore{failing: map[string]bool{"b": true}}
+	c := NewCollector(db, store)
+
+	if n := c.collect(context.Background()); n != 3 {
+		t.Fatalf("collect() = %d, want 3", n)
+	}
+	// Неудаленный ключ не подтверждается и вернется в очередь после gcLease
+	if want := []string{"a", "c"}; !reflect.DeepEqual(db.completed, want) {
+		t.Fatalf("completed = %v, want %v", db.completed, want)
+	}
+}
+
+func TestCollectorDrainsFullBatches(t *testing.T) {
+	db := &gcQueueDB{}
+	for i := 0; i < gcBatchSize+10; i++ {
+		db.queue = append(db.queue, fmt.Sprintf("blob-%d", i))
+	}
+	store := &deletingStore{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	NewCollector(db, store).Run(ctx)
+
+	if len(db.queue) != 0 || len(db.completed) != gcBatchSize+10 {
+		t.Fatalf("queue = %d, completed = %d; want everything collected in one run", len(db.queue), len(db.completed))
+	}
+}
@@ -0,0 +1,104 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocalStore(t *testing.T) (*LocalStore, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "blobs")
+	store, err := NewLocalStore(dir)
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	return store, dir
+}
+
+func readBlob(t *testing.T, store Store, key string) string {
+	t.Helper()
+	r, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %q: %v", key, err)
+	}
+	return string(data)
+}
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store, dir := newTestLocalStore(t)
+
+	if err := store.Put(ctx, "k1", strings.NewReader("v1"), &Blob{Size: 2}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := readBlob(t, store, "k1"); got != "v1" {
+		t.Fatalf("Get() = %q, want v1", got)
+	}
+
+	// Существующий объект перезаписывается
+	if err := store.Put(ctx, "k1", strings.NewReader("v2"), &Blob{Size: 2}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := readBlob(t, store, "k1"); got != "v2" {
+		t.Fatalf("Get() after overwrite = %q, want v2", got)
+	}
+
+	if err := store.Delete(ctx, "k1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "k1"); err != ErrNotFound {
+		t.Fatalf("Get() after delete error = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, "k1"); err != nil {
+		t.Fatalf("Delete of missing blob: %v", err)
+	}
+
+	// Временные файлы не остаются
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("directory not empty: %v", entries)
+	}
+}
+
+// Ошибка чтения тела не оставляет ни объекта, ни временного файла
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+
+func TestLocalStoreFailedPut(t *testing.T) {
+	store, dir := newTestLocalStore(t)
+
+	if err := store.Put(context.Background(), "k1", failingReader{}, &Blob{}); err == nil {
+		t.Fatal("Put() with failing reader succeeded")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("directory not empty: %v", entries)
+	}
+}
+
+func TestLocalStoreRejectsKeysOutsideDir(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestLocalStore(t)
+
+	for _, key := range []string{"", ".", "..", "../escape", "a/b", `a\b`} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), &Blob{Size: 1}); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil || err == ErrNotFound {
+			t.Errorf("Get(%q) error = %v, want invalid key", key, err)
+		}
+		if err := store.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+	}
+}
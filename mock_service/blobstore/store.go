@@ -0,0 +1,26 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound - объекта с таким ключом нет
+var ErrNotFound = errors.New("blob not found")
+
+// Blob - метаданные сохраняемого объекта
+type Blob struct {
+	Size        int64
+	ContentType string
+	SHA256      string // hex
+}
+
+// Store - хранилище содержимого вложений. Ключи выдает вызывающая сторона,
+// объект с существующим ключом перезаписывается.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, blob *Blob) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete - удаление отсутствующего объекта не ошибка
+	Delete(ctx context.Context, key string) error
+}
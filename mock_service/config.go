@@ -1,14 +1,55 @@
 package main
 
 import (
+	"fmt"
+	"mock_service/api"
+	"mock_service/blobstore"
 	"mock_service/database"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
+	redis_utils "utils/redis"
 )
 
 type Config struct {
-	Port   uint64            `json:"port"`
-	DBConf database.DBConfig `json:"db"`
+	Port           uint64            `json:"port"`
+	DBConf         database.DBConfig `json:"db"`
+	DeletionMode   string            `json:"deletion_mode"`
+	AuthServiceURL string            `json:"auth_service_url"`
+	TakeoutDir     string            `json:"takeout_dir"`
+
+	// Адрес /debug/vars; только loopback, наружу метрики не публикуются
+	DebugAddr string `json:"debug_addr"`
+
+	// Сколько записи хранятся в корзине (0 - бессрочно) и как часто корзина очищается
+	TrashRetention     time.Duration `json:"trash_retention"`
+	TrashPurgeInterval time.Duration `json:"trash_purge_interval"`
+	// Как часто удаляются записи с истекшим сроком жизни
+	ExpiryReapInterval time.Duration `json:"expiry_reap_interval"`
+	// Сколько хранятся события ленты изменений (для возобновления по Last-Event-ID)
+	EventsRetention time.Duration `json:"events_retention"`
+
+	// Разрешить вебхуки на адреса локальных сетей; сколько хранится журнал завершенных доставок
+	WebhookAllowPrivate bool          `json:"webhook_allow_private"`
+	WebhookLogRetention time.Duration `json:"webhook_log_retention"`
+
+	// Сколько хранятся ответы по ключам Idempotency-Key
+	IdempotencyTTL time.Duration `json:"idempotency_ttl"`
+
+	// Кэш чтения записей в Redis
+	CacheEnabled bool                 `json:"cache_enabled"`
+	Cache        database.CacheConfig `json:"cache"`
+
+	// Хранилище содержимого вложений: local (каталог BlobDir) или s3
+	BlobStore   string               `json:"blob_store"`
+	BlobDir     string               `json:"blob_dir"`
+	S3          blobstore.S3Config   `json:"s3"`
+	Attachments api.AttachmentConfig `json:"attachments"`
+
+	RedisConf            redis_utils.RedisConfig `json:"redis"`
+	RevocationFailPolicy redis_utils.FailPolicy  `json:"revocation_fail_policy"`
 }
 
 func ReadConfig() (*Config, error) {
@@ -28,5 +69,152 @@ func ReadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	config.DebugAddr = os.Getenv("DEBUG_ADDR")
+	if config.DebugAddr == "" {
+		config.DebugAddr = "127.0.0.1:6060"
+	}
+	host, _, err := net.SplitHostPort(config.DebugAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEBUG_ADDR: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("DEBUG_ADDR must be a loopback address")
+	}
+
+	redisConf, err := redis_utils.ReadRedisConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.RedisConf = *redisConf
+
+	config.RevocationFailPolicy, err = redis_utils.ParseFailPolicy(os.Getenv("REVOCATION_FAIL_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+
+	config.DeletionMode = os.Getenv("USER_DELETION_MODE")
+	switch config.DeletionMode {
+	case "":
+		config.DeletionMode = database.DeletionModePurge
+	case database.DeletionModePurge, database.DeletionModeAnonymize:
+	default:
+		return nil, fmt.Errorf("unknown USER_DELETION_MODE %s", config.DeletionMode)
+	}
+
+	config.AuthServiceURL = os.Getenv("AUTH_SERVICE_URL")
+	config.TakeoutDir = os.Getenv("TAKEOUT_DIR")
+	if config.TakeoutDir == "" {
+		config.TakeoutDir = filepath.Join(os.TempDir(), "takeout")
+	}
+
+	config.TrashRetention, err = durationEnv("TRASH_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	config.TrashPurgeInterval, err = durationEnv("TRASH_PURGE_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if config.TrashPurgeInterval <= 0 {
+		return nil, fmt.Errorf("TRASH_PURGE_INTERVAL must be positive")
+	}
+	config.ExpiryReapInterval, err = durationEnv("EXPIRY_REAP_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if config.ExpiryReapInterval <= 0 {
+		return nil, fmt.Errorf("EXPIRY_REAP_INTERVAL must be positive")
+	}
+	config.EventsRetention, err = durationEnv("EVENTS_RETENTION", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	config.IdempotencyTTL, err = durationEnv("IDEMPOTENCY_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if config.IdempotencyTTL <= 0 {
+		return nil, fmt.Errorf("IDEMPOTENCY_TTL must be positive")
+	}
+
+	config.CacheEnabled = os.Getenv("CACHE_ENABLED") == "true"
+	config.Cache.ItemTTL, err = durationEnv("CACHE_ITEM_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	config.Cache.ListTTL, err = durationEnv("CACHE_LIST_TTL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if config.CacheEnabled && (config.Cache.ItemTTL <= 0 || config.Cache.ListTTL <= 0) {
+		return nil, fmt.Errorf("CACHE_ITEM_TTL and CACHE_LIST_TTL must be positive")
+	}
+
+	config.WebhookAllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+	config.WebhookLogRetention, err = durationEnv("WEBHOOK_LOG_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	config.BlobStore = os.Getenv("BLOB_STORE")
+	switch config.BlobStore {
+	case "":
+		config.BlobStore = "local"
+	case "local", "s3":
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %s", config.BlobStore)
+	}
+	config.BlobDir = os.Getenv("BLOB_DIR")
+	if config.BlobDir == "" {
+		config.BlobDir = "blobs"
+	}
+	config.S3 = blobstore.S3Config{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		PathStyle: os.Getenv("S3_PATH_STYLE") == "true",
+	}
+	if config.S3.Region == "" {
+		config.S3.Region = "us-east-1"
+	}
+
+	config.Attachments.MaxSize, err = sizeEnv("ATTACHMENT_MAX_SIZE", 100<<20)
+	if err != nil {
+		return nil, err
+	}
+	config.Attachments.Quota, err = sizeEnv("ATTACHMENT_QUOTA", 1<<30)
+	if err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
+
+// Размер в байтах из переменной окружения или значение по умолчанию
+func sizeEnv(name string, def int64) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return n, nil
+}
+
+// Длительность из переменной окружения ("720h", "30m") или значение по умолчанию
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return d, nil
+}
@@ -1,7 +1,11 @@
 package database
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -18,16 +22,408 @@ type DBItem struct {
 	ID    int64                  `json:"id"`
 	Name  string                 `json:"name"`
 	Value map[string]interface{} `json:"value"`
+	// Доступ текущего пользователя к записи
+	Permission string    `json:"permission,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Version    int64     `json:"version"`
+	// Коллекция записи; при создании пустая означает DefaultCollection,
+	// при изменении непустая переносит запись в эту коллекцию
+	Collection string `json:"collection,omitempty"`
+	// Время перемещения в корзину, только для записей из корзины
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Время, после которого запись скрывается и удаляется; nil - бессрочно
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// TTL - срок жизни в секундах при создании или изменении, важнее ExpiresAt.
+	// Отрицательный при изменении делает запись бессрочной. В ответах не заполняется.
+	TTL int64 `json:"ttl,omitempty"`
 }
 
+// Revision - состояние записи после операции operation (insert, update, delete)
+type Revision struct {
+	ItemID    int64                  `json:"id"`
+	Version   int64                  `json:"version"`
+	Operation string                 `json:"operation"`
+	Name      string                 `json:"name"`
+	Value     map[string]interface{} `json:"value,omitempty"`
+	ChangedAt time.Time              `json:"changed_at"`
+}
+
+// Schema - JSON Schema пользователя для проверки value записей
+type Schema struct {
+	ID        int64           `json:"-"`
+	Name      string          `json:"name"`
+	Schema    json.RawMessage `json:"schema"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// SchemaBinding - записи с именем ItemName проверяются схемой Schema
+type SchemaBinding struct {
+	Schema   string `json:"schema"`
+	ItemName string `json:"item_name"`
+}
+
+// Коллекция, в которую попадают записи без явно указанной коллекции
+const DefaultCollection = "default"
+
+// Collection - коллекция записей владельца
+type Collection struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Schema      string    `json:"schema,omitempty"` // схема для всех записей коллекции
+	Items       int64     `json:"items"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ErrNotEmpty - в коллекции есть записи
+var ErrNotEmpty = errors.New("collection is not empty")
+
+// Поля, по которым можно сортировать список записей
+const (
+	SortByID        = "id"
+	SortByName      = "name"
+	SortByCreatedAt = "created_at"
+	SortByUpdatedAt = "updated_at"
+)
+
+// Ограничения размера страницы
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ErrInvalidCursor - курсор поврежден или получен для другой сортировки
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions - параметры выборки списка записей
+type ListOptions struct {
+	Limit int    // размер страницы, 0 - DefaultListLimit
+	After string // курсор из предыдущей страницы
+
+	NamePrefix    string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+
+	Sort string // SortBy*, по умолчанию id
+	Desc bool
+
+	Shared     bool   // записи, которыми поделились с пользователем, вместо собственных
+	Collection string // только записи из этой коллекции
+
+	// Фильтры по value
+	Contains json.RawMessage // value @> Contains
+	HasKeys  []string        // value содержит все ключи верхнего уровня
+	JSONPath string          // value @? JSONPath
+	Where    []ValueFilter
+}
+
+// SearchOptions - параметры полнотекстового поиска
+type SearchOptions struct {
+	// Query - слова через пробел, все должны встретиться в имени или value;
+	// слово со звездочкой в конце ищется по префиксу (app* найдет apple)
+	Query      string
+	Limit      int // 0 - DefaultListLimit
+	Offset     int
+	Shared     bool   // только записи, которыми поделились с пользователем
+	Collection string // только записи из этой коллекции
+}
+
+// SearchResult - найденная запись, ее релевантность и фрагмент с выделенными совпадениями
+type SearchResult struct {
+	*DBItem
+	Rank    float32 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// Типы событий ленты изменений
+const (
+	EventCreate  = "create"
+	EventUpdate  = "update"
+	EventDelete  = "delete"  // запись перемещена в корзину
+	EventRestore = "restore" // запись восстановлена из корзины
+	EventShare   = "share"   // пользователю выдан или изменен доступ
+	EventRevoke  = "revoke"  // доступ пользователя отозван
+	EventPurge   = "purge"   // запись удалена окончательно
+	// Запись удалена по истечении срока жизни. Событие появляется, когда запись удаляет
+	// expiry.Reaper (раз в EXPIRY_REAP_INTERVAL), а не в момент истечения: читать запись
+	// нельзя уже с expires_at, но события до удаления нет.
+	EventExpire = "expire"
+)
+
+func IsValidEventType(eventType string) bool {
+	switch eventType {
+	case EventCreate, EventUpdate, EventDelete, EventRestore, EventShare, EventRevoke, EventPurge, EventExpire:
+		return true
+	}
+	return false
+}
+
+// ItemEvent - изменение записи, адресованное пользователю UserHash
+type ItemEvent struct {
+	ID        int64     `json:"id"`
+	UserHash  string    `json:"-"`
+	ItemID    int64     `json:"item_id"`
+	Type      string    `json:"type"`
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Webhook - адрес, на который отправляются события пользователя.
+// Secret - ключ подписи HMAC-SHA256, отдается только при создании.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"` // типы событий, пустой - все
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Состояния доставки события вебхуку
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead" // попытки исчерпаны, повтор - только вручную
+)
+
+// WebhookDelivery - отправка одного события одному вебхуку
+type WebhookDelivery struct {
+	ID            int64             `json:"id"`
+	WebhookID     int64             `json:"webhook_id"`
+	EventID       int64             `json:"event_id"`
+	EventType     string            `json:"event_type"`
+	Payload       json.RawMessage   `json:"payload"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt time.Time         `json:"next_attempt_at"`
+	LastError     string            `json:"last_error,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	FinishedAt    *time.Time        `json:"finished_at,omitempty"`
+	AttemptLog    []*WebhookAttempt `json:"attempt_log,omitempty"`
+
+	// Заполняются для отправки
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookAttempt - результат одной попытки доставки
+type WebhookAttempt struct {
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMs  int64     `json:"duration_ms"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// Attachment - файл, прикрепленный к записи. Содержимое хранится в хранилище
+// объектов под ключом BlobKey, размер учитывается в квоте загрузившего.
+type Attachment struct {
+	ItemID      int64     `json:"item_id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	CreatedAt   time.Time `json:"created_at"`
+	BlobKey     string    `json:"-"`
+}
+
+// ErrQuotaExceeded - вложение не помещается в квоту пользователя
+var ErrQuotaExceeded = errors.New("attachment quota exceeded")
+
+// Операторы сравнения вложенных полей value
+const (
+	FilterEq  = "eq"
+	FilterNe  = "ne"
+	FilterGt  = "gt"
+	FilterGte = "gte"
+	FilterLt  = "lt"
+	FilterLte = "lte"
+)
+
+// ValueFilter - сравнение поля value по пути Path (ключи объектов или индексы массивов)
+type ValueFilter struct {
+	Path  []string
+	Op    string
+	Value string // JSON-значение; если это не JSON, сравнивается как строка
+}
+
+// ErrVersionMismatch - запись изменилась с тех пор, как клиент ее прочитал
+var ErrVersionMismatch = errors.New("item version mismatch")
+
+// ErrInvalidItem - запись нарушает ограничения таблицы (например, нет имени)
+var ErrInvalidItem = errors.New("invalid item")
+
+// ErrAlreadyExists - объект с таким именем уже есть
+var ErrAlreadyExists = errors.New("already exists")
+
+// PatchFunc - получает текущее value записи и возвращает новое
+type PatchFunc func(value []byte) ([]byte, error)
+
+// ExpiryChange - новый срок жизни записи: TTL в секундах (отрицательный - бессрочно)
+// важнее ExpiresAt. Нулевое значение срок не меняет.
+type ExpiryChange struct {
+	TTL       int64
+	ExpiresAt *time.Time
+}
+
+// ErrNotFound - записи нет или она недоступна пользователю
+var ErrNotFound = errors.New("item not found")
+
+// ErrInvalidFilter - фильтр не удалось применить (например, синтаксическая ошибка в JSONPath)
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Уровни доступа к записи
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+	PermissionOwner = "owner"
+)
+
+func IsValidPermission(permission string) bool {
+	switch permission {
+	case PermissionRead, PermissionWrite, PermissionOwner:
+		return true
+	}
+	return false
+}
+
+// Share - доступ пользователя к записи
+type Share struct {
+	UserHash   string `json:"userhash"`
+	Username   string `json:"username,omitempty"`
+	Permission string `json:"permission"`
+}
+
+// Что делать с данными удаленного пользователя
+const (
+	DeletionModePurge     = "purge"     // удалить записи
+	DeletionModeAnonymize = "anonymize" // отвязать записи от пользователя
+)
+
+// Владелец, к которому переходят записи при анонимизации
+const AnonymizedUserHash = "anonymized"
+
 type DBAdapter interface {
 	InitialzeDB() error
 	FinishDB() error
 	Insert(item *DBItem, userHash string) (int64, error)
-	Update(id int64, item *DBItem, userHash string) error
-	Delete(id int64, userHash string) error
+	// BeginTx - транзакция для группы изменений
+	BeginTx() (DBTx, error)
+	// Update, Patch, Delete: expectedVersion - ожидаемая версия записи (0 - не проверять),
+	// при несовпадении возвращается ErrVersionMismatch
+	Update(id int64, item *DBItem, userHash string, expectedVersion int64) error
+	// Patch - атомарно изменяет value записи функцией apply и срок жизни; ошибка apply возвращается как есть
+	Patch(id int64, userHash string, expectedVersion int64, expiry ExpiryChange, apply PatchFunc) (*DBItem, error)
+	Delete(id int64, userHash string, expectedVersion int64) error
+	// Get - запись, доступная пользователю; ErrNotFound, если ее нет, она в корзине или истекла
 	Get(id int64, userHash string) (*DBItem, error)
-	GetAll(userHash string) ([]*DBItem, error)
+	// GetTrash - записи пользователя в корзине, от недавно удаленных
+	GetTrash(userHash string) ([]*DBItem, error)
+	RestoreItem(id int64, userHash string) error
+	// DeletePermanently - окончательно удаляет запись из корзины вместе с историей
+	DeletePermanently(id int64, userHash string) error
+	// PurgeTrash - окончательно удаляет записи, попавшие в корзину раньше before
+	PurgeTrash(before time.Time) (int64, error)
+	// PurgeExpired - удаляет записи с истекшим сроком жизни вместе с историей
+	PurgeExpired() (int64, error)
+	CreateSchema(userHash string, schema *Schema) error
+	UpdateSchema(userHash string, schema *Schema) error
+	DeleteSchema(userHash string, name string) error
+	GetSchema(userHash string, name string) (*Schema, error)
+	GetSchemas(userHash string) ([]*Schema, error)
+	BindSchema(userHash string, binding *SchemaBinding) error
+	UnbindSchema(userHash string, itemName string) error
+	GetSchemaBindings(userHash string) ([]*SchemaBinding, error)
+	// GetSchemaForItem - схема, которой должна соответствовать запись itemID с именем name
+	// в коллекции collection (для новой записи itemID = 0, схемы берутся у userHash; для
+	// существующей - у ее владельцев, пустая collection - текущая коллекция записи).
+	// Схема, привязанная к имени, важнее схемы коллекции. nil, если схемы нет.
+	GetSchemaForItem(userHash string, itemID int64, name string, collection string) (*Schema, error)
+	CreateCollection(userHash string, collection *Collection) error
+	UpdateCollection(userHash string, collection *Collection) error
+	// DeleteCollection - удаляет пустую коллекцию (ErrNotEmpty, если в ней есть записи),
+	// записи из корзины и с истекшим сроком жизни удаляются вместе с ней
+	DeleteCollection(userHash string, name string) error
+	GetCollection(userHash string, name string) (*Collection, error)
+	GetCollections(userHash string) ([]*Collection, error)
+	// GetHistory - ревизии записи без значений, от новых к старым
+	GetHistory(id int64, userHash string) ([]*Revision, error)
+	// GetRevision - запись в версии version
+	GetRevision(id int64, userHash string, version int64) (*Revision, error)
+	// GetAll - страница списка записей и курсор следующей страницы ("" - страница последняя)
+	GetAll(userHash string, opts *ListOptions) ([]*DBItem, string, error)
+	// GetEvents - события пользователя с ID больше afterID по возрастанию ID
+	GetEvents(userHash string, afterID int64, limit int) ([]*ItemEvent, error)
+	// GetLateEvents - события пользователя с ID меньше afterID, которые могли быть зафиксированы
+	// позже события afterID (ID выдаются до фиксации). Часть из них уже могла быть получена.
+	GetLateEvents(userHash string, afterID int64, limit int) ([]*ItemEvent, error)
+	// PruneEvents - удаляет события, созданные раньше before
+	PruneEvents(before time.Time) (int64, error)
+	// ListenEvents - передает в handle новые события всех пользователей, блокирует до отмены ctx.
+	// afterID > 0 - сначала передаются события, записанные после него.
+	ListenEvents(ctx context.Context, afterID int64, handle func(*ItemEvent)) error
+	CreateWebhook(userHash string, webhook *Webhook) error
+	// UpdateWebhook - меняет адрес, типы событий и активность
+	UpdateWebhook(userHash string, webhook *Webhook) error
+	DeleteWebhook(userHash string, id int64) error
+	GetWebhook(userHash string, id int64) (*Webhook, error)
+	GetWebhooks(userHash string) ([]*Webhook, error)
+	// GetWebhookDeliveries - последние доставки вебхука, status "" - в любом состоянии
+	GetWebhookDeliveries(userHash string, webhookID int64, status string, limit int) ([]*WebhookDelivery, error)
+	// GetWebhookDelivery - доставка вместе с журналом попыток
+	GetWebhookDelivery(userHash string, webhookID int64, deliveryID int64) (*WebhookDelivery, error)
+	// RedeliverWebhook - ставит доставку в очередь заново с обнулением попыток
+	RedeliverWebhook(userHash string, webhookID int64, deliveryID int64) error
+	// ClaimWebhookDeliveries - доставки, которые пора отправить; на время lease их не получат
+	// другие экземпляры сервиса, после lease (например, при падении процесса) они вернутся в очередь
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error)
+	// RecordWebhookAttempt - сохраняет попытку. Неудачная попытка с retryAt = nil переводит
+	// доставку в dead, иначе следующая попытка назначается на retryAt.
+	RecordWebhookAttempt(deliveryID int64, attempt *WebhookAttempt, success bool, retryAt *time.Time) error
+	// PruneWebhookDeliveries - удаляет завершенные доставки, завершенные раньше before
+	PruneWebhookDeliveries(before time.Time) (int64, error)
+	// CreateAttachment - прикрепляет к записи загруженный объект (нужен доступ write или owner),
+	// вложение с тем же именем заменяется. Если вместе с ним usage пользователя превысит
+	// quota, возвращается ErrQuotaExceeded. Ожидающее удаление объекта отменяется.
+	CreateAttachment(userHash string, attachment *Attachment, quota int64) error
+	GetAttachments(itemID int64, userHash string) ([]*Attachment, error)
+	GetAttachment(itemID int64, userHash string, name string) (*Attachment, error)
+	DeleteAttachment(itemID int64, userHash string, name string) error
+	// GetAttachmentUsage - суммарный размер вложений, загруженных пользователем
+	GetAttachmentUsage(userHash string) (int64, error)
+	// ScheduleBlobGC - удалить объект после delay, если к этому времени он не прикреплен
+	ScheduleBlobGC(blobKey string, delay time.Duration) error
+	// ClaimBlobGC - ключи объектов, которые пора удалить; на время lease их не получат
+	// другие экземпляры сервиса
+	ClaimBlobGC(limit int, lease time.Duration) ([]string, error)
+	// CompleteBlobGC - объекты удалены из хранилища
+	CompleteBlobGC(blobKeys []string) error
+	// Search - записи, доступные пользователю, по полнотекстовому запросу, от более релевантных
+	Search(userHash string, opts *SearchOptions) ([]*SearchResult, error)
+	// ShareItem - выдает или меняет доступ к записи; доступно только владельцу
+	ShareItem(id int64, ownerHash string, share *Share) error
+	GetShares(id int64, ownerHash string) ([]*Share, error)
+	// RevokeShare - отзывает доступ; владелец может отозвать любой доступ, получатель - свой
+	RevokeShare(id int64, userHash string, targetHash string) error
+	// DeleteUserData - удаляет или анонимизирует записи пользователя и фиксирует результат
+	// в журнале удалений. Повторный вызов с тем же eventID ничего не делает.
+	DeleteUserData(userHash string, mode string, eventID string) (int64, error)
+}
+
+// DBTx - изменения записей в одной транзакции. После Commit или Rollback использовать нельзя.
+type DBTx interface {
+	Insert(item *DBItem, userHash string) (int64, error)
+	Update(id int64, item *DBItem, userHash string, expectedVersion int64) error
+	Delete(id int64, userHash string, expectedVersion int64) error
+	// FindByName - ID записей владельца с именем name (в коллекции collection, если она задана),
+	// не больше limit
+	FindByName(userHash string, name string, collection string, limit int) ([]int64, error)
+	// Точки сохранения: ошибка одной операции не отменяет предыдущие
+	Savepoint(name string) error
+	RollbackTo(name string) error
+	Release(name string) error
+	Commit() error
+	Rollback() error
 }
 
 func NewDBAdapter(dbType string, cfg *DBConfig) (DBAdapter, error) {
@@ -5,12 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 )
 
 const PSQL_ERR_DB_ALREADY_EXISTS = "42P04"
+const PSQL_ERR_SYNTAX_ERROR = "42601"
+const PSQL_ERR_UNIQUE_VIOLATION = "23505"
+
+// Класс ошибок данных (неверный формат значения, ошибки вычисления JSONPath и т.п.)
+const PSQL_ERR_CLASS_DATA_EXCEPTION = "22"
+
+// Класс ошибок нарушения ограничений (NOT NULL, CHECK и т.п.)
+const PSQL_ERR_CLASS_INTEGRITY_VIOLATION = "23"
 
 type PostgresDB struct {
 	db  *sql.DB
@@ -35,9 +44,7 @@ func (p *PostgresDB) InitialzeDB() error {
 }
 
 func (p *PostgresDB) сonnectAndCreateDB(cfg *DBConfig) (*sql.DB, error) {
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=postgres sslmode=disable",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword)
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", dataSourceName(cfg, "postgres"))
 	if err != nil {
 		return nil, err
 	}
@@ -57,9 +64,12 @@ func (p *PostgresDB) сonnectAndCreateDB(cfg *DBConfig) (*sql.DB, error) {
 	db.Close()
 
 	// Подключаемся к созданной (или существующей) базе данных
-	connStr = fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
-	return sql.Open("postgres", connStr)
+	return sql.Open("postgres", dataSourceName(cfg, cfg.DBName))
+}
+
+func dataSourceName(cfg *DBConfig, dbName string) string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, dbName)
 }
 
 func (p *PostgresDB) initializeTables() error {
@@ -70,28 +80,208 @@ func (p *PostgresDB) initializeTables() error {
         value JSONB NOT NULL
     );
 
+		ALTER TABLE _items ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		ALTER TABLE _items ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		-- Версия записи для оптимистичных блокировок, увеличивается триггером touch_items
+		ALTER TABLE _items ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+		-- Время перемещения в корзину; такие записи скрыты представлением items
+		ALTER TABLE _items ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS _items_deleted_at_idx ON _items (deleted_at) WHERE deleted_at IS NOT NULL;
+		-- Срок жизни записи; истекшие записи скрыты представлением items и удаляются фоново
+		ALTER TABLE _items ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS _items_expires_at_idx ON _items (expires_at) WHERE expires_at IS NOT NULL;
+		-- Индексы для постраничной выборки с сортировкой (ключ курсора - пара (поле, id))
+		CREATE INDEX IF NOT EXISTS _items_name_id_idx ON _items (name, id);
+		CREATE INDEX IF NOT EXISTS _items_created_at_id_idx ON _items (created_at, id);
+		CREATE INDEX IF NOT EXISTS _items_updated_at_id_idx ON _items (updated_at, id);
+		-- Фильтр prefix (LIKE 'префикс%'): индекс (name, id) в сортировке базы для LIKE не подходит
+		CREATE INDEX IF NOT EXISTS _items_name_pattern_idx ON _items (name text_pattern_ops);
+		-- jsonb_ops поддерживает @>, ?, ?&, @? для фильтров по value
+		CREATE INDEX IF NOT EXISTS _items_value_idx ON _items USING GIN (value jsonb_ops);
+
+		-- Полнотекстовый индекс: имя важнее текста строк и чисел из value
+		ALTER TABLE _items ADD COLUMN IF NOT EXISTS search TSVECTOR GENERATED ALWAYS AS (
+			setweight(to_tsvector('simple'::regconfig, name), 'A') ||
+			setweight(jsonb_to_tsvector('simple'::regconfig, value, '["string", "numeric"]'), 'B')
+		) STORED;
+		CREATE INDEX IF NOT EXISTS _items_search_idx ON _items USING GIN (search);
+
+		-- Текст value для фрагментов результатов поиска
+		CREATE OR REPLACE FUNCTION item_text(value JSONB) RETURNS TEXT AS $$
+			SELECT string_agg(v #>> '{}', ' ')
+			FROM jsonb_path_query(value, 'strict $.** ? (@.type() == "string" || @.type() == "number")') v
+		$$ LANGUAGE sql IMMUTABLE;
+
+		-- Экранирование текста фрагментов: ts_headline возвращает текст как есть
+		CREATE OR REPLACE FUNCTION html_escape(s TEXT) RETURNS TEXT AS $$
+			SELECT replace(replace(replace(replace(replace(s,
+				'&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')
+		$$ LANGUAGE sql IMMUTABLE;
+
+		CREATE OR REPLACE FUNCTION touch_items() RETURNS TRIGGER AS $$
+		BEGIN
+				NEW.updated_at := now();
+				NEW.version := OLD.version + 1;
+				RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS touch_items ON _items;
+		-- Перенос в другую коллекцию версию не меняет
+		CREATE TRIGGER touch_items BEFORE UPDATE OF name, value, deleted_at ON _items
+			FOR EACH ROW EXECUTE FUNCTION touch_items();
+
 		CREATE TABLE IF NOT EXISTS _user2items (
 				id BIGSERIAL PRIMARY KEY,
 				userhash TEXT NOT NULL,
 				item_id BIGINT NOT NULL REFERENCES _items(id) ON DELETE CASCADE
 		);
 
+		-- Уровень доступа к записи: владелец или получатель, с которым ею поделились
+		ALTER TABLE _user2items ADD COLUMN IF NOT EXISTS permission TEXT NOT NULL DEFAULT 'owner'
+				CHECK (permission IN ('read', 'write', 'owner'));
+		-- Имя получателя (хэш необратим, а в списке доступов нужно показывать имя)
+		ALTER TABLE _user2items ADD COLUMN IF NOT EXISTS username TEXT;
+		CREATE UNIQUE INDEX IF NOT EXISTS _user2items_userhash_item_id_idx ON _user2items (userhash, item_id);
+
+		CREATE TABLE IF NOT EXISTS _user_deletions (
+				id BIGSERIAL PRIMARY KEY,
+				event_id TEXT UNIQUE NOT NULL,
+				userhash TEXT NOT NULL,
+				mode TEXT NOT NULL,
+				items_affected BIGINT NOT NULL DEFAULT 0,
+				processed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+
+		-- История изменений записей. Ссылки на _items нет: история удаленной записи сохраняется.
+		CREATE TABLE IF NOT EXISTS _items_history (
+				id BIGSERIAL PRIMARY KEY,
+				item_id BIGINT NOT NULL,
+				version BIGINT NOT NULL,
+				operation TEXT NOT NULL,
+				name TEXT NOT NULL,
+				value JSONB NOT NULL,
+				changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS _items_history_item_id_version_idx ON _items_history (item_id, version);
+
+		CREATE OR REPLACE FUNCTION record_item_history() RETURNS TRIGGER AS $$
+		DECLARE
+				op TEXT := lower(TG_OP);
+		BEGIN
+				IF TG_OP = 'DELETE' THEN
+						INSERT INTO _items_history (item_id, version, operation, name, value)
+						VALUES (OLD.id, OLD.version, 'delete', OLD.name, OLD.value);
+						RETURN OLD;
+				END IF;
+				-- Перемещение в корзину и восстановление из нее
+				IF TG_OP = 'UPDATE' AND NEW.deleted_at IS DISTINCT FROM OLD.deleted_at THEN
+						op := CASE WHEN NEW.deleted_at IS NULL THEN 'restore' ELSE 'trash' END;
+				END IF;
+				INSERT INTO _items_history (item_id, version, operation, name, value)
+				VALUES (NEW.id, NEW.version, op, NEW.name, NEW.value);
+				RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS record_item_history ON _items;
+		CREATE TRIGGER record_item_history AFTER INSERT OR UPDATE OF name, value, deleted_at OR DELETE ON _items
+			FOR EACH ROW EXECUTE FUNCTION record_item_history();
+
+		-- Записи, созданные до появления истории, получают начальную ревизию
+		INSERT INTO _items_history (item_id, version, operation, name, value)
+			SELECT id, version, 'insert', name, value FROM _items i
+			WHERE NOT EXISTS (SELECT 1 FROM _items_history h WHERE h.item_id = i.id);
+
+		-- JSON Schema для проверки value и их привязки к именам записей
+		CREATE TABLE IF NOT EXISTS _schemas (
+				id BIGSERIAL PRIMARY KEY,
+				userhash TEXT NOT NULL,
+				name TEXT NOT NULL,
+				schema JSONB NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				UNIQUE (userhash, name)
+		);
+
+		CREATE TABLE IF NOT EXISTS _schema_bindings (
+				id BIGSERIAL PRIMARY KEY,
+				userhash TEXT NOT NULL,
+				schema_id BIGINT NOT NULL REFERENCES _schemas(id) ON DELETE CASCADE,
+				item_name TEXT NOT NULL,
+				UNIQUE (userhash, item_name)
+		);
+
+		-- Коллекции записей; у каждого владельца есть коллекция default
+		CREATE TABLE IF NOT EXISTS _collections (
+				id BIGSERIAL PRIMARY KEY,
+				userhash TEXT NOT NULL,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				schema_id BIGINT REFERENCES _schemas(id) ON DELETE SET NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				UNIQUE (userhash, name)
+		);
+
+		ALTER TABLE _items ADD COLUMN IF NOT EXISTS collection_id BIGINT REFERENCES _collections(id) ON DELETE SET NULL;
+		CREATE INDEX IF NOT EXISTS _items_collection_id_idx ON _items (collection_id);
+
+		-- Записи, созданные до появления коллекций, переносятся в коллекцию default владельца
+		INSERT INTO _collections (userhash, name, description)
+			SELECT DISTINCT u.userhash, 'default', 'Default collection'
+			FROM _user2items u JOIN _items i ON i.id = u.item_id
+			WHERE u.permission = 'owner' AND i.collection_id IS NULL
+			ON CONFLICT (userhash, name) DO NOTHING;
+		UPDATE _items i SET collection_id = c.id
+			FROM _user2items u, _collections c
+			WHERE i.collection_id IS NULL AND u.item_id = i.id AND u.permission = 'owner'
+				AND c.userhash = u.userhash AND c.name = 'default';
+
 		CREATE OR REPLACE VIEW items AS
 			SELECT 
 					u.userhash AS userhash,
 					i.id AS id,
 					i.name AS name,
-					i.value AS value
+					i.value AS value,
+					u.permission AS permission,
+					i.created_at AS created_at,
+					i.updated_at AS updated_at,
+					i.version AS version,
+					-- Коллекция видна только владельцам: у получателя доступа ее нет
+					COALESCE(CASE WHEN u.permission = 'owner' THEN c.name END, '') AS collection,
+					i.search AS search,
+					i.expires_at AS expires_at,
+					i.collection_id AS collection_id
 			FROM _user2items u
-			JOIN _items i ON u.item_id = i.id;
-
-		CREATE OR REPLACE FUNCTION insert_into_items(name TEXT, value JSONB, userhash TEXT)
+			JOIN _items i ON u.item_id = i.id
+			LEFT JOIN _collections c ON c.id = i.collection_id
+			WHERE i.deleted_at IS NULL AND (i.expires_at IS NULL OR i.expires_at > now());
+
+		-- Без коллекции запись попадает в default, которая создается при первой записи
+		DROP FUNCTION IF EXISTS insert_into_items(TEXT, JSONB, TEXT);
+		DROP FUNCTION IF EXISTS insert_into_items(TEXT, JSONB, TEXT, TEXT);
+		CREATE OR REPLACE FUNCTION insert_into_items(name TEXT, value JSONB, userhash TEXT, collection TEXT DEFAULT NULL,
+				expires_at TIMESTAMPTZ DEFAULT NULL)
 		RETURNS BIGINT AS $$
 		DECLARE
 				new_item_id BIGINT;
+				target_name TEXT := COALESCE(NULLIF(collection, ''), 'default');
+				target_id BIGINT;
 		BEGIN
-				INSERT INTO _items (name, value)
-				VALUES (name, value)
+				IF target_name = 'default' THEN
+						INSERT INTO _collections (userhash, name, description)
+						VALUES (userhash, 'default', 'Default collection')
+						ON CONFLICT ON CONSTRAINT _collections_userhash_name_key DO NOTHING;
+				END IF;
+
+				SELECT c.id INTO target_id FROM _collections c
+					WHERE c.userhash = insert_into_items.userhash AND c.name = target_name;
+				IF target_id IS NULL THEN
+						RAISE EXCEPTION 'collection % not found', target_name USING ERRCODE = 'foreign_key_violation';
+				END IF;
+
+				INSERT INTO _items (name, value, collection_id, expires_at)
+				VALUES (name, value, target_id, expires_at)
 				RETURNING id INTO new_item_id;
 
 				INSERT INTO _user2items (userhash, item_id)
@@ -101,12 +291,14 @@ func (p *PostgresDB) initializeTables() error {
 		END;
 		$$ LANGUAGE plpgsql;
 
+		-- Удаление через представление перемещает запись в корзину
 		CREATE OR REPLACE RULE delete_user_items AS
 			ON DELETE TO items
 			DO INSTEAD (
-					DELETE FROM _items 
+					UPDATE _items SET deleted_at = now()
 						WHERE id IN (
-							SELECT item_id FROM _user2items WHERE item_id = OLD.id AND userhash = OLD.userhash
+							SELECT item_id FROM _user2items
+								WHERE item_id = OLD.id AND userhash = OLD.userhash AND permission = 'owner'
 						);
 		);
 		CREATE OR REPLACE RULE update_user_items AS
@@ -117,9 +309,182 @@ func (p *PostgresDB) initializeTables() error {
 					name = COALESCE(NULLIF(NEW.name, ''), OLD.name), 
 					value = COALESCE(NEW.value, OLD.value) 
 				WHERE id IN (
-					SELECT item_id FROM _user2items WHERE item_id = OLD.id AND userhash = OLD.userhash
+					SELECT item_id FROM _user2items
+						WHERE item_id = OLD.id AND userhash = OLD.userhash AND permission IN ('write', 'owner')
 				);
 		);
+
+		-- Лента изменений: событие для каждого пользователя с доступом к записи,
+		-- уведомление в канал item_events после фиксации транзакции
+		CREATE TABLE IF NOT EXISTS _item_events (
+				id BIGSERIAL PRIMARY KEY,
+				userhash TEXT NOT NULL,
+				item_id BIGINT NOT NULL,
+				type TEXT NOT NULL,
+				version BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS _item_events_userhash_id_idx ON _item_events (userhash, id);
+		-- ID выдаются до фиксации, поэтому событие с меньшим ID может стать видимым позже.
+		-- tx_id - транзакция события, tx_xmin - старейшая незавершенная транзакция при записи:
+		-- все события с меньшим ID, зафиксированные позже, имеют tx_id >= tx_xmin.
+		ALTER TABLE _item_events
+				ADD COLUMN IF NOT EXISTS tx_id xid8 NOT NULL DEFAULT pg_current_xact_id(),
+				ADD COLUMN IF NOT EXISTS tx_xmin xid8 NOT NULL DEFAULT pg_snapshot_xmin(pg_current_snapshot());
+		CREATE INDEX IF NOT EXISTS _item_events_created_at_idx ON _item_events (created_at);
+
+		CREATE OR REPLACE FUNCTION emit_item_event(userhash TEXT, item_id BIGINT, type TEXT, version BIGINT)
+		RETURNS VOID AS $$
+		DECLARE
+				event _item_events;
+		BEGIN
+				INSERT INTO _item_events (userhash, item_id, type, version)
+				VALUES (emit_item_event.userhash, emit_item_event.item_id, emit_item_event.type, COALESCE(emit_item_event.version, 0))
+				RETURNING * INTO event;
+				PERFORM pg_notify('item_events', json_build_object(
+						'id', event.id, 'userhash', event.userhash, 'item_id', event.item_id,
+						'type', event.type, 'version', event.version, 'created_at', event.created_at)::text);
+		END;
+		$$ LANGUAGE plpgsql;
+
+		CREATE OR REPLACE FUNCTION notify_item_change() RETURNS TRIGGER AS $$
+		DECLARE
+				event_type TEXT := 'update';
+		BEGIN
+				IF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+						event_type := 'delete';
+				ELSIF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL THEN
+						event_type := 'restore';
+				ELSIF NEW.deleted_at IS NOT NULL THEN
+						RETURN NULL;
+				END IF;
+				PERFORM emit_item_event(u.userhash, NEW.id, event_type, NEW.version)
+					FROM _user2items u WHERE u.item_id = NEW.id;
+				RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS notify_item_change ON _items;
+		CREATE TRIGGER notify_item_change AFTER UPDATE OF name, value, deleted_at ON _items
+			FOR EACH ROW EXECUTE FUNCTION notify_item_change();
+
+		-- Создание записи, выдача и отзыв доступа. Строка, удаленная вместе с записью, - purge
+		-- или причина удаления из mock.change_reason (expire).
+		CREATE OR REPLACE FUNCTION notify_access_change() RETURNS TRIGGER AS $$
+		DECLARE
+				item_version BIGINT;
+		BEGIN
+				IF TG_OP = 'DELETE' THEN
+						SELECT version INTO item_version FROM _items WHERE id = OLD.item_id;
+						PERFORM emit_item_event(OLD.userhash, OLD.item_id,
+								CASE WHEN FOUND THEN 'revoke'
+										ELSE COALESCE(NULLIF(current_setting('mock.change_reason', true), ''), 'purge') END,
+								item_version);
+						RETURN NULL;
+				END IF;
+
+				SELECT version INTO item_version FROM _items WHERE id = NEW.item_id;
+				PERFORM emit_item_event(NEW.userhash, NEW.item_id,
+						CASE WHEN TG_OP = 'INSERT' AND NOT EXISTS (
+								SELECT 1 FROM _user2items WHERE item_id = NEW.item_id AND id <> NEW.id
+						) THEN 'create' ELSE 'share' END, item_version);
+				RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS notify_access_change ON _user2items;
+		CREATE TRIGGER notify_access_change AFTER INSERT OR UPDATE OF permission OR DELETE ON _user2items
+			FOR EACH ROW EXECUTE FUNCTION notify_access_change();
+
+		-- Вебхуки пользователя; пустой events - все типы событий
+		CREATE TABLE IF NOT EXISTS _webhooks (
+				id BIGSERIAL PRIMARY KEY,
+				userhash TEXT NOT NULL,
+				url TEXT NOT NULL,
+				secret TEXT NOT NULL,
+				events TEXT[] NOT NULL DEFAULT '{}',
+				active BOOLEAN NOT NULL DEFAULT true,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS _webhooks_userhash_idx ON _webhooks (userhash);
+
+		-- Outbox: доставка создается в той же транзакции, что и событие
+		CREATE TABLE IF NOT EXISTS _webhook_deliveries (
+				id BIGSERIAL PRIMARY KEY,
+				webhook_id BIGINT NOT NULL REFERENCES _webhooks(id) ON DELETE CASCADE,
+				event_id BIGINT NOT NULL,
+				event_type TEXT NOT NULL,
+				payload JSONB NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+				attempts INT NOT NULL DEFAULT 0,
+				next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				last_error TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				finished_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS _webhook_deliveries_pending_idx ON _webhook_deliveries (next_attempt_at)
+			WHERE status = 'pending';
+		CREATE INDEX IF NOT EXISTS _webhook_deliveries_webhook_id_idx ON _webhook_deliveries (webhook_id, id);
+
+		CREATE TABLE IF NOT EXISTS _webhook_attempts (
+				id BIGSERIAL PRIMARY KEY,
+				delivery_id BIGINT NOT NULL REFERENCES _webhook_deliveries(id) ON DELETE CASCADE,
+				status_code INT NOT NULL DEFAULT 0,
+				error TEXT NOT NULL DEFAULT '',
+				duration_ms BIGINT NOT NULL DEFAULT 0,
+				attempted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS _webhook_attempts_delivery_id_idx ON _webhook_attempts (delivery_id);
+
+		CREATE OR REPLACE FUNCTION enqueue_webhook_deliveries() RETURNS TRIGGER AS $$
+		BEGIN
+				INSERT INTO _webhook_deliveries (webhook_id, event_id, event_type, payload)
+				SELECT w.id, NEW.id, NEW.type, json_build_object(
+						'id', NEW.id, 'type', NEW.type, 'item_id', NEW.item_id,
+						'version', NEW.version, 'created_at', NEW.created_at)
+				FROM _webhooks w
+				WHERE w.userhash = NEW.userhash AND w.active AND (cardinality(w.events) = 0 OR NEW.type = ANY(w.events));
+				RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS enqueue_webhook_deliveries ON _item_events;
+		CREATE TRIGGER enqueue_webhook_deliveries AFTER INSERT ON _item_events
+			FOR EACH ROW EXECUTE FUNCTION enqueue_webhook_deliveries();
+
+		CREATE TABLE IF NOT EXISTS _attachments (
+				id BIGSERIAL PRIMARY KEY,
+				item_id BIGINT NOT NULL REFERENCES _items(id) ON DELETE CASCADE,
+				userhash TEXT NOT NULL,
+				name TEXT NOT NULL CHECK (name <> ''),
+				content_type TEXT NOT NULL,
+				size BIGINT NOT NULL CHECK (size >= 0),
+				sha256 TEXT NOT NULL,
+				blob_key TEXT NOT NULL UNIQUE,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				UNIQUE (item_id, name)
+		);
+		CREATE INDEX IF NOT EXISTS _attachments_userhash_idx ON _attachments (userhash);
+
+		-- Объекты хранилища, которые нужно удалить. Строка с not_before в будущем и без
+		-- claimed_until защищает еще не прикрепленный объект: если загрузка не завершится,
+		-- объект будет удален.
+		CREATE TABLE IF NOT EXISTS _blob_gc (
+				blob_key TEXT PRIMARY KEY,
+				not_before TIMESTAMPTZ NOT NULL DEFAULT now(),
+				claimed_until TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS _blob_gc_not_before_idx ON _blob_gc (not_before);
+
+		CREATE OR REPLACE FUNCTION schedule_blob_gc() RETURNS TRIGGER AS $$
+		BEGIN
+				IF TG_OP = 'DELETE' OR NEW.blob_key IS DISTINCT FROM OLD.blob_key THEN
+						INSERT INTO _blob_gc (blob_key) VALUES (OLD.blob_key)
+						ON CONFLICT (blob_key) DO UPDATE SET not_before = now();
+				END IF;
+				RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS schedule_blob_gc ON _attachments;
+		CREATE TRIGGER schedule_blob_gc AFTER UPDATE OF blob_key OR DELETE ON _attachments
+			FOR EACH ROW EXECUTE FUNCTION schedule_blob_gc();
 		`
 	_, err := p.db.Exec(query)
 	return err
@@ -130,6 +495,32 @@ func (p *PostgresDB) FinishDB() error {
 }
 
 func (p *PostgresDB) Insert(item *DBItem, userHash string) (int64, error) {
+	return insertItem(p.db, item, userHash)
+}
+
+func (p *PostgresDB) Update(id int64, item *DBItem, userHash string, expectedVersion int64) error {
+	if item.Collection == "" && !changesExpiry(item) {
+		return updateItem(p.db, id, item, userHash, expectedVersion)
+	}
+
+	// Изменение, перенос в другую коллекцию и смена срока жизни - одной транзакцией
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateItem(tx, id, item, userHash, expectedVersion); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresDB) Delete(id int64, userHash string, expectedVersion int64) error {
+	return deleteItem(p.db, id, userHash, expectedVersion)
+}
+
+func insertItem(q querier, item *DBItem, userHash string) (int64, error) {
 	var jsonValue interface{} = nil
 	var err error
 	if item.Value != nil {
@@ -139,32 +530,35 @@ func (p *PostgresDB) Insert(item *DBItem, userHash string) (int64, error) {
 		}
 	}
 
-	query := `select insert_into_items(NULLIF($1, ''), $2, $3);`
+	if err := checkExpiry(item); err != nil {
+		return 0, err
+	}
+
+	query := `select insert_into_items(NULLIF($1, ''), $2, $3, $4,
+							CASE WHEN $6::bigint > 0 THEN now() + make_interval(secs => $6) ELSE $5::timestamptz END);`
 	var id int64
-	err = p.db.QueryRow(query, item.Name, jsonValue, userHash).Scan(&id)
+	err = q.QueryRow(query, item.Name, jsonValue, userHash, item.Collection, item.ExpiresAt, item.TTL).Scan(&id)
+	if pgErr, ok := err.(*pq.Error); ok && pgErr.Code.Class() == PSQL_ERR_CLASS_INTEGRITY_VIOLATION {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidItem, pgErr.Message)
+	}
 	return id, err
 }
 
 func (p *PostgresDB) Get(id int64, userHash string) (*DBItem, error) {
-	query := `SELECT id, name, value FROM items WHERE id=$1 and userhash=$2`
-	v := &DBItem{}
-	var valueBytes []byte
-	err := p.db.QueryRow(query, id, userHash).Scan(&v.ID, &v.Name, &valueBytes)
+	query := `SELECT ` + itemColumns + ` FROM items WHERE id=$1 and userhash=$2`
+	v, err := scanItem(p.db.QueryRow(query, id, userHash))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, errors.New("failed to select item from db: " + err.Error())
 	}
 
-	// Декодируем JSON-значение из valueBytes в map[string]interface{}
-	if err := json.Unmarshal(valueBytes, &v.Value); err != nil {
-		return nil, errors.New("failed to decode JSON field 'value': " + err.Error())
-	}
-
 	return v, nil
 }
 
-func (p *PostgresDB) GetAll(userHash string) ([]*DBItem, error) {
-	query := `SELECT id, name, value FROM items WHERE userhash=$1 ORDER BY id`
-	rows, err := p.db.Query(query, userHash)
+func (p *PostgresDB) queryItems(query string, args ...interface{}) ([]*DBItem, error) {
+	rows, err := p.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -173,18 +567,10 @@ func (p *PostgresDB) GetAll(userHash string) ([]*DBItem, error) {
 	var items []*DBItem
 	// Итерируемся по результатам
 	for rows.Next() {
-		v := &DBItem{}
-		var valueBytes []byte // временная переменная для хранения []byte из jsonb
-		// Сканируем текущую строку в структуру DBItem
-		if err := rows.Scan(&v.ID, &v.Name, &valueBytes); err != nil {
+		v, err := scanItem(rows)
+		if err != nil {
 			return nil, err
 		}
-
-		// Декодируем JSON-значение из valueBytes в map[string]interface{}
-		if err := json.Unmarshal(valueBytes, &v.Value); err != nil {
-			return nil, errors.New("failed to decode JSON field 'value': " + err.Error())
-		}
-
 		items = append(items, v)
 	}
 
@@ -196,9 +582,36 @@ func (p *PostgresDB) GetAll(userHash string) ([]*DBItem, error) {
 	return items, nil
 }
 
-func (p *PostgresDB) Delete(id int64, userHash string) error {
-	query := `DELETE FROM items WHERE id=$1 AND userhash=$2`
-	result, err := p.db.Exec(query, id, userHash)
+// Общий интерфейс *sql.Row и *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanItem - читает строку с колонками itemColumns и дополнительными колонками extra
+func scanItem(row rowScanner, extra ...interface{}) (*DBItem, error) {
+	v := &DBItem{}
+	var valueBytes []byte // временная переменная для хранения []byte из jsonb
+	dest := append([]interface{}{&v.ID, &v.Name, &valueBytes, &v.Permission, &v.CreatedAt, &v.UpdatedAt, &v.Version, &v.Collection,
+		&v.ExpiresAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	// Декодируем JSON-значение из valueBytes в map[string]interface{}
+	if err := json.Unmarshal(valueBytes, &v.Value); err != nil {
+		return nil, errors.New("failed to decode JSON field 'value': " + err.Error())
+	}
+	return v, nil
+}
+
+func deleteItem(q querier, id int64, userHash string, expectedVersion int64) error {
+	// Не через правило delete_user_items: для DELETE, замененного на UPDATE,
+	// Postgres не возвращает число измененных строк
+	query := `UPDATE _items SET deleted_at = now()
+						WHERE id=$1 AND deleted_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+							AND ($3::bigint = 0 OR version=$3)
+							AND id IN (SELECT item_id FROM _user2items WHERE item_id=$1 AND userhash=$2 AND permission='owner')`
+	result, err := q.Exec(query, id, userHash, expectedVersion)
 	if err != nil {
 		return err
 	}
@@ -210,13 +623,13 @@ func (p *PostgresDB) Delete(id int64, userHash string) error {
 	}
 
 	if rowsAffected == 0 {
-		return errors.New("no rows affected")
+		return checkVersion(q, id, userHash, expectedVersion, PermissionOwner)
 	}
 
 	return nil
 }
 
-func (p *PostgresDB) Update(id int64, item *DBItem, userHash string) error {
+func updateItem(q querier, id int64, item *DBItem, userHash string, expectedVersion int64) error {
 	var jsonValue interface{} = nil
 	if item.Value != nil {
 		var err error
@@ -225,13 +638,16 @@ func (p *PostgresDB) Update(id int64, item *DBItem, userHash string) error {
 			return fmt.Errorf("error marshalling json: %v", err)
 		}
 	}
+	if err := checkExpiry(item); err != nil {
+		return err
+	}
 
 	query := `UPDATE items 
              SET
               name = COALESCE(NULLIF($1, ''), name), 
               value = COALESCE($2, value) 
-             WHERE id=$3 AND userhash=$4`
-	result, err := p.db.Exec(query, item.Name, jsonValue, id, userHash)
+             WHERE id=$3 AND userhash=$4 AND ($5::bigint = 0 OR version=$5)`
+	result, err := q.Exec(query, item.Name, jsonValue, id, userHash, expectedVersion)
 	if err != nil {
 		return err
 	}
@@ -243,8 +659,278 @@ func (p *PostgresDB) Update(id int64, item *DBItem, userHash string) error {
 	}
 
 	if rowsAffected == 0 {
-		return errors.New("no rows affected")
+		return checkVersion(q, id, userHash, expectedVersion, PermissionWrite, PermissionOwner)
+	}
+
+	if item.Collection != "" {
+		if err := moveItem(q, id, userHash, item.Collection); err != nil {
+			return err
+		}
+	}
+
+	// Право на изменение уже проверено обновлением выше
+	return setExpiry(q, id, ExpiryChange{TTL: item.TTL, ExpiresAt: item.ExpiresAt})
+}
+
+// Меняет срок жизни записи без проверки прав
+func setExpiry(q querier, id int64, expiry ExpiryChange) error {
+	if !changesExpiry(&DBItem{TTL: expiry.TTL, ExpiresAt: expiry.ExpiresAt}) {
+		return nil
 	}
 
+	query := `UPDATE _items SET expires_at = CASE
+							WHEN $2::bigint > 0 THEN now() + make_interval(secs => $2)
+							WHEN $2::bigint < 0 THEN NULL
+							ELSE $3::timestamptz END
+						WHERE id=$1`
+	_, err := q.Exec(query, id, expiry.TTL, expiry.ExpiresAt)
+	return err
+}
+
+func changesExpiry(item *DBItem) bool {
+	return item.TTL != 0 || item.ExpiresAt != nil
+}
+
+// Срок жизни, истекший уже при записи, - ошибка клиента
+func checkExpiry(item *DBItem) error {
+	if item.TTL == 0 && item.ExpiresAt != nil && !item.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: expires_at must be in the future", ErrInvalidItem)
+	}
 	return nil
 }
+
+// Переносит запись в коллекцию владельца; переносить может только владелец
+func moveItem(q querier, id int64, userHash string, collection string) error {
+	query := `UPDATE _items i SET collection_id = c.id
+						FROM _user2items u, _collections c
+						WHERE i.id=$1 AND u.item_id = i.id AND u.userhash=$2 AND u.permission='owner'
+							AND c.userhash=$2 AND c.name=$3`
+	result, err := q.Exec(query, id, userHash, collection)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: collection %s not found", ErrInvalidItem, collection)
+	}
+
+	return nil
+}
+
+// Объясняет, почему запись не изменилась: если у пользователя есть нужный доступ,
+// значит не совпала версия (ErrVersionMismatch), иначе "no rows affected"
+func checkVersion(q querier, id int64, userHash string, expectedVersion int64, permissions ...string) error {
+	if expectedVersion == 0 {
+		return errors.New("no rows affected")
+	}
+
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM items WHERE id=$1 AND userhash=$2 AND permission = ANY($3))`
+	if err := q.QueryRow(query, id, userHash, pq.Array(permissions)).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return errors.New("no rows affected")
+}
+
+func (p *PostgresDB) Patch(id int64, userHash string, expectedVersion int64, expiry ExpiryChange, apply PatchFunc) (*DBItem, error) {
+	if err := checkExpiry(&DBItem{TTL: expiry.TTL, ExpiresAt: expiry.ExpiresAt}); err != nil {
+		return nil, err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Блокируем запись до конца транзакции, чтобы параллельные изменения не потерялись
+	var valueBytes []byte
+	var version int64
+	query := `SELECT i.value, i.version FROM _items i JOIN _user2items u ON u.item_id = i.id
+						WHERE i.id=$1 AND u.userhash=$2 AND u.permission IN ('write', 'owner')
+							AND i.deleted_at IS NULL AND (i.expires_at IS NULL OR i.expires_at > now())
+						FOR UPDATE OF i`
+	err = tx.QueryRow(query, id, userHash).Scan(&valueBytes, &version)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no rows affected")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expectedVersion != 0 && version != expectedVersion {
+		return nil, ErrVersionMismatch
+	}
+
+	patched, err := apply(valueBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE _items SET value=$1 WHERE id=$2`, patched, id); err != nil {
+		return nil, err
+	}
+	if err := setExpiry(tx, id, expiry); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT ` + itemColumns + ` FROM items WHERE id=$1 and userhash=$2`
+	item, err := scanItem(tx.QueryRow(query, id, userHash))
+	if err != nil {
+		return nil, err
+	}
+
+	return item, tx.Commit()
+}
+
+// Удаляет записи пользователя вместе с их историей
+func (p *PostgresDB) purgeUserItems(tx *sql.Tx, userHash string) (int64, error) {
+	query := `DELETE FROM _items WHERE id IN (
+							SELECT item_id FROM _user2items u WHERE userhash=$1 AND NOT EXISTS (
+								SELECT 1 FROM _user2items o WHERE o.item_id=u.item_id AND o.userhash<>$1 AND o.permission='owner'))
+						RETURNING id`
+	count, err := deleteItemsWithHistory(tx, query, userHash)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM _user2items WHERE userhash=$1`, userHash); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Выполняет query вида DELETE FROM _items ... RETURNING id и удаляет историю удаленных записей
+func deleteItemsWithHistory(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	var ids []int64
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Отдельным запросом: ревизии удаления записываются триггером после DELETE
+	if _, err := tx.Exec(`DELETE FROM _items_history WHERE item_id = ANY($1)`, pq.Array(ids)); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+// Передает записи пользователя анонимному владельцу. Если запись уже принадлежит
+// ему (ее совладелец был удален раньше), связь пользователя просто удаляется:
+// (userhash, item_id) уникален.
+func (p *PostgresDB) anonymizeUserItems(tx *sql.Tx, userHash string) (int64, error) {
+	query := `DELETE FROM _user2items u WHERE userhash=$1
+						AND EXISTS (SELECT 1 FROM _user2items a WHERE a.item_id=u.item_id AND a.userhash=$2)`
+	result, err := tx.Exec(query, userHash, AnonymizedUserHash)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err = tx.Exec(`UPDATE _user2items SET userhash=$2 WHERE userhash=$1`, userHash, AnonymizedUserHash)
+	if err != nil {
+		return 0, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted + updated, nil
+}
+
+func (p *PostgresDB) DeleteUserData(userHash string, mode string, eventID string) (int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Событие могло быть доставлено повторно - тогда оно уже есть в журнале
+	var recordID int64
+	query := `INSERT INTO _user_deletions (event_id, userhash, mode) VALUES ($1, $2, $3)
+						ON CONFLICT (event_id) DO NOTHING RETURNING id`
+	err = tx.QueryRow(query, eventID, userHash, mode).Scan(&recordID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Сначала убираем доступы, выданные пользователю к чужим записям
+	_, err = tx.Exec(`DELETE FROM _user2items WHERE userhash=$1 AND permission<>'owner'`, userHash)
+	if err != nil {
+		return 0, err
+	}
+
+	var rowsAffected int64
+	switch mode {
+	case DeletionModePurge:
+		// Записи, у которых есть другие владельцы, остаются им
+		rowsAffected, err = p.purgeUserItems(tx, userHash)
+	case DeletionModeAnonymize:
+		rowsAffected, err = p.anonymizeUserItems(tx, userHash)
+	default:
+		return 0, fmt.Errorf("unknown deletion mode %s", mode)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Вложения, оставшиеся на чужих или анонимизированных записях, больше не в квоте пользователя
+	_, err = tx.Exec(`UPDATE _attachments SET userhash=$2 WHERE userhash=$1`, userHash, AnonymizedUserHash)
+	if err != nil {
+		return 0, err
+	}
+
+	// Схемы - настройки пользователя, а не данные: удаляются в любом режиме
+	if _, err = tx.Exec(`DELETE FROM _schemas WHERE userhash=$1`, userHash); err != nil {
+		return 0, err
+	}
+	if mode == DeletionModePurge {
+		_, err = tx.Exec(`DELETE FROM _collections WHERE userhash=$1`, userHash)
+	} else {
+		// Имена коллекций уникальны у владельца, поэтому к ним добавляется id
+		_, err = tx.Exec(`UPDATE _collections SET userhash=$2, name=name || '-' || id WHERE userhash=$1`, userHash, AnonymizedUserHash)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Лента изменений и вебхуки адресованы пользователю и после удаления не нужны
+	if _, err = tx.Exec(`DELETE FROM _item_events WHERE userhash=$1`, userHash); err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec(`DELETE FROM _webhooks WHERE userhash=$1`, userHash); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE _user_deletions SET items_affected=$1 WHERE id=$2`, rowsAffected, recordID)
+	if err != nil {
+		return 0, err
+	}
+
+	return rowsAffected, tx.Commit()
+}
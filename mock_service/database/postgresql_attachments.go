@@ -0,0 +1,161 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const attachmentColumns = `a.item_id, a.name, a.content_type, a.size, a.sha256, a.created_at, a.blob_key`
+
+func (p *PostgresDB) CreateAttachment(userHash string, attachment *Attachment, quota int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM items WHERE id=$1 AND userhash=$2 AND permission IN ('write', 'owner'))`
+	if err := tx.QueryRow(query, attachment.ItemID, userHash).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("no rows affected")
+	}
+
+	// Загрузки одного пользователя проверяют квоту по очереди
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, userHash); err != nil {
+		return err
+	}
+	// Заменяемое вложение освобождает свое место
+	var usage int64
+	query = `SELECT COALESCE(SUM(size), 0) FROM _attachments
+						WHERE userhash=$1 AND NOT (item_id=$2 AND name=$3)`
+	if err := tx.QueryRow(query, userHash, attachment.ItemID, attachment.Name).Scan(&usage); err != nil {
+		return err
+	}
+	if usage+attachment.Size > quota {
+		return ErrQuotaExceeded
+	}
+
+	// Пока объект защищен от сборщика, его можно прикрепить
+	query = `DELETE FROM _blob_gc WHERE blob_key=$1 AND not_before > now() AND claimed_until IS NULL`
+	if err := execAffected(tx, query, attachment.BlobKey); err != nil {
+		if err.Error() == "no rows affected" {
+			return fmt.Errorf("blob %s is not protected from garbage collection", attachment.BlobKey)
+		}
+		return err
+	}
+
+	query = `INSERT INTO _attachments (item_id, userhash, name, content_type, size, sha256, blob_key)
+						VALUES ($1, $2, $3, $4, $5, $6, $7)
+						ON CONFLICT (item_id, name) DO UPDATE SET userhash=EXCLUDED.userhash,
+							content_type=EXCLUDED.content_type, size=EXCLUDED.size, sha256=EXCLUDED.sha256,
+							blob_key=EXCLUDED.blob_key, created_at=now()
+						RETURNING created_at`
+	err = tx.QueryRow(query, attachment.ItemID, userHash, attachment.Name, attachment.ContentType,
+		attachment.Size, attachment.SHA256, attachment.BlobKey).Scan(&attachment.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *PostgresDB) GetAttachments(itemID int64, userHash string) ([]*Attachment, error) {
+	var exists bool
+	if err := p.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM items WHERE id=$1 AND userhash=$2)`, itemID, userHash).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("no rows affected")
+	}
+
+	rows, err := p.db.Query(`SELECT `+attachmentColumns+` FROM _attachments a WHERE a.item_id=$1 ORDER BY a.name`, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []*Attachment{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+func (p *PostgresDB) GetAttachment(itemID int64, userHash string, name string) (*Attachment, error) {
+	query := `SELECT ` + attachmentColumns + ` FROM _attachments a, items i
+						WHERE a.item_id=$1 AND a.name=$3 AND i.id = a.item_id AND i.userhash=$2`
+	a, err := scanAttachment(p.db.QueryRow(query, itemID, userHash, name))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no rows affected")
+	}
+	return a, err
+}
+
+func (p *PostgresDB) DeleteAttachment(itemID int64, userHash string, name string) error {
+	query := `DELETE FROM _attachments WHERE item_id=$1 AND name=$3
+						AND item_id IN (SELECT id FROM items WHERE id=$1 AND userhash=$2 AND permission IN ('write', 'owner'))`
+	return execAffected(p.db, query, itemID, userHash, name)
+}
+
+func (p *PostgresDB) GetAttachmentUsage(userHash string) (int64, error) {
+	var usage int64
+	err := p.db.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM _attachments WHERE userhash=$1`, userHash).Scan(&usage)
+	return usage, err
+}
+
+func (p *PostgresDB) ScheduleBlobGC(blobKey string, delay time.Duration) error {
+	query := `INSERT INTO _blob_gc (blob_key, not_before) VALUES ($1, now() + make_interval(secs => $2))`
+	_, err := p.db.Exec(query, blobKey, delay.Seconds())
+	return err
+}
+
+func (p *PostgresDB) ClaimBlobGC(limit int, lease time.Duration) ([]string, error) {
+	query := `UPDATE _blob_gc SET claimed_until = now() + make_interval(secs => $2)
+						WHERE blob_key IN (
+							SELECT blob_key FROM _blob_gc
+							WHERE not_before <= now() AND (claimed_until IS NULL OR claimed_until <= now())
+							ORDER BY not_before LIMIT $1
+							FOR UPDATE SKIP LOCKED
+						)
+						RETURNING blob_key`
+	rows, err := p.db.Query(query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (p *PostgresDB) CompleteBlobGC(blobKeys []string) error {
+	_, err := p.db.Exec(`DELETE FROM _blob_gc WHERE blob_key = ANY($1)`, pq.Array(blobKeys))
+	return err
+}
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	a := &Attachment{}
+	err := row.Scan(&a.ItemID, &a.Name, &a.ContentType, &a.Size, &a.SHA256, &a.CreatedAt, &a.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
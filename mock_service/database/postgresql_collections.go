@@ -0,0 +1,142 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Колонки коллекции в порядке сканирования в scanCollection
+const collectionColumns = `c.name, c.description, COALESCE(s.name, ''), c.created_at,
+	(SELECT COUNT(*) FROM _items i WHERE i.collection_id = c.id AND i.deleted_at IS NULL
+		AND (i.expires_at IS NULL OR i.expires_at > now()))`
+
+func (p *PostgresDB) CreateCollection(userHash string, collection *Collection) error {
+	schemaID, err := p.collectionSchemaID(userHash, collection.Schema)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO _collections (userhash, name, description, schema_id) VALUES ($1, $2, $3, $4)
+						RETURNING created_at`
+	err = p.db.QueryRow(query, userHash, collection.Name, collection.Description, schemaID).Scan(&collection.CreatedAt)
+	if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == PSQL_ERR_UNIQUE_VIOLATION {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (p *PostgresDB) UpdateCollection(userHash string, collection *Collection) error {
+	schemaID, err := p.collectionSchemaID(userHash, collection.Schema)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE _collections SET description=$3, schema_id=$4 WHERE userhash=$1 AND name=$2`
+	result, err := p.db.Exec(query, userHash, collection.Name, collection.Description, schemaID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return nil
+}
+
+// Схема коллекции по имени; nil - без схемы
+func (p *PostgresDB) collectionSchemaID(userHash string, schema string) (interface{}, error) {
+	if schema == "" {
+		return nil, nil
+	}
+
+	var id int64
+	err := p.db.QueryRow(`SELECT id FROM _schemas WHERE userhash=$1 AND name=$2`, userHash, schema).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: schema %s not found", ErrInvalidItem, schema)
+	}
+	return id, err
+}
+
+func (p *PostgresDB) DeleteCollection(userHash string, name string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var live bool
+	query := `SELECT id, EXISTS (
+							SELECT 1 FROM _items WHERE collection_id = c.id AND deleted_at IS NULL
+								AND (expires_at IS NULL OR expires_at > now())
+						)
+						FROM _collections c WHERE userhash=$1 AND name=$2 FOR UPDATE`
+	err = tx.QueryRow(query, userHash, name).Scan(&id, &live)
+	if err == sql.ErrNoRows {
+		return errors.New("no rows affected")
+	}
+	if err != nil {
+		return err
+	}
+	if live {
+		return ErrNotEmpty
+	}
+
+	if _, err := deleteItemsWithHistory(tx, `DELETE FROM _items WHERE collection_id=$1 RETURNING id`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM _collections WHERE id=$1`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *PostgresDB) GetCollection(userHash string, name string) (*Collection, error) {
+	query := `SELECT ` + collectionColumns + `
+						FROM _collections c LEFT JOIN _schemas s ON s.id = c.schema_id
+						WHERE c.userhash=$1 AND c.name=$2`
+	c, err := scanCollection(p.db.QueryRow(query, userHash, name))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no rows affected")
+	}
+	return c, err
+}
+
+func (p *PostgresDB) GetCollections(userHash string) ([]*Collection, error) {
+	query := `SELECT ` + collectionColumns + `
+						FROM _collections c LEFT JOIN _schemas s ON s.id = c.schema_id
+						WHERE c.userhash=$1 ORDER BY c.name`
+	rows, err := p.db.Query(query, userHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []*Collection
+	for rows.Next() {
+		c, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, c)
+	}
+	return collections, rows.Err()
+}
+
+func scanCollection(row rowScanner) (*Collection, error) {
+	c := &Collection{}
+	if err := row.Scan(&c.Name, &c.Description, &c.Schema, &c.CreatedAt, &c.Items); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
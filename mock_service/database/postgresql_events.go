@@ -0,0 +1,133 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Канал pg_notify, в который пишет emit_item_event
+const itemEventsChannel = "item_events"
+
+const eventColumns = `id, userhash, item_id, type, version, created_at`
+
+// Уведомление содержит получателя события, который не отдается клиентам
+type eventPayload struct {
+	ItemEvent
+	UserHash string `json:"userhash"`
+}
+
+// События с ID меньше $1 из транзакций, которые могли быть зафиксированы после события $1
+const eventsLateForCursor = `id < $1 AND tx_id >= (SELECT tx_xmin FROM _item_events WHERE id = $1)`
+
+func (p *PostgresDB) GetEvents(userHash string, afterID int64, limit int) ([]*ItemEvent, error) {
+	return p.queryEvents(`SELECT `+eventColumns+` FROM _item_events
+													WHERE userhash=$1 AND id>$2 ORDER BY id LIMIT $3`, userHash, afterID, limit)
+}
+
+func (p *PostgresDB) GetLateEvents(userHash string, afterID int64, limit int) ([]*ItemEvent, error) {
+	return p.queryEvents(`SELECT `+eventColumns+` FROM _item_events
+													WHERE `+eventsLateForCursor+` AND userhash=$2 ORDER BY id LIMIT $3`, afterID, userHash, limit)
+}
+
+func (p *PostgresDB) PruneEvents(before time.Time) (int64, error) {
+	result, err := p.db.Exec(`DELETE FROM _item_events WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (p *PostgresDB) ListenEvents(ctx context.Context, afterID int64, handle func(*ItemEvent)) error {
+	listener := pq.NewListener(dataSourceName(p.cfg, p.cfg.DBName), 10*time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("ListenEvents: listener error: %v", err)
+			}
+		})
+	defer listener.Close()
+
+	if err := listener.Listen(itemEventsChannel); err != nil {
+		return err
+	}
+
+	// Последнее полученное событие: уведомления, пропущенные без соединения, читаются из таблицы
+	lastID := afterID
+	if lastID == 0 {
+		if err := p.db.QueryRow(`SELECT COALESCE(max(id), 0) FROM _item_events`).Scan(&lastID); err != nil {
+			return err
+		}
+	} else {
+		// Соединение восстанавливается после ошибки: события, записанные без него
+		if err := p.handleMissedEvents(&lastID, handle); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-listener.Notify:
+			if n == nil {
+				// Соединение восстановлено
+				if err := p.handleMissedEvents(&lastID, handle); err != nil {
+					log.Printf("ListenEvents: Error reading missed events: %v", err)
+				}
+				continue
+			}
+
+			var payload eventPayload
+			if err := json.Unmarshal([]byte(n.Extra), &payload); err != nil {
+				log.Printf("ListenEvents: invalid notification %q: %v", n.Extra, err)
+				continue
+			}
+			e := payload.ItemEvent
+			e.UserHash = payload.UserHash
+			handle(&e)
+			if e.ID > lastID {
+				lastID = e.ID
+			}
+		case <-time.After(90 * time.Second):
+			// Проверка соединения, если уведомлений давно не было
+			go listener.Ping()
+		}
+	}
+}
+
+// Передает в handle события после *lastID и сдвигает его
+func (p *PostgresDB) handleMissedEvents(lastID *int64, handle func(*ItemEvent)) error {
+	events, err := p.queryEvents(`SELECT `+eventColumns+` FROM _item_events
+													WHERE id > $1 OR (`+eventsLateForCursor+`) ORDER BY id`, *lastID)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		handle(e)
+		if e.ID > *lastID {
+			*lastID = e.ID
+		}
+	}
+	return nil
+}
+
+func (p *PostgresDB) queryEvents(query string, args ...interface{}) ([]*ItemEvent, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*ItemEvent
+	for rows.Next() {
+		e := &ItemEvent{}
+		if err := rows.Scan(&e.ID, &e.UserHash, &e.ItemID, &e.Type, &e.Version, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
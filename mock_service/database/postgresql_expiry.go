@@ -0,0 +1,38 @@
+package database
+
+// Сколько истекших записей удаляется в одной транзакции
+const expiryBatchSize = 1000
+
+func (p *PostgresDB) PurgeExpired() (int64, error) {
+	var total int64
+	for {
+		count, err := p.purgeExpiredBatch()
+		total += count
+		if err != nil || count < expiryBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (p *PostgresDB) purgeExpiredBatch() (int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Причина удаления для событий ленты: expire вместо purge
+	if _, err := tx.Exec(`SET LOCAL mock.change_reason = 'expire'`); err != nil {
+		return 0, err
+	}
+
+	query := `DELETE FROM _items WHERE id IN (
+							SELECT id FROM _items WHERE expires_at <= now() LIMIT $1 FOR UPDATE SKIP LOCKED
+						) RETURNING id`
+	count, err := deleteItemsWithHistory(tx, query, expiryBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
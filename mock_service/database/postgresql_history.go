@@ -0,0 +1,60 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// История доступна всем, у кого есть доступ к записи, в том числе к записи в корзине
+// или с истекшим сроком жизни (их нет в представлении items). История окончательно
+// удаленной записи удаляется вместе с ней.
+const historyAccess = `EXISTS (SELECT 1 FROM _user2items WHERE item_id=$1 AND userhash=$2)`
+
+func (p *PostgresDB) GetHistory(id int64, userHash string) ([]*Revision, error) {
+	query := `SELECT item_id, version, operation, name, changed_at FROM _items_history
+						WHERE item_id=$1 AND ` + historyAccess + `
+						ORDER BY id DESC`
+	rows, err := p.db.Query(query, id, userHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*Revision
+	for rows.Next() {
+		r := &Revision{}
+		if err := rows.Scan(&r.ItemID, &r.Version, &r.Operation, &r.Name, &r.ChangedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(revisions) == 0 {
+		return nil, errors.New("no rows affected")
+	}
+	return revisions, nil
+}
+
+func (p *PostgresDB) GetRevision(id int64, userHash string, version int64) (*Revision, error) {
+	query := `SELECT item_id, version, operation, name, value, changed_at FROM _items_history
+						WHERE item_id=$1 AND version=$3 AND operation<>'delete' AND ` + historyAccess + `
+						ORDER BY id DESC LIMIT 1`
+	r := &Revision{}
+	var valueBytes []byte
+	err := p.db.QueryRow(query, id, userHash, version).Scan(&r.ItemID, &r.Version, &r.Operation, &r.Name, &valueBytes, &r.ChangedAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no rows affected")
+	}
+	if err != nil {
+		return nil, errors.New("failed to select revision from db: " + err.Error())
+	}
+
+	if err := json.Unmarshal(valueBytes, &r.Value); err != nil {
+		return nil, errors.New("failed to decode JSON field 'value': " + err.Error())
+	}
+	return r, nil
+}
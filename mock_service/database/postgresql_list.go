@@ -0,0 +1,215 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Колонки представления items в порядке сканирования в queryItems
+const itemColumns = `id, name, value, permission, created_at, updated_at, version, collection, expires_at`
+
+// Курсор - ключ последней записи страницы
+type listCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v,omitempty"` // значение поля сортировки, если сортировка не по id
+	ID    int64  `json:"id"`
+}
+
+func encodeCursor(c *listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string, sort string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &listCursor{}
+	if err := json.Unmarshal(data, c); err != nil || c.Sort != sort {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Построитель условий запроса с позиционными параметрами
+type queryBuilder struct {
+	where []string
+	args  []interface{}
+}
+
+// arg - добавляет параметр и возвращает его плейсхолдер
+func (b *queryBuilder) arg(v interface{}) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (b *queryBuilder) add(cond string) {
+	b.where = append(b.where, cond)
+}
+
+// Фильтр по коллекции владельца. Сравнивается collection_id, а не имя из представления,
+// чтобы использовался индекс _items_collection_id_idx.
+func (b *queryBuilder) addCollection(userHash string, collection string) {
+	b.add(fmt.Sprintf("permission = 'owner' AND collection_id = (SELECT id FROM _collections WHERE userhash = %s AND name = %s)",
+		b.arg(userHash), b.arg(collection)))
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (p *PostgresDB) GetAll(userHash string, opts *ListOptions) ([]*DBItem, string, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+
+	sort := opts.Sort
+	if sort == "" {
+		sort = SortByID
+	}
+	// Тип значения курсора для сравнения
+	cast := ""
+	switch sort {
+	case SortByID, SortByName:
+	case SortByCreatedAt, SortByUpdatedAt:
+		cast = "::timestamptz"
+	default:
+		return nil, "", fmt.Errorf("unknown sort field %s", sort)
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	b := &queryBuilder{}
+	b.add("userhash = " + b.arg(userHash))
+	if opts.Shared {
+		b.add("permission <> 'owner'")
+	} else {
+		b.add("permission = 'owner'")
+	}
+	if opts.Collection != "" {
+		b.addCollection(userHash, opts.Collection)
+	}
+	if opts.NamePrefix != "" {
+		b.add("name LIKE " + b.arg(likeEscaper.Replace(opts.NamePrefix)+"%"))
+	}
+	if opts.CreatedAfter != nil {
+		b.add("created_at >= " + b.arg(*opts.CreatedAfter))
+	}
+	if opts.CreatedBefore != nil {
+		b.add("created_at < " + b.arg(*opts.CreatedBefore))
+	}
+	if err := addValueFilters(b, opts); err != nil {
+		return nil, "", err
+	}
+
+	op, order := ">", "ASC"
+	if opts.Desc {
+		op, order = "<", "DESC"
+	}
+	if opts.After != "" {
+		cursor, err := decodeCursor(opts.After, sort)
+		if err != nil {
+			return nil, "", err
+		}
+		if sort == SortByID {
+			b.add(fmt.Sprintf("id %s %s", op, b.arg(cursor.ID)))
+		} else {
+			b.add(fmt.Sprintf("(%s, id) %s (%s%s, %s)", sort, op, b.arg(cursor.Value), cast, b.arg(cursor.ID)))
+		}
+	}
+
+	orderBy := "id " + order
+	if sort != SortByID {
+		orderBy = fmt.Sprintf("%s %s, id %s", sort, order, order)
+	}
+
+	// Одна лишняя запись показывает, есть ли следующая страница
+	query := fmt.Sprintf(`SELECT %s FROM items WHERE %s ORDER BY %s LIMIT %d`,
+		itemColumns, strings.Join(b.where, " AND "), orderBy, limit+1)
+	items, err := p.queryItems(query, b.args...)
+	if err != nil {
+		if pgErr, ok := err.(*pq.Error); ok &&
+			(pgErr.Code == PSQL_ERR_SYNTAX_ERROR || pgErr.Code.Class() == PSQL_ERR_CLASS_DATA_EXCEPTION) {
+			return nil, "", fmt.Errorf("%w: %s", ErrInvalidFilter, pgErr.Message)
+		}
+		return nil, "", err
+	}
+
+	if len(items) <= limit {
+		return items, "", nil
+	}
+	items = items[:limit]
+
+	last := items[limit-1]
+	next := &listCursor{Sort: sort, ID: last.ID}
+	switch sort {
+	case SortByName:
+		next.Value = last.Name
+	case SortByCreatedAt:
+		next.Value = last.CreatedAt.Format(time.RFC3339Nano)
+	case SortByUpdatedAt:
+		next.Value = last.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	return items, encodeCursor(next), nil
+}
+
+// Условия на value. Пользовательские данные передаются только параметрами.
+func addValueFilters(b *queryBuilder, opts *ListOptions) error {
+	if len(opts.Contains) > 0 {
+		b.add("value @> " + b.arg(string(opts.Contains)) + "::jsonb")
+	}
+	if len(opts.HasKeys) > 0 {
+		b.add("value ?& " + b.arg(pq.Array(opts.HasKeys)) + "::text[]")
+	}
+	if opts.JSONPath != "" {
+		b.add("value @? " + b.arg(opts.JSONPath) + "::jsonpath")
+	}
+
+	for _, f := range opts.Where {
+		if len(f.Path) == 0 {
+			return fmt.Errorf("%w: empty path", ErrInvalidFilter)
+		}
+		path := b.arg(pq.Array(f.Path)) + "::text[]"
+
+		// Значение, не являющееся JSON, считаем строкой
+		value := []byte(f.Value)
+		if !json.Valid(value) {
+			value, _ = json.Marshal(f.Value)
+		}
+
+		switch f.Op {
+		case FilterEq:
+			b.add(fmt.Sprintf("value #> %s = %s::jsonb", path, b.arg(string(value))))
+		case FilterNe:
+			b.add(fmt.Sprintf("value #> %s <> %s::jsonb", path, b.arg(string(value))))
+		case FilterGt, FilterGte, FilterLt, FilterLte:
+			op := map[string]string{FilterGt: ">", FilterGte: ">=", FilterLt: "<", FilterLte: "<="}[f.Op]
+			var number float64
+			if err := json.Unmarshal(value, &number); err == nil {
+				// Числа сравниваются как числа; записи, где поле не число, не подходят
+				b.add(fmt.Sprintf("CASE WHEN jsonb_typeof(value #> %[1]s) = 'number' THEN (value #>> %[1]s)::numeric %[2]s %[3]s END",
+					path, op, b.arg(number)))
+			} else {
+				var text string
+				if err := json.Unmarshal(value, &text); err != nil {
+					return fmt.Errorf("%w: %s requires a number or a string", ErrInvalidFilter, f.Op)
+				}
+				b.add(fmt.Sprintf("CASE WHEN jsonb_typeof(value #> %[1]s) = 'string' THEN value #>> %[1]s %[2]s %[3]s END",
+					path, op, b.arg(text)))
+			}
+		default:
+			return fmt.Errorf("%w: unknown operator %s", ErrInvalidFilter, f.Op)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Параметры запроса в виде, в котором их получит драйвер (pq.Array -> литерал массива)
+func driverArgs(t *testing.T, args []interface{}) []interface{} {
+	t.Helper()
+	out := make([]interface{}, len(args))
+	for i, arg := range args {
+		if v, ok := arg.(driver.Valuer); ok {
+			value, err := v.Value()
+			if err != nil {
+				t.Fatalf("arg %d: %v", i, err)
+			}
+			arg = value
+		}
+		out[i] = arg
+	}
+	return out
+}
+
+func TestAddValueFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      ListOptions
+		wantWhere []string
+		wantArgs  []interface{}
+		wantErr   string
+	}{
+		{
+			name:      "eq",
+			opts:      ListOptions{Where: []ValueFilter{{Path: []string{"a", "b"}, Op: FilterEq, Value: "1"}}},
+			wantWhere: []string{"value #> $1::text[] = $2::jsonb"},
+			wantArgs:  []interface{}{`{"a","b"}`, "1"},
+		},
+		{
+			name:      "ne with string that is not JSON",
+			opts:      ListOptions{Where: []ValueFilter{{Path: []string{"status"}, Op: FilterNe, Value: "done"}}},
+			wantWhere: []string{"value #> $1::text[] <> $2::jsonb"},
+			wantArgs:  []interface{}{`{"status"}`, `"done"`},
+		},
+		{
+			name: "gt number",
+			opts: ListOptions{Where: []ValueFilter{{Path: []string{"n"}, Op: FilterGt, Value: "10"}}},
+			wantWhere: []string{
+				"CASE WHEN jsonb_typeof(value #> $1::text[]) = 'number' THEN (value #>> $1::text[])::numeric > $2 END",
+			},
+			wantArgs: []interface{}{`{"n"}`, float64(10)},
+		},
+		{
+			name: "gte number",
+			opts: ListOptions{Where: []ValueFilter{{Path: []string{"n"}, Op: FilterGte, Value: "1.5"}}},
+			wantWhere: []string{
+				"CASE WHEN jsonb_typeof(value #> $1::text[]) = 'number' THEN (value #>> $1::text[])::numeric >= $2 END",
+			},
+			wantArgs: []interface{}{`{"n"}`, 1.5},
+		},
+		{
+			name: "lt string",
+			opts: ListOptions{Where: []ValueFilter{{Path: []string{"s"}, Op: FilterLt, Value: "m"}}},
+			wantWhere: []string{
+				"CASE WHEN jsonb_typeof(value #> $1::text[]) = 'string' THEN value #>> $1::text[] < $2 END",
+			},
+			wantArgs: []interface{}{`{"s"}`, "m"},
+		},
+		{
+			name: "lte quoted string",
+			opts: ListOptions{Where: []ValueFilter{{Path: []string{"s"}, Op: FilterLte, Value: `"10"`}}},
+			wantWhere: []string{
+				"CASE WHEN jsonb_typeof(value #> $1::text[]) = 'string' THEN value #>> $1::text[] <= $2 END",
+			},
+			wantArgs: []interface{}{`{"s"}`, "10"},
+		},
+		{
+			name:    "comparison with object",
+			opts:    ListOptions{Where: []ValueFilter{{Path: []string{"o"}, Op: FilterGt, Value: `{"a":1}`}}},
+			wantErr: "gt requires a number or a string",
+		},
+		{
+			name:    "empty path",
+			opts:    ListOptions{Where: []ValueFilter{{Op: FilterEq, Value: "1"}}},
+			wantErr: "empty path",
+		},
+		{
+			name:    "unknown operator",
+			opts:    ListOptions{Where: []ValueFilter{{Path: []string{"a"}, Op: "like", Value: "1"}}},
+			wantErr: "unknown operator like",
+		},
+		{
+			name: "contains, has_key and jsonpath",
+			opts: ListOptions{
+				Contains: json.RawMessage(`{"tag":"x"}`),
+				HasKeys:  []string{"a", "b"},
+				JSONPath: `$.n ? (@ > 1)`,
+			},
+			wantWhere: []string{
+				"value @> $1::jsonb",
+				"value ?& $2::text[]",
+				"value @? $3::jsonpath",
+			},
+			wantArgs: []interface{}{`{"tag":"x"}`, `{"a","b"}`, `$.n ? (@ > 1)`},
+		},
+		{
+			name: "several filters share numbering",
+			opts: ListOptions{
+				JSONPath: "$.a",
+				Where: []ValueFilter{
+					{Path: []string{"a"}, Op: FilterEq, Value: "true"},
+					{Path: []string{"b", "0"}, Op: FilterNe, Value: "null"},
+				},
+			},
+			wantWhere: []string{
+				"value @? $1::jsonpath",
+				"value #> $2::text[] = $3::jsonb",
+				"value #> $4::text[] <> $5::jsonb",
+			},
+			wantArgs: []interface{}{"$.a", `{"a"}`, "true", `{"b","0"}`, "null"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &queryBuilder{}
+			err := addValueFilters(b, &tt.opts)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalidFilter) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want ErrInvalidFilter with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("addValueFilters: %v", err)
+			}
+			if !reflect.DeepEqual(b.where, tt.wantWhere) {
+				t.Errorf("where = %q, want %q", b.where, tt.wantWhere)
+			}
+			if args := driverArgs(t, b.args); !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestQueryBuilderCollection(t *testing.T) {
+	b := &queryBuilder{}
+	b.add("userhash = " + b.arg("alice"))
+	b.addCollection("alice", "notes")
+
+	want := []string{
+		"userhash = $1",
+		"permission = 'owner' AND collection_id = (SELECT id FROM _collections WHERE userhash = $2 AND name = $3)",
+	}
+	if !reflect.DeepEqual(b.where, want) || !reflect.DeepEqual(b.args, []interface{}{"alice", "alice", "notes"}) {
+		t.Fatalf("where = %q, args = %v", b.where, b.args)
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	cursor := encodeCursor(&listCursor{Sort: SortByName, Value: "item", ID: 7})
+
+	c, err := decodeCursor(cursor, SortByName)
+	if err != nil || c.Value != "item" || c.ID != 7 {
+		t.Fatalf("decodeCursor() = %+v, %v", c, err)
+	}
+
+	for _, tt := range []struct{ name, cursor, sort string }{
+		{"mismatched sort", cursor, SortByCreatedAt},
+		{"not base64", "!!!", SortByName},
+		{"not JSON", "bm90IGpzb24", SortByName},
+	} {
+		if _, err := decodeCursor(tt.cursor, tt.sort); err != ErrInvalidCursor {
+			t.Errorf("%s: error = %v, want ErrInvalidCursor", tt.name, err)
+		}
+	}
+}
+
+func TestGetAllRejectsCursorOfOtherSort(t *testing.T) {
+	// Курсор проверяется до запроса к базе
+	p := &PostgresDB{}
+	after := encodeCursor(&listCursor{Sort: SortByID, ID: 7})
+	if _, _, err := p.GetAll("alice", &ListOptions{Sort: SortByName, After: after}); err != ErrInvalidCursor {
+		t.Fatalf("GetAll() error = %v, want ErrInvalidCursor", err)
+	}
+}
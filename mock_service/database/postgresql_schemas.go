@@ -0,0 +1,170 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+func (p *PostgresDB) CreateSchema(userHash string, schema *Schema) error {
+	query := `INSERT INTO _schemas (userhash, name, schema) VALUES ($1, $2, $3)
+						RETURNING id, created_at, updated_at`
+	err := p.db.QueryRow(query, userHash, schema.Name, []byte(schema.Schema)).Scan(&schema.ID, &schema.CreatedAt, &schema.UpdatedAt)
+	if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == PSQL_ERR_UNIQUE_VIOLATION {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (p *PostgresDB) UpdateSchema(userHash string, schema *Schema) error {
+	query := `UPDATE _schemas SET schema=$3, updated_at=now() WHERE userhash=$1 AND name=$2
+						RETURNING id, created_at, updated_at`
+	err := p.db.QueryRow(query, userHash, schema.Name, []byte(schema.Schema)).Scan(&schema.ID, &schema.CreatedAt, &schema.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return errors.New("no rows affected")
+	}
+	return err
+}
+
+func (p *PostgresDB) DeleteSchema(userHash string, name string) error {
+	result, err := p.db.Exec(`DELETE FROM _schemas WHERE userhash=$1 AND name=$2`, userHash, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return nil
+}
+
+func (p *PostgresDB) GetSchema(userHash string, name string) (*Schema, error) {
+	query := `SELECT id, name, schema, created_at, updated_at FROM _schemas WHERE userhash=$1 AND name=$2`
+	s, err := scanSchema(p.db.QueryRow(query, userHash, name))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no rows affected")
+	}
+	return s, err
+}
+
+func (p *PostgresDB) GetSchemas(userHash string) ([]*Schema, error) {
+	query := `SELECT id, name, schema, created_at, updated_at FROM _schemas WHERE userhash=$1 ORDER BY name`
+	rows, err := p.db.Query(query, userHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schemas []*Schema
+	for rows.Next() {
+		s, err := scanSchema(rows)
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, rows.Err()
+}
+
+func (p *PostgresDB) BindSchema(userHash string, binding *SchemaBinding) error {
+	// Привязка к имени записи одна: новая заменяет прежнюю
+	query := `INSERT INTO _schema_bindings (userhash, schema_id, item_name)
+						SELECT userhash, id, $3 FROM _schemas WHERE userhash=$1 AND name=$2
+						ON CONFLICT (userhash, item_name) DO UPDATE SET schema_id=EXCLUDED.schema_id`
+	result, err := p.db.Exec(query, userHash, binding.Schema, binding.ItemName)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return nil
+}
+
+func (p *PostgresDB) UnbindSchema(userHash string, itemName string) error {
+	result, err := p.db.Exec(`DELETE FROM _schema_bindings WHERE userhash=$1 AND item_name=$2`, userHash, itemName)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return nil
+}
+
+func (p *PostgresDB) GetSchemaBindings(userHash string) ([]*SchemaBinding, error) {
+	query := `SELECT s.name, b.item_name FROM _schema_bindings b JOIN _schemas s ON s.id = b.schema_id
+						WHERE b.userhash=$1 ORDER BY b.item_name`
+	rows, err := p.db.Query(query, userHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bindings []*SchemaBinding
+	for rows.Next() {
+		b := &SchemaBinding{}
+		if err := rows.Scan(&b.Schema, &b.ItemName); err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, rows.Err()
+}
+
+func (p *PostgresDB) GetSchemaForItem(userHash string, itemID int64, name string, collection string) (*Schema, error) {
+	query := `WITH owners AS (
+							SELECT $1 AS userhash WHERE $3::bigint = 0
+							UNION
+							SELECT userhash FROM _user2items WHERE item_id=$3 AND permission='owner'
+						)
+						SELECT id, name, schema, created_at, updated_at FROM (
+							SELECT s.*, 1 AS priority
+							FROM _schema_bindings b JOIN _schemas s ON s.id = b.schema_id
+							WHERE b.item_name=$2 AND b.userhash IN (SELECT userhash FROM owners)
+							UNION ALL
+							SELECT s.*, 2 AS priority
+							FROM _collections c JOIN _schemas s ON s.id = c.schema_id
+							WHERE c.userhash IN (SELECT userhash FROM owners) AND CASE
+								WHEN $4 = '' THEN c.id = (SELECT collection_id FROM _items WHERE id=$3)
+								ELSE c.name = $4
+							END
+						) found
+						ORDER BY priority, id LIMIT 1`
+	s, err := scanSchema(p.db.QueryRow(query, userHash, name, itemID, collection))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+func scanSchema(row rowScanner) (*Schema, error) {
+	s := &Schema{}
+	var schema []byte
+	if err := row.Scan(&s.ID, &s.Name, &schema, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	s.Schema = schema
+	return s, nil
+}
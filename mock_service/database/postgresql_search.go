@@ -0,0 +1,85 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Параметры ts_headline: до трех фрагментов, совпадения в <mark>. Текст экранируется
+// html_escape до ts_headline, поэтому теги во фрагменте - только <mark>.
+const snippetOptions = `StartSel=<mark>, StopSel=</mark>, MaxFragments=3, MaxWords=20, MinWords=5`
+
+// toTSQuery - запрос пользователя в синтаксисе to_tsquery. В лексемы попадают только буквы
+// и цифры, поэтому операторы tsquery из запроса не проходят.
+func toTSQuery(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		prefix := strings.HasSuffix(word, "*")
+		lexemes := strings.FieldsFunc(word, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for i, lexeme := range lexemes {
+			term := "'" + lexeme + "'"
+			// Префикс относится к последней части слова
+			if prefix && i == len(lexemes)-1 {
+				term += ":*"
+			}
+			terms = append(terms, term)
+		}
+	}
+	return strings.Join(terms, " & ")
+}
+
+func (p *PostgresDB) Search(userHash string, opts *SearchOptions) ([]*SearchResult, error) {
+	tsquery := toTSQuery(opts.Query)
+	if tsquery == "" {
+		return nil, fmt.Errorf("%w: empty search query", ErrInvalidFilter)
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	b := &queryBuilder{}
+	b.add("userhash = " + b.arg(userHash))
+	q := b.arg(tsquery)
+	b.add("search @@ q")
+	if opts.Shared {
+		b.add("permission <> 'owner'")
+	}
+	if opts.Collection != "" {
+		b.addCollection(userHash, opts.Collection)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s, ts_rank(search, q) AS rank,
+			ts_headline('simple', html_escape(name || ' ' || COALESCE(item_text(value), '')), q, '%s')
+		FROM items, to_tsquery('simple', %s) q
+		WHERE %s
+		ORDER BY rank DESC, id
+		LIMIT %d OFFSET %d`,
+		itemColumns, snippetOptions, q, strings.Join(b.where, " AND "), limit, opts.Offset)
+	rows, err := p.db.Query(query, b.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*SearchResult
+	for rows.Next() {
+		r := &SearchResult{}
+		if r.DBItem, err = scanItem(rows, &r.Rank, &r.Snippet); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,36 @@
+package database
+
+import "testing"
+
+func TestToTSQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"words", "hello world", "'hello' & 'world'"},
+		{"extra spaces", "  hello \t world\n", "'hello' & 'world'"},
+		{"empty", "", ""},
+		{"only spaces", "   ", ""},
+		{"only punctuation", "!!! ... --", ""},
+		{"punctuation splits words", "e-mail, foo.bar", "'e' & 'mail' & 'foo' & 'bar'"},
+		{"quotes", `don't "quoted"`, "'don' & 't' & 'quoted'"},
+		{"tsquery operators", "a & !b | (c <-> d) e:A", "'a' & 'b' & 'c' & 'd' & 'e' & 'A'"},
+		{"prefix after punctuation", "(d):*", "'d':*"},
+		{"sql injection", "x'); DROP TABLE items; --", "'x' & 'DROP' & 'TABLE' & 'items'"},
+		{"digits", "order 42", "'order' & '42'"},
+		{"unicode", "привет мир 日本語", "'привет' & 'мир' & '日本語'"},
+		{"prefix", "hel*", "'hel':*"},
+		{"prefix applies to last part", "e-mai*", "'e' & 'mai':*"},
+		{"prefix only on marked word", "foo bar*", "'foo' & 'bar':*"},
+		{"star inside word", "a*b", "'a' & 'b'"},
+		{"star alone", "*", ""},
+		{"double star", "ab**", "'ab':*"},
+	}
+
+	for _, tt := range tests {
+		if got := toTSQuery(tt.query); got != tt.want {
+			t.Errorf("%s: toTSQuery(%q) = %q, want %q", tt.name, tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ErrLastOwner - нельзя отозвать доступ у единственного владельца записи
+var ErrLastOwner = errors.New("item must have at least one owner")
+
+func (p *PostgresDB) ShareItem(id int64, ownerHash string, share *Share) error {
+	// Доступ выдается, только если ownerHash владеет записью. Понизить другого владельца нельзя.
+	query := `INSERT INTO _user2items (userhash, item_id, permission, username)
+						SELECT $3, item_id, $4, NULLIF($5, '') FROM _user2items
+							WHERE item_id=$1 AND userhash=$2 AND permission='owner'
+								AND item_id IN (SELECT id FROM _items WHERE deleted_at IS NULL AND (expires_at IS NULL OR expires_at > now()))
+						ON CONFLICT (userhash, item_id) DO UPDATE
+							SET permission=EXCLUDED.permission, username=EXCLUDED.username
+							WHERE _user2items.permission<>'owner'`
+	result, err := p.db.Exec(query, id, ownerHash, share.UserHash, share.Permission, share.Username)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return nil
+}
+
+func (p *PostgresDB) GetShares(id int64, ownerHash string) ([]*Share, error) {
+	query := `SELECT userhash, COALESCE(username, ''), permission FROM _user2items s
+						WHERE item_id=$1 AND EXISTS (
+							SELECT 1 FROM _user2items WHERE item_id=$1 AND userhash=$2 AND permission='owner'
+						)
+						ORDER BY id`
+	rows, err := p.db.Query(query, id, ownerHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []*Share
+	for rows.Next() {
+		s := &Share{}
+		if err := rows.Scan(&s.UserHash, &s.Username, &s.Permission); err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(shares) == 0 {
+		return nil, errors.New("no rows affected")
+	}
+	return shares, nil
+}
+
+func (p *PostgresDB) RevokeShare(id int64, userHash string, targetHash string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Блокируем строки записи, чтобы параллельные отзывы не оставили ее без владельцев
+	var owners int
+	var allowed bool
+	query := `SELECT COUNT(*) FILTER (WHERE permission='owner'),
+								COALESCE(bool_or(userhash=$2 AND (permission='owner' OR userhash=$3)), false)
+						FROM (SELECT userhash, permission FROM _user2items WHERE item_id=$1 FOR UPDATE) s`
+	if err := tx.QueryRow(query, id, userHash, targetHash).Scan(&owners, &allowed); err != nil {
+		return err
+	}
+	if !allowed {
+		return errors.New("no rows affected")
+	}
+
+	var permission string
+	query = `DELETE FROM _user2items WHERE item_id=$1 AND userhash=$2 RETURNING permission`
+	err = tx.QueryRow(query, id, targetHash).Scan(&permission)
+	if err == sql.ErrNoRows {
+		return errors.New("no rows affected")
+	}
+	if err != nil {
+		return err
+	}
+	if permission == PermissionOwner && owners <= 1 {
+		return ErrLastOwner
+	}
+
+	return tx.Commit()
+}
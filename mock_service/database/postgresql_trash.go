@@ -0,0 +1,108 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// Записи пользователя в корзине; управлять корзиной может только владелец
+const trashOwner = `id IN (SELECT item_id FROM _user2items WHERE userhash=$1 AND permission='owner')`
+
+func (p *PostgresDB) GetTrash(userHash string) ([]*DBItem, error) {
+	query := `SELECT id, name, value, 'owner', created_at, updated_at, version,
+							COALESCE((SELECT name FROM _collections c WHERE c.id = collection_id), ''), expires_at, deleted_at
+						FROM _items
+						WHERE deleted_at IS NOT NULL AND ` + trashOwner + `
+						ORDER BY deleted_at DESC, id DESC`
+	rows, err := p.db.Query(query, userHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*DBItem
+	for rows.Next() {
+		var deletedAt time.Time
+		v, err := scanItem(rows, &deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		v.DeletedAt = &deletedAt
+		items = append(items, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (p *PostgresDB) RestoreItem(id int64, userHash string) error {
+	query := `UPDATE _items SET deleted_at = NULL WHERE id=$2 AND deleted_at IS NOT NULL AND ` + trashOwner
+	result, err := p.db.Exec(query, userHash, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return nil
+}
+
+func (p *PostgresDB) DeletePermanently(id int64, userHash string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM _items WHERE id=$2 AND deleted_at IS NOT NULL AND ` + trashOwner + ` RETURNING id`
+	count, err := deleteItemsWithHistory(tx, query, userHash, id)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return tx.Commit()
+}
+
+// Сколько записей удаляется в одной транзакции при очистке корзины
+const purgeBatchSize = 1000
+
+func (p *PostgresDB) PurgeTrash(before time.Time) (int64, error) {
+	var total int64
+	for {
+		count, err := p.purgeTrashBatch(before)
+		total += count
+		if err != nil || count < purgeBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (p *PostgresDB) purgeTrashBatch(before time.Time) (int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM _items WHERE id IN (
+							SELECT id FROM _items WHERE deleted_at < $1 LIMIT $2 FOR UPDATE SKIP LOCKED
+						) RETURNING id`
+	count, err := deleteItemsWithHistory(tx, query, before, purgeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
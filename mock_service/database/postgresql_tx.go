@@ -0,0 +1,81 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// querier - общий интерфейс *sql.DB и *sql.Tx, чтобы операции над записями
+// выполнялись как отдельно, так и внутри транзакции
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type postgresTx struct {
+	tx *sql.Tx
+}
+
+func (p *PostgresDB) BeginTx() (DBTx, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &postgresTx{tx: tx}, nil
+}
+
+func (t *postgresTx) Insert(item *DBItem, userHash string) (int64, error) {
+	return insertItem(t.tx, item, userHash)
+}
+
+func (t *postgresTx) Update(id int64, item *DBItem, userHash string, expectedVersion int64) error {
+	return updateItem(t.tx, id, item, userHash, expectedVersion)
+}
+
+func (t *postgresTx) Delete(id int64, userHash string, expectedVersion int64) error {
+	return deleteItem(t.tx, id, userHash, expectedVersion)
+}
+
+func (t *postgresTx) FindByName(userHash string, name string, collection string, limit int) ([]int64, error) {
+	query := `SELECT id FROM items WHERE userhash=$1 AND permission='owner' AND name=$2
+						AND ($3 = '' OR collection = $3) ORDER BY id LIMIT $4`
+	rows, err := t.tx.Query(query, userHash, name, collection, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Имя точки сохранения задается только кодом сервиса, поэтому подставляется в запрос как есть
+func (t *postgresTx) Savepoint(name string) error {
+	_, err := t.tx.Exec("SAVEPOINT " + name)
+	return err
+}
+
+func (t *postgresTx) RollbackTo(name string) error {
+	_, err := t.tx.Exec("ROLLBACK TO SAVEPOINT " + name)
+	return err
+}
+
+func (t *postgresTx) Release(name string) error {
+	_, err := t.tx.Exec("RELEASE SAVEPOINT " + name)
+	return err
+}
+
+func (t *postgresTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *postgresTx) Rollback() error {
+	return t.tx.Rollback()
+}
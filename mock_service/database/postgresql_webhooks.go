@@ -0,0 +1,227 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const webhookColumns = `id, url, events, active, created_at`
+
+const deliveryColumns = `d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.status, d.attempts,
+	d.next_attempt_at, d.last_error, d.created_at, d.finished_at`
+
+func (p *PostgresDB) CreateWebhook(userHash string, webhook *Webhook) error {
+	query := `INSERT INTO _webhooks (userhash, url, secret, events, active) VALUES ($1, $2, $3, $4, $5)
+						RETURNING id, created_at`
+	return p.db.QueryRow(query, userHash, webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active).
+		Scan(&webhook.ID, &webhook.CreatedAt)
+}
+
+func (p *PostgresDB) UpdateWebhook(userHash string, webhook *Webhook) error {
+	query := `UPDATE _webhooks SET url=$3, events=$4, active=$5 WHERE userhash=$1 AND id=$2`
+	return execAffected(p.db, query, userHash, webhook.ID, webhook.URL, pq.Array(webhook.Events), webhook.Active)
+}
+
+func (p *PostgresDB) DeleteWebhook(userHash string, id int64) error {
+	return execAffected(p.db, `DELETE FROM _webhooks WHERE userhash=$1 AND id=$2`, userHash, id)
+}
+
+func (p *PostgresDB) GetWebhook(userHash string, id int64) (*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM _webhooks WHERE userhash=$1 AND id=$2`
+	w, err := scanWebhook(p.db.QueryRow(query, userHash, id))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no rows affected")
+	}
+	return w, err
+}
+
+func (p *PostgresDB) GetWebhooks(userHash string) ([]*Webhook, error) {
+	rows, err := p.db.Query(`SELECT `+webhookColumns+` FROM _webhooks WHERE userhash=$1 ORDER BY id`, userHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []*Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+func (p *PostgresDB) GetWebhookDeliveries(userHash string, webhookID int64, status string, limit int) ([]*WebhookDelivery, error) {
+	query := `SELECT ` + deliveryColumns + ` FROM _webhook_deliveries d
+						JOIN _webhooks w ON w.id = d.webhook_id
+						WHERE w.userhash=$1 AND d.webhook_id=$2 AND ($3 = '' OR d.status=$3)
+						ORDER BY d.id DESC LIMIT $4`
+	rows, err := p.db.Query(query, userHash, webhookID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (p *PostgresDB) GetWebhookDelivery(userHash string, webhookID int64, deliveryID int64) (*WebhookDelivery, error) {
+	query := `SELECT ` + deliveryColumns + ` FROM _webhook_deliveries d
+						JOIN _webhooks w ON w.id = d.webhook_id
+						WHERE w.userhash=$1 AND d.webhook_id=$2 AND d.id=$3`
+	d, err := scanDelivery(p.db.QueryRow(query, userHash, webhookID, deliveryID))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no rows affected")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Query(`SELECT status_code, error, duration_ms, attempted_at FROM _webhook_attempts
+														WHERE delivery_id=$1 ORDER BY id`, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := &WebhookAttempt{}
+		if err := rows.Scan(&a.StatusCode, &a.Error, &a.DurationMs, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		d.AttemptLog = append(d.AttemptLog, a)
+	}
+	return d, rows.Err()
+}
+
+func (p *PostgresDB) RedeliverWebhook(userHash string, webhookID int64, deliveryID int64) error {
+	query := `UPDATE _webhook_deliveries d SET status='pending', attempts=0, next_attempt_at=now(), finished_at=NULL
+						FROM _webhooks w
+						WHERE w.id = d.webhook_id AND w.userhash=$1 AND d.webhook_id=$2 AND d.id=$3`
+	return execAffected(p.db, query, userHash, webhookID, deliveryID)
+}
+
+func (p *PostgresDB) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	// Отправка откладывается на время lease: если процесс упадет, доставка вернется в очередь
+	query := `WITH claimed AS (
+							SELECT id FROM _webhook_deliveries
+								WHERE status='pending' AND next_attempt_at <= now()
+								ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED
+						)
+						UPDATE _webhook_deliveries d SET next_attempt_at = now() + make_interval(secs => $2)
+						FROM claimed, _webhooks w
+						WHERE d.id = claimed.id AND w.id = d.webhook_id
+						RETURNING ` + deliveryColumns + `, w.url, w.secret`
+	rows, err := p.db.Query(query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		var url, secret string
+		d, err := scanDelivery(rows, &url, &secret)
+		if err != nil {
+			return nil, err
+		}
+		d.URL, d.Secret = url, secret
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (p *PostgresDB) RecordWebhookAttempt(deliveryID int64, attempt *WebhookAttempt, success bool, retryAt *time.Time) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO _webhook_attempts (delivery_id, status_code, error, duration_ms, attempted_at)
+						VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(query, deliveryID, attempt.StatusCode, attempt.Error, attempt.DurationMs, attempt.AttemptedAt)
+	if err != nil {
+		return err
+	}
+
+	status := DeliveryPending
+	switch {
+	case success:
+		status = DeliveryDelivered
+	case retryAt == nil:
+		status = DeliveryDead
+	}
+	query = `UPDATE _webhook_deliveries SET status=$2, attempts=attempts+1, last_error=$3,
+							next_attempt_at=COALESCE($4, next_attempt_at),
+							finished_at=CASE WHEN $2 = 'pending' THEN NULL ELSE now() END
+						WHERE id=$1`
+	if _, err = tx.Exec(query, deliveryID, status, attempt.Error, retryAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *PostgresDB) PruneWebhookDeliveries(before time.Time) (int64, error) {
+	result, err := p.db.Exec(`DELETE FROM _webhook_deliveries WHERE status<>'pending' AND finished_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// execAffected - выполняет запрос и возвращает "no rows affected", если он ничего не изменил
+func execAffected(q querier, query string, args ...interface{}) error {
+	result, err := q.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("no rows affected")
+	}
+
+	return nil
+}
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	w := &Webhook{}
+	if err := row.Scan(&w.ID, &w.URL, pq.Array(&w.Events), &w.Active, &w.CreatedAt); err != nil {
+		return nil, err
+	}
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+	return w, nil
+}
+
+func scanDelivery(row rowScanner, extra ...interface{}) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	var payload []byte
+	dest := append([]interface{}{&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastError, &d.CreatedAt, &d.FinishedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	d.Payload = payload
+	return d, nil
+}
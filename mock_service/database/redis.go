@@ -1 +1,418 @@
 package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	redis_utils "utils/redis"
+)
+
+// CacheConfig - время жизни записей и страниц списка в кэше
+type CacheConfig struct {
+	ItemTTL time.Duration `json:"item_ttl"`
+	ListTTL time.Duration `json:"list_ttl"`
+}
+
+// Счетчики кэша: hits, misses, stale_pages, lock_waits, invalidations, errors. Доступны через /debug/vars.
+var cacheStats = expvar.NewMap("item_cache")
+
+const (
+	// Блокировка загрузки значения из базы одним экземпляром сервиса
+	cacheLockTTL  = 5 * time.Second
+	cacheLockWait = 200 * time.Millisecond
+	cacheLockPoll = 20 * time.Millisecond
+	// Поколения хранятся дольше значений, иначе устаревшее значение могло бы вернуться в кэш
+	cacheGenTTL = 24 * time.Hour
+)
+
+// RedisCache - DBAdapter с кэшем Get и GetAll в Redis. Ошибки Redis не ломают запросы:
+// чтение идет в базу, сбой инвалидации записывается в лог.
+// Изменение записи увеличивает ее поколение: сбрасывается ее кэш и страницы списков всех
+// пользователей, в которых она есть. Страницы, в которые запись может попасть (новая запись,
+// выданный доступ), сбрасываются у автора изменения и участников доступа; у остальных
+// получателей запись появится в отфильтрованных списках через ListTTL.
+type RedisCache struct {
+	DBAdapter
+	redis  *redis_utils.RedisClient
+	cfg    CacheConfig
+	flight singleflight.Group
+}
+
+func NewRedisCache(db DBAdapter, redis *redis_utils.RedisClient, cfg CacheConfig) *RedisCache {
+	return &RedisCache{DBAdapter: db, redis: redis, cfg: cfg}
+}
+
+// Записи хранятся в хэше cache:item:{<id>} с полем на каждого пользователя,
+// поколение записи - в cache:item_gen:{<id>} (тот же слот кластера)
+const itemCachePrefix = "cache:item:"
+
+func itemCacheKey(id int64) string {
+	return fmt.Sprintf("%s{%d}", itemCachePrefix, id)
+}
+
+func itemGenKey(id int64) string {
+	return fmt.Sprintf("cache:item_gen:{%d}", id)
+}
+
+func listGenKey(userHash string) string {
+	return "cache:list_gen:" + userHash
+}
+
+func listCacheKey(userHash string, gen []byte, opts *ListOptions) string {
+	data, _ := json.Marshal(opts)
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("cache:list:%s:%s:%s", userHash, gen, hex.EncodeToString(hash[:]))
+}
+
+// Страница списка с поколениями ее записей на момент загрузки
+type cachedPage struct {
+	Items []*DBItem `json:"items"`
+	Gens  []string  `json:"gens"`
+	Next  string    `json:"next"`
+}
+
+func (c *RedisCache) Get(id int64, userHash string) (*DBItem, error) {
+	ctx := context.Background()
+	key := itemCacheKey(id)
+
+	// Поколение читается вместе со значением и проверяется при записи
+	var gen string
+	lookup := func() ([]byte, error) {
+		data, g, err := c.redis.GetCachedField(ctx, key, itemGenKey(id), userHash)
+		gen = g
+		return data, err
+	}
+	store := func(data []byte) error {
+		return c.redis.SetCachedField(ctx, key, itemGenKey(id), userHash, gen, data, c.cfg.ItemTTL)
+	}
+	load := func() (interface{}, error) {
+		return c.DBAdapter.Get(id, userHash)
+	}
+
+	data, err := c.readThrough(key+":"+userHash, lookup, store, load)
+	if err != nil {
+		return nil, err
+	}
+	item := &DBItem{}
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+	// Срок жизни мог истечь, пока запись лежала в кэше; ошибка - как у запроса к базе
+	if expired(item) {
+		return nil, ErrNotFound
+	}
+	return item, nil
+}
+
+func expired(item *DBItem) bool {
+	return item.ExpiresAt != nil && !item.ExpiresAt.After(time.Now())
+}
+
+func (c *RedisCache) GetAll(userHash string, opts *ListOptions) ([]*DBItem, string, error) {
+	ctx := context.Background()
+	gen, err := c.redis.CacheGet(ctx, listGenKey(userHash))
+	if err != nil {
+		c.cacheError(err)
+		return c.DBAdapter.GetAll(userHash, opts)
+	}
+	key := listCacheKey(userHash, gen, opts)
+
+	lookup := func() ([]byte, error) {
+		data, err := c.redis.CacheGet(ctx, key)
+		if err != nil || data == nil {
+			return data, err
+		}
+		// Страница, в которой изменилась хотя бы одна запись, считается промахом
+		current, err := c.isPageCurrent(ctx, data)
+		if err != nil || !current {
+			return nil, err
+		}
+		return data, nil
+	}
+	store := func(data []byte) error {
+		return c.redis.CacheSet(ctx, key, data, c.cfg.ListTTL)
+	}
+	load := func() (interface{}, error) {
+		items, next, err := c.DBAdapter.GetAll(userHash, opts)
+		if err != nil {
+			return nil, err
+		}
+		// Поколения читаются после загрузки: изменение, зафиксированное во время загрузки
+		// и сброшенное до этого чтения, может остаться на странице до ListTTL.
+		// Без поколений страница не пройдет проверку и не будет использована.
+		page := &cachedPage{Items: items, Next: next}
+		if gens, err := c.redis.CacheGetMany(ctx, itemGenKeys(items)); err != nil {
+			c.cacheError(err)
+		} else {
+			page.Gens = gens
+		}
+		return page, nil
+	}
+
+	data, err := c.readThrough(key, lookup, store, load)
+	if err != nil {
+		return nil, "", err
+	}
+	page := &cachedPage{}
+	if err := json.Unmarshal(data, page); err != nil {
+		return nil, "", err
+	}
+	items := page.Items[:0]
+	for _, item := range page.Items {
+		if !expired(item) {
+			items = append(items, item)
+		}
+	}
+	return items, page.Next, nil
+}
+
+// readThrough - значение из кэша или из базы. Одновременные промахи по одному ключу
+// загружают значение один раз: внутри процесса через singleflight, между экземплярами
+// сервиса - через блокировку в Redis.
+func (c *RedisCache) readThrough(key string, lookup func() ([]byte, error), store func([]byte) error,
+	load func() (interface{}, error)) ([]byte, error) {
+	data, err := lookup()
+	if err != nil {
+		c.cacheError(err)
+		value, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	}
+	if data != nil {
+		cacheStats.Add("hits", 1)
+		return data, nil
+	}
+	cacheStats.Add("misses", 1)
+
+	v, err, _ := c.flight.Do(key, func() (interface{}, error) {
+		ctx := context.Background()
+		lockKey := "cache:lock:" + key
+		token, err := c.redis.AcquireLock(ctx, lockKey, cacheLockTTL)
+		if err != nil {
+			c.cacheError(err)
+		} else if token == "" {
+			// Значение загружает другой экземпляр - ждем, но не дольше cacheLockWait
+			cacheStats.Add("lock_waits", 1)
+			for deadline := time.Now().Add(cacheLockWait); time.Now().Before(deadline); {
+				time.Sleep(cacheLockPoll)
+				if data, err := lookup(); err == nil && data != nil {
+					return data, nil
+				}
+			}
+		} else {
+			defer c.redis.ReleaseLock(ctx, lockKey, token)
+		}
+
+		value, err := load()
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if err := store(data); err != nil {
+			c.cacheError(err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (c *RedisCache) cacheError(err error) {
+	cacheStats.Add("errors", 1)
+	log.Printf("RedisCache: %v", err)
+}
+
+func itemGenKeys(items []*DBItem) []string {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = itemGenKey(item.ID)
+	}
+	return keys
+}
+
+// isPageCurrent - не изменились ли записи страницы после ее загрузки; ошибка - ошибка Redis
+func (c *RedisCache) isPageCurrent(ctx context.Context, data []byte) (bool, error) {
+	page := &cachedPage{}
+	if err := json.Unmarshal(data, page); err != nil || len(page.Gens) != len(page.Items) {
+		return false, nil
+	}
+	gens, err := c.redis.CacheGetMany(ctx, itemGenKeys(page.Items))
+	if err != nil {
+		return false, err
+	}
+	for i, gen := range gens {
+		if gen != page.Gens[i] {
+			cacheStats.Add("stale_pages", 1)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *RedisCache) invalidateItems(ids ...int64) {
+	for _, id := range ids {
+		cacheStats.Add("invalidations", 1)
+		if err := c.redis.InvalidateCached(context.Background(), itemCacheKey(id), itemGenKey(id), cacheGenTTL); err != nil {
+			c.cacheError(err)
+		}
+	}
+}
+
+func (c *RedisCache) invalidateLists(userHashes ...string) {
+	for _, userHash := range userHashes {
+		if err := c.redis.CacheIncr(context.Background(), listGenKey(userHash), cacheGenTTL); err != nil {
+			c.cacheError(err)
+		}
+	}
+}
+
+func (c *RedisCache) Insert(item *DBItem, userHash string) (int64, error) {
+	id, err := c.DBAdapter.Insert(item, userHash)
+	if err == nil {
+		c.invalidateLists(userHash)
+	}
+	return id, err
+}
+
+func (c *RedisCache) Update(id int64, item *DBItem, userHash string, expectedVersion int64) error {
+	err := c.DBAdapter.Update(id, item, userHash, expectedVersion)
+	if err == nil {
+		c.invalidateItems(id)
+		c.invalidateLists(userHash)
+	}
+	return err
+}
+
+func (c *RedisCache) Patch(id int64, userHash string, expectedVersion int64, expiry ExpiryChange, apply PatchFunc) (*DBItem, error) {
+	item, err := c.DBAdapter.Patch(id, userHash, expectedVersion, expiry, apply)
+	if err == nil {
+		c.invalidateItems(id)
+		c.invalidateLists(userHash)
+	}
+	return item, err
+}
+
+func (c *RedisCache) Delete(id int64, userHash string, expectedVersion int64) error {
+	err := c.DBAdapter.Delete(id, userHash, expectedVersion)
+	if err == nil {
+		c.invalidateItems(id)
+		c.invalidateLists(userHash)
+	}
+	return err
+}
+
+func (c *RedisCache) RestoreItem(id int64, userHash string) error {
+	err := c.DBAdapter.RestoreItem(id, userHash)
+	if err == nil {
+		c.invalidateItems(id)
+		c.invalidateLists(userHash)
+	}
+	return err
+}
+
+func (c *RedisCache) ShareItem(id int64, ownerHash string, share *Share) error {
+	err := c.DBAdapter.ShareItem(id, ownerHash, share)
+	if err == nil {
+		c.invalidateItems(id)
+		c.invalidateLists(ownerHash, share.UserHash)
+	}
+	return err
+}
+
+func (c *RedisCache) RevokeShare(id int64, userHash string, targetHash string) error {
+	err := c.DBAdapter.RevokeShare(id, userHash, targetHash)
+	if err == nil {
+		c.invalidateItems(id)
+		c.invalidateLists(userHash, targetHash)
+	}
+	return err
+}
+
+func (c *RedisCache) DeleteUserData(userHash string, mode string, eventID string) (int64, error) {
+	affected, err := c.DBAdapter.DeleteUserData(userHash, mode, eventID)
+	if err == nil {
+		// Какие записи были у пользователя, уже не узнать, поэтому его поля ищутся во всех хэшах
+		if err := c.redis.DeleteCachedFields(context.Background(), itemCachePrefix+"*", userHash); err != nil {
+			c.cacheError(err)
+		}
+		c.invalidateLists(userHash)
+	}
+	return affected, err
+}
+
+func (c *RedisCache) BeginTx() (DBTx, error) {
+	tx, err := c.DBAdapter.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTx{DBTx: tx, cache: c}, nil
+}
+
+// cachedTx - сбрасывает кэш измененных записей после фиксации транзакции
+type cachedTx struct {
+	DBTx
+	cache *RedisCache
+	ids   []int64
+	users []string
+}
+
+func (t *cachedTx) Insert(item *DBItem, userHash string) (int64, error) {
+	id, err := t.DBTx.Insert(item, userHash)
+	if err == nil {
+		t.users = append(t.users, userHash)
+	}
+	return id, err
+}
+
+func (t *cachedTx) Update(id int64, item *DBItem, userHash string, expectedVersion int64) error {
+	err := t.DBTx.Update(id, item, userHash, expectedVersion)
+	if err == nil {
+		t.ids = append(t.ids, id)
+		t.users = append(t.users, userHash)
+	}
+	return err
+}
+
+func (t *cachedTx) Delete(id int64, userHash string, expectedVersion int64) error {
+	err := t.DBTx.Delete(id, userHash, expectedVersion)
+	if err == nil {
+		t.ids = append(t.ids, id)
+		t.users = append(t.users, userHash)
+	}
+	return err
+}
+
+func (t *cachedTx) Commit() error {
+	err := t.DBTx.Commit()
+	if err == nil {
+		t.cache.invalidateItems(t.ids...)
+		t.cache.invalidateLists(uniqueStrings(t.users)...)
+	}
+	return err
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]struct{}, len(values))
+	var result []string
+	for _, v := range values {
+		if _, ok := seen[v]; !ok {
+			seen[v] = struct{}{}
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	redis_utils "utils/redis"
+)
+
+// Заглушка базы: записи, видимые всем пользователям, и счетчики обращений
+type countingDB struct {
+	DBAdapter
+
+	mu    sync.Mutex
+	items map[int64]*DBItem
+	gets  int
+	lists int
+}
+
+func (db *countingDB) Get(id int64, userHash string) (*DBItem, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.gets++
+	item, ok := db.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *item
+	return &c, nil
+}
+
+func (db *countingDB) GetAll(userHash string, opts *ListOptions) ([]*DBItem, string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lists++
+	var items []*DBItem
+	for id := int64(1); id <= int64(len(db.items)); id++ {
+		c := *db.items[id]
+		items = append(items, &c)
+	}
+	return items, "", nil
+}
+
+func (db *countingDB) Update(id int64, item *DBItem, userHash string, expectedVersion int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	current := db.items[id]
+	current.Value = item.Value
+	current.Version++
+	return nil
+}
+
+func (db *countingDB) calls() (int, int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.gets, db.lists
+}
+
+func newTestCache(t *testing.T) (*RedisCache, *countingDB, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	redis, err := redis_utils.NewRedisClient(&redis_utils.RedisConfig{Addrs: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatalf("NewRedisClient: %v", err)
+	}
+	db := &countingDB{items: map[int64]*DBItem{
+		1: {ID: 1, Name: "a", Value: map[string]interface{}{"n": float64(1)}, Version: 1},
+		2: {ID: 2, Name: "b", Value: map[string]interface{}{"n": float64(2)}, Version: 1},
+	}}
+	return NewRedisCache(db, redis, CacheConfig{ItemTTL: time.Minute, ListTTL: time.Minute}), db, mr
+}
+
+func TestRedisCacheGet(t *testing.T) {
+	cache, db, _ := newTestCache(t)
+
+	for i := 0; i < 3; i++ {
+		item, err := cache.Get(1, "alice")
+		if err != nil || item.Name != "a" {
+			t.Fatalf("Get() = %+v, %v", item, err)
+		}
+	}
+	if gets, _ := db.calls(); gets != 1 {
+		t.Fatalf("database read %d times, want 1", gets)
+	}
+
+	// Изменение сбрасывает кэш записи у всех пользователей
+	cache.Get(1, "bob")
+	if err := cache.Update(1, &DBItem{Value: map[string]interface{}{"n": float64(10)}}, "alice", 0); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		item, err := cache.Get(1, user)
+		if err != nil || item.Value["n"] != float64(10) {
+			t.Errorf("%s: Get() after update = %+v, %v", user, item, err)
+		}
+	}
+	if gets, _ := db.calls(); gets != 4 {
+		t.Fatalf("database read %d times, want 4", gets)
+	}
+}
+
+func TestRedisCacheListDependsOnItemGenerations(t *testing.T) {
+	cache, db, _ := newTestCache(t)
+
+	list := func(user string) []*DBItem {
+		t.Helper()
+		items, _, err := cache.GetAll(user, &ListOptions{})
+		if err != nil {
+			t.Fatalf("GetAll: %v", err)
+		}
+		return items
+	}
+
+	list("alice")
+	list("bob")
+	list("alice")
+	list("bob")
+	if _, lists := db.calls(); lists != 2 {
+		t.Fatalf("lists loaded %d times, want 2", lists)
+	}
+
+	// Запись изменил alice; список bob (например, получателя доступа) тоже устаревает
+	cache.Update(2, &DBItem{Value: map[string]interface{}{"n": float64(20)}}, "alice", 0)
+	items := list("bob")
+	if len(items) != 2 || items[1].Value["n"] != float64(20) {
+		t.Fatalf("bob list after update = %+v", items)
+	}
+	if _, lists := db.calls(); lists != 3 {
+		t.Fatalf("lists loaded %d times, want 3", lists)
+	}
+
+	// Обновленная страница снова кэшируется
+	list("bob")
+	if _, lists := db.calls(); lists != 3 {
+		t.Fatalf("lists loaded %d times, want 3", lists)
+	}
+}
+
+func TestRedisCacheGenerationOutlivesValues(t *testing.T) {
+	cache, db, mr := newTestCache(t)
+
+	cache.Update(1, &DBItem{Value: map[string]interface{}{"n": float64(10)}}, "alice", 0)
+	cache.Get(1, "alice")
+	cache.GetAll("bob", &ListOptions{})
+
+	// Значения истекли, поколение записи хранится cacheGenTTL
+	mr.FastForward(2 * time.Minute)
+	if ttl := mr.TTL(itemGenKey(1)); ttl <= 0 || ttl > cacheGenTTL {
+		t.Fatalf("item generation TTL = %s", ttl)
+	}
+	if mr.Exists(itemCacheKey(1)) {
+		t.Fatalf("item hash outlived ItemTTL")
+	}
+
+	cache.Get(1, "alice")
+	if gets, _ := db.calls(); gets != 2 {
+		t.Fatalf("database read %d times, want 2", gets)
+	}
+}
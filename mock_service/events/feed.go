@@ -0,0 +1,144 @@
+package events
+
+import (
+	"context"
+	"log"
+	"mock_service/database"
+	"sync"
+	"time"
+)
+
+// Сколько событий может ждать отправки одному подписчику
+const subscriptionBuffer = 64
+
+// TokenAudience - audience токена ленты, который можно передать в параметре access_token
+// или в подпротоколе WebSocket (jwt_utils.QueryTokenMiddleware)
+const TokenAudience = "events"
+
+// Subscription - события одного пользователя. Канал закрывается, если подписчик
+// не успевает их читать: клиент должен переподключиться с последним ID.
+type Subscription struct {
+	Events   <-chan *database.ItemEvent
+	events   chan *database.ItemEvent
+	userHash string
+}
+
+// Пауза перед повторным подключением к уведомлениям после ошибки
+const (
+	listenRetryMin = time.Second
+	listenRetryMax = time.Minute
+)
+
+// Feed - раздает события из базы подписчикам и удаляет старые события
+type Feed struct {
+	db        database.DBAdapter
+	retention time.Duration
+
+	mu     sync.Mutex
+	subs   map[string]map[*Subscription]struct{}
+	lastID int64 // последнее разданное событие, с него продолжается прослушивание после ошибки
+}
+
+func NewFeed(db database.DBAdapter, retention time.Duration) *Feed {
+	return &Feed{
+		db:        db,
+		retention: retention,
+		subs:      make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+// Run - блокирует до отмены ctx. Если прослушивание уведомлений прерывается ошибкой,
+// оно перезапускается с паузой, растущей до listenRetryMax.
+func (f *Feed) Run(ctx context.Context) error {
+	go f.prune(ctx)
+
+	retry := listenRetryMin
+	for {
+		f.mu.Lock()
+		lastID := f.lastID
+		f.mu.Unlock()
+
+		started := time.Now()
+		err := f.db.ListenEvents(ctx, lastID, f.publish)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(started) > listenRetryMax {
+			retry = listenRetryMin
+		}
+		log.Printf("Feed: Error listening events, retry in %s: %v", retry, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, listenRetryMax)
+	}
+}
+
+func (f *Feed) Subscribe(userHash string) *Subscription {
+	events := make(chan *database.ItemEvent, subscriptionBuffer)
+	s := &Subscription{Events: events, events: events, userHash: userHash}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs[userHash] == nil {
+		f.subs[userHash] = make(map[*Subscription]struct{})
+	}
+	f.subs[userHash][s] = struct{}{}
+	return s
+}
+
+func (f *Feed) Unsubscribe(s *Subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.remove(s)
+}
+
+// remove - вызывается под f.mu
+func (f *Feed) remove(s *Subscription) {
+	subs := f.subs[s.userHash]
+	if _, ok := subs[s]; !ok {
+		return
+	}
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(f.subs, s.userHash)
+	}
+	close(s.events)
+}
+
+func (f *Feed) publish(e *database.ItemEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastID = max(f.lastID, e.ID)
+	for s := range f.subs[e.UserHash] {
+		select {
+		case s.events <- e:
+		default:
+			log.Printf("Feed: subscriber of %s is too slow, disconnected", e.UserHash)
+			f.remove(s)
+		}
+	}
+}
+
+func (f *Feed) prune(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		count, err := f.db.PruneEvents(time.Now().Add(-f.retention))
+		if err != nil {
+			log.Printf("Feed: Error pruning events: %v", err)
+		} else if count > 0 {
+			log.Printf("Feed: %d old events deleted", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
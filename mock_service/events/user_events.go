@@ -0,0 +1,60 @@
+package events
+
+import (
+	"context"
+	"log"
+	"mock_service/database"
+	"os"
+	redis_utils "utils/redis"
+)
+
+// Группа потребителей mock_service в потоке событий о пользователях
+const userEventsGroup = "mock_service"
+
+// UserEventsConsumer - обрабатывает события auth_service об удалении пользователей
+type UserEventsConsumer struct {
+	db        database.DBAdapter
+	redis_cli *redis_utils.RedisClient
+	mode      string
+}
+
+func NewUserEventsConsumer(db database.DBAdapter, redis_cli *redis_utils.RedisClient, mode string) *UserEventsConsumer {
+	return &UserEventsConsumer{db, redis_cli, mode}
+}
+
+// Run - блокирующее чтение событий до отмены ctx
+func (c *UserEventsConsumer) Run(ctx context.Context) error {
+	consumer, err := os.Hostname()
+	if err != nil {
+		consumer = "mock_service"
+	}
+	return c.redis_cli.ConsumeEvents(ctx, redis_utils.StreamUserEvents, userEventsGroup, consumer, c.handleEvent)
+}
+
+func (c *UserEventsConsumer) handleEvent(id string, values map[string]interface{}) error {
+	if values["type"] != redis_utils.EventUserDeleted {
+		return nil
+	}
+
+	userHash, _ := values["userhash"].(string)
+	if userHash == "" {
+		// Повторная обработка не поможет, поэтому подтверждаем событие
+		log.Printf("UserEventsConsumer: event %s without userhash, skipped", id)
+		return nil
+	}
+
+	// Повторно опубликованное событие приходит с новым ID в потоке, но с тем же event_id;
+	// события без него (опубликованные до event_id) различаются по ID в потоке
+	eventID, _ := values[redis_utils.EventIDField].(string)
+	if eventID == "" {
+		eventID = id
+	}
+
+	affected, err := c.db.DeleteUserData(userHash, c.mode, eventID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("UserEventsConsumer: user %s deleted (event %s), %s: %d items", userHash, eventID, c.mode, affected)
+	return nil
+}
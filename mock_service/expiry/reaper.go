@@ -0,0 +1,50 @@
+package expiry
+
+import (
+	"context"
+	"log"
+	"mock_service/database"
+	"time"
+)
+
+// Reaper - периодически удаляет записи с истекшим сроком жизни. Читать их нельзя
+// сразу после истечения срока, Reaper только освобождает место. Событие expire
+// отправляется при удалении записи, то есть с задержкой до interval.
+type Reaper struct {
+	db       database.DBAdapter
+	interval time.Duration
+}
+
+func NewReaper(db database.DBAdapter, interval time.Duration) *Reaper {
+	return &Reaper{
+		db:       db,
+		interval: interval,
+	}
+}
+
+// Run - блокирует до отмены ctx
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.reap()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reaper) reap() {
+	count, err := r.db.PurgeExpired()
+	if err != nil {
+		log.Printf("Expiry reaper: Error: %v", err)
+		return
+	}
+	if count > 0 {
+		log.Printf("Expiry reaper: %d expired items deleted", count)
+	}
+}
@@ -5,16 +5,24 @@ go 1.22.5
 require github.com/lib/pq v1.10.9
 
 require (
+	github.com/alicebob/miniredis/v2 v2.33.0
+	github.com/evanphx/json-patch/v5 v5.9.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	golang.org/x/sync v0.8.0
 	utils/json v0.0.0-00010101000000-000000000000
 	utils/jwt v0.0.0-00010101000000-000000000000
 	utils/redis v0.0.0-00010101000000-000000000000
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/go-redis/redis/v8 v8.11.4 // indirect
 	github.com/golang-jwt/jwt/v5 v5.0.0 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
 
 replace utils/redis => ../utils/redis
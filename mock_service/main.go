@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"log"
 	"mock_service/api"
+	"mock_service/blobstore"
 	"mock_service/database"
+	"mock_service/events"
+	"mock_service/expiry"
+	"mock_service/takeout"
+	"mock_service/trash"
+	"mock_service/webhooks"
 	"net/http"
 	"os"
 	jwt_utils "utils/jwt"
@@ -32,18 +40,115 @@ func main() {
 	}
 
 	log.Printf("Init Redis client")
-	r_addr := os.Getenv("REDIS_HOST")
-	r_port := os.Getenv("REDIS_PORT")
-	redis_cli := redis_utils.InitRedisClient(r_addr+":"+r_port, "")
+	redis_cli, err := redis_utils.NewRedisClient(&config.RedisConf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.CacheEnabled {
+		log.Printf("Enable item cache, item TTL: %s, list TTL: %s", config.Cache.ItemTTL, config.Cache.ListTTL)
+		db_adapter = database.NewRedisCache(db_adapter, redis_cli, config.Cache)
+	}
+
+	log.Printf("Start token revocation cache, fail policy: %s", config.RevocationFailPolicy)
+	revocations := redis_utils.NewRevocationCache(redis_cli, config.RevocationFailPolicy)
+	go revocations.Run(context.Background())
 
 	secret := os.Getenv("JWT_SECRET")
 	jwt_utils.InitJwtSecret(secret)
+	jwt_utils.InitDPoPReplayStore(redis_cli)
+
+	log.Printf("Start user events consumer, deletion mode: %s", config.DeletionMode)
+	user_events := events.NewUserEventsConsumer(db_adapter, redis_cli, config.DeletionMode)
+	go func() {
+		if err := user_events.Run(context.Background()); err != nil {
+			log.Printf("User events consumer stopped: %v", err)
+		}
+	}()
+
+	if config.TrashRetention > 0 {
+		log.Printf("Start trash purger, retention: %s", config.TrashRetention)
+		purger := trash.NewPurger(db_adapter, config.TrashRetention, config.TrashPurgeInterval)
+		go purger.Run(context.Background())
+	}
+
+	log.Printf("Start expiry reaper, interval: %s", config.ExpiryReapInterval)
+	reaper := expiry.NewReaper(db_adapter, config.ExpiryReapInterval)
+	go reaper.Run(context.Background())
+
+	takeout_manager, err := takeout.NewManager(db_adapter, config.AuthServiceURL, config.TakeoutDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Start item events feed, retention: %s", config.EventsRetention)
+	feed := events.NewFeed(db_adapter, config.EventsRetention)
+	go feed.Run(context.Background())
+
+	log.Printf("Start webhook dispatcher, log retention: %s", config.WebhookLogRetention)
+	dispatcher := webhooks.NewDispatcher(db_adapter, config.WebhookAllowPrivate, config.WebhookLogRetention)
+	go dispatcher.Run(context.Background())
+
+	var blobs blobstore.Store
+	if config.BlobStore == "s3" {
+		log.Printf("Use S3 blob store, bucket: %s", config.S3.Bucket)
+		blobs, err = blobstore.NewS3Store(config.S3)
+	} else {
+		log.Printf("Use local blob store, dir: %s", config.BlobDir)
+		blobs, err = blobstore.NewLocalStore(config.BlobDir)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Start blob garbage collector")
+	collector := blobstore.NewCollector(db_adapter, blobs)
+	go collector.Run(context.Background())
+
+	idempotency := api.NewIdempotency(redis_cli, config.IdempotencyTTL)
+	api := api.NewApi(db_adapter, revocations, takeout_manager, feed, blobs, config.Attachments)
 
-	api := api.NewApi(db_adapter)
+	// Метрики процесса и кэша - на отдельном адресе, доступном только локально
+	debug := http.NewServeMux()
+	debug.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		log.Printf("Starting debug server on " + config.DebugAddr)
+		if err := http.ListenAndServe(config.DebugAddr, debug); err != nil {
+			log.Printf("Debug server stopped: %v", err)
+		}
+	}()
 
 	mux := http.NewServeMux()
-	mux.Handle("/data", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerData), redis_cli))
-	mux.Handle("/list", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerList), redis_cli))
+	mux.Handle("/data", jwt_utils.JwtMiddleware(idempotency.Wrap(http.HandlerFunc(api.HandlerData)), revocations))
+	mux.Handle("/data/{id}/attachments", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerAttachments), revocations))
+	mux.Handle("/data/{id}/attachments/{name}", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerAttachment), revocations))
+	mux.Handle("/data/batch", jwt_utils.JwtMiddleware(idempotency.Wrap(http.HandlerFunc(api.HandlerBatch)), revocations))
+	mux.Handle("/list", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerList), revocations))
+	mux.Handle("/export", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerExport), revocations))
+	mux.Handle("/import", jwt_utils.JwtMiddleware(idempotency.Wrap(http.HandlerFunc(api.HandlerImport)), revocations))
+	mux.Handle("/search", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerSearch), revocations))
+	mux.Handle("/history", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerHistory), revocations))
+	mux.Handle("/history/diff", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerHistoryDiff), revocations))
+	mux.Handle("/history/restore", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerHistoryRestore), revocations))
+	mux.Handle("/collections", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerCollections), revocations))
+	mux.Handle("/collections/{c}", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerCollection), revocations))
+	mux.Handle("/collections/{c}/items", jwt_utils.JwtMiddleware(idempotency.Wrap(http.HandlerFunc(api.HandlerCollectionItems)), revocations))
+	mux.Handle("/collections/{c}/items/{id}", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerCollectionItem), revocations))
+	mux.Handle("/schemas", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerSchemas), revocations))
+	mux.Handle("/schemas/bindings", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerSchemaBindings), revocations))
+	mux.Handle("/trash", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerTrash), revocations))
+	mux.Handle("/trash/restore", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerTrashRestore), revocations))
+	mux.Handle("/events", jwt_utils.QueryTokenMiddleware(http.HandlerFunc(api.HandlerEvents), revocations, events.TokenAudience))
+	mux.Handle("/events/ws", jwt_utils.QueryTokenMiddleware(http.HandlerFunc(api.HandlerEventsWS), revocations, events.TokenAudience))
+	mux.Handle("/events/token", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerEventsToken), revocations))
+	mux.Handle("/webhooks", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerWebhooks), revocations))
+	mux.Handle("/webhooks/{id}", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerWebhook), revocations))
+	mux.Handle("/webhooks/{id}/deliveries", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerWebhookDeliveries), revocations))
+	mux.Handle("/webhooks/{id}/deliveries/{delivery}", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerWebhookDelivery), revocations))
+	mux.Handle("/webhooks/{id}/deliveries/{delivery}/redeliver", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerWebhookRedeliver), revocations))
+	mux.Handle("/share", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerShare), revocations))
+	mux.Handle("/takeout", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerTakeout), revocations))
+	mux.Handle("/takeout/download", jwt_utils.JwtMiddleware(http.HandlerFunc(api.HandlerTakeoutDownload), revocations))
 
 	port := fmt.Sprintf("%d", config.Port)
 	log.Printf("Starting server on port " + port)
@@ -0,0 +1,332 @@
+package takeout
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mock_service/database"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Состояния выгрузки
+const (
+	StatusPending = "pending"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// Сколько хранится готовый архив
+const archiveTTL = 24 * time.Hour
+
+type Job struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	userHash string
+	path     string
+}
+
+// Состояние выгрузки на диске, рядом с архивом
+type storedJob struct {
+	Job
+	UserHash string `json:"userhash"`
+}
+
+// Описание файла в архиве
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type Manifest struct {
+	UserHash    string         `json:"userhash"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	ItemsCount  int            `json:"items_count"`
+	Files       []ManifestFile `json:"files"`
+}
+
+// Manager - асинхронная сборка архивов с персональными данными пользователя.
+// Профиль берется из auth_service, записи - из DBAdapter. Состояние выгрузок хранится
+// в dir рядом с архивами и переживает перезапуск; выгрузки, прерванные перезапуском,
+// завершаются ошибкой. Каталог не разделяется между экземплярами сервиса.
+type Manager struct {
+	db      database.DBAdapter
+	authURL string
+	dir     string
+	client  *http.Client
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func NewManager(db database.DBAdapter, authURL string, dir string) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		db:      db,
+		authURL: authURL,
+		dir:     dir,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		jobs:    make(map[string]*Job),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Загружает состояние выгрузок, сохраненное до перезапуска
+func (m *Manager) load() error {
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var stored storedJob
+		if err := json.Unmarshal(data, &stored); err != nil {
+			log.Printf("Takeout: skip %s: %v", path, err)
+			continue
+		}
+
+		job := stored.Job
+		job.userHash = stored.UserHash
+		job.path = filepath.Join(m.dir, job.ID+".zip")
+		if job.Status == StatusPending {
+			now := time.Now().UTC()
+			job.Status, job.Error, job.FinishedAt = StatusFailed, "export interrupted by restart", &now
+			os.Remove(job.path)
+			if err := m.save(&job); err != nil {
+				return err
+			}
+		}
+		m.jobs[job.ID] = &job
+	}
+	return nil
+}
+
+// Сохраняет состояние выгрузки; файл заменяется целиком
+func (m *Manager) save(job *Job) error {
+	data, err := json.Marshal(&storedJob{Job: *job, UserHash: job.userHash})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(m.dir, job.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Start - запускает выгрузку. Профиль запрашивается сразу, пока токен пользователя действителен.
+func (m *Manager) Start(userHash string, authHeader string) (*Job, error) {
+	profile, err := m.fetchProfile(authHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		ID:        id,
+		Status:    StatusPending,
+		CreatedAt: time.Now().UTC(),
+		userHash:  userHash,
+		path:      filepath.Join(m.dir, id+".zip"),
+	}
+
+	m.mu.Lock()
+	m.cleanupLocked()
+	if err := m.save(job); err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	m.jobs[id] = job
+	snapshot := *job
+	m.mu.Unlock()
+
+	go m.build(job, profile)
+
+	return &snapshot, nil
+}
+
+// Get - состояние выгрузки; чужие выгрузки не видны
+func (m *Manager) Get(id string, userHash string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok || job.userHash != userHash {
+		return nil, false
+	}
+	snapshot := *job
+	return &snapshot, true
+}
+
+// Open - открывает готовый архив
+func (m *Manager) Open(job *Job) (*os.File, error) {
+	if job.Status != StatusDone {
+		return nil, fmt.Errorf("export is not ready")
+	}
+	return os.Open(job.path)
+}
+
+func (m *Manager) fetchProfile(authHeader string) (json.RawMessage, error) {
+	req, err := http.NewRequest(http.MethodGet, m.authURL+"/profile", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authHeader)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get profile from auth service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get profile from auth service: status %d", resp.StatusCode)
+	}
+
+	var profile json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("failed to decode profile: %v", err)
+	}
+	return profile, nil
+}
+
+func (m *Manager) build(job *Job, profile json.RawMessage) {
+	size, err := m.writeArchive(job, profile)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	if err != nil {
+		log.Printf("Takeout %s failed: %v", job.ID, err)
+		os.Remove(job.path)
+		job.Status = StatusFailed
+		job.Error = "failed to build export"
+	} else {
+		job.Status = StatusDone
+		job.Size = size
+		log.Printf("Takeout %s finished, %d bytes", job.ID, size)
+	}
+
+	if err := m.save(job); err != nil {
+		log.Printf("Takeout %s: failed to save state: %v", job.ID, err)
+	}
+}
+
+func (m *Manager) writeArchive(job *Job, profile json.RawMessage) (int64, error) {
+	var items []*database.DBItem
+	opts := &database.ListOptions{Limit: database.MaxListLimit}
+	for {
+		page, next, err := m.db.GetAll(job.userHash, opts)
+		if err != nil {
+			return 0, err
+		}
+		items = append(items, page...)
+		if next == "" {
+			break
+		}
+		opts.After = next
+	}
+
+	f, err := os.OpenFile(job.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	manifest := Manifest{
+		UserHash:    job.userHash,
+		GeneratedAt: time.Now().UTC(),
+		ItemsCount:  len(items),
+	}
+
+	writeFile := func(name string, data interface{}) error {
+		content, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+
+		hash := sha256.Sum256(content)
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Name:   name,
+			Size:   int64(len(content)),
+			SHA256: hex.EncodeToString(hash[:]),
+		})
+		return nil
+	}
+
+	if err := writeFile("profile.json", profile); err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if err := writeFile(fmt.Sprintf("items/%d.json", item.ID), item); err != nil {
+			return 0, err
+		}
+	}
+	if err := writeFile("manifest.json", manifest); err != nil {
+		return 0, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	return f.Seek(0, io.SeekCurrent)
+}
+
+// Удаляет устаревшие выгрузки. Вызывается под m.mu.
+func (m *Manager) cleanupLocked() {
+	for id, job := range m.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > archiveTTL {
+			os.Remove(job.path)
+			os.Remove(filepath.Join(m.dir, id+".json"))
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
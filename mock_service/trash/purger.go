@@ -0,0 +1,50 @@
+package trash
+
+import (
+	"context"
+	"log"
+	"mock_service/database"
+	"time"
+)
+
+// Purger - периодически окончательно удаляет записи, пролежавшие в корзине дольше retention
+type Purger struct {
+	db        database.DBAdapter
+	retention time.Duration
+	interval  time.Duration
+}
+
+func NewPurger(db database.DBAdapter, retention time.Duration, interval time.Duration) *Purger {
+	return &Purger{
+		db:        db,
+		retention: retention,
+		interval:  interval,
+	}
+}
+
+// Run - блокирует до отмены ctx
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.purge()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Purger) purge() {
+	count, err := p.db.PurgeTrash(time.Now().Add(-p.retention))
+	if err != nil {
+		log.Printf("Trash purger: Error: %v", err)
+		return
+	}
+	if count > 0 {
+		log.Printf("Trash purger: %d items deleted permanently", count)
+	}
+}
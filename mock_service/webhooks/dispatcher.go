@@ -0,0 +1,248 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mock_service/database"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Заголовки запроса вебхука. Подпись - HMAC-SHA256 секрета от "<timestamp>.<тело>".
+const (
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+const (
+	pollInterval   = 5 * time.Second
+	claimBatchSize = 50
+	requestTimeout = 10 * time.Second
+	// Должен быть больше requestTimeout, иначе доставку заберет другой экземпляр
+	claimLease = time.Minute
+
+	// После maxAttempts неудачных попыток доставка переходит в dead
+	maxAttempts    = 8
+	baseRetryDelay = 30 * time.Second
+	maxRetryDelay  = 6 * time.Hour
+)
+
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// Dispatcher - отправляет события из очереди доставок и удаляет старый журнал
+type Dispatcher struct {
+	db        database.DBAdapter
+	client    *http.Client
+	retention time.Duration
+}
+
+// NewDispatcher - allowPrivate разрешает адреса в локальных сетях (для разработки и тестов)
+func NewDispatcher(db database.DBAdapter, allowPrivate bool, retention time.Duration) *Dispatcher {
+	dialer := &net.Dialer{Timeout: requestTimeout}
+	if !allowPrivate {
+		// Проверяется адрес после разрешения имени, поэтому DNS не позволит обойти запрет
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// Только напрямую: через прокси проверялся бы адрес прокси, а не получателя
+	transport.Proxy = nil
+	return &Dispatcher{
+		db: db,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   requestTimeout,
+			// Перенаправление считается ответом получателя
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		retention: retention,
+	}
+}
+
+// Специальные сети, которые не проверяются методами net.IP
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "эта" сеть
+		"100.64.0.0/10",  // CGNAT (RFC 6598)
+		"192.0.0.0/24",   // служебные адреса IETF
+		"198.18.0.0/15",  // тестирование производительности
+		"240.0.0.0/4",    // зарезервировано, включая широковещательный адрес
+		"64:ff9b::/96",   // NAT64: может вести на адрес локальной сети
+		"64:ff9b:1::/48", // локальный NAT64
+		"2001:db8::/32",  // документация
+		"fec0::/10",      // устаревшие site-local
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Run - блокирует до отмены ctx
+func (d *Dispatcher) Run(ctx context.Context) {
+	go d.prune(ctx)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Полная пачка - возможно, в очереди есть еще
+		for d.dispatch(ctx) == claimBatchSize {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context) int {
+	deliveries, err := d.db.ClaimWebhookDeliveries(claimBatchSize, claimLease)
+	if err != nil {
+		log.Printf("Webhooks: Error claiming deliveries: %v", err)
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *database.WebhookDelivery) {
+			defer wg.Done()
+			d.deliver(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery *database.WebhookDelivery) {
+	attempt := &database.WebhookAttempt{AttemptedAt: time.Now()}
+	attempt.StatusCode, attempt.Error = d.send(ctx, delivery)
+	attempt.DurationMs = time.Since(attempt.AttemptedAt).Milliseconds()
+
+	success := attempt.Error == ""
+	var retryAt *time.Time
+	if !success && delivery.Attempts+1 < maxAttempts {
+		t := time.Now().Add(retryDelay(delivery.Attempts + 1))
+		retryAt = &t
+	}
+
+	if err := d.db.RecordWebhookAttempt(delivery.ID, attempt, success, retryAt); err != nil {
+		log.Printf("Webhooks: Error recording attempt of delivery %d: %v", delivery.ID, err)
+		return
+	}
+	if !success && retryAt == nil {
+		log.Printf("Webhooks: delivery %d is dead after %d attempts: %s", delivery.ID, maxAttempts, attempt.Error)
+	}
+}
+
+// send - код ответа и описание ошибки ("" - доставлено)
+func (d *Dispatcher) send(ctx context.Context, delivery *database.WebhookDelivery) (int, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	// Тело ответа не нужно, но дочитывается, чтобы соединение вернулось в пул
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, ""
+}
+
+// Sign - значение заголовка X-Webhook-Signature
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay - экспоненциальная задержка перед попыткой attempt+1 со случайной добавкой до 10%,
+// чтобы повторы разных доставок не совпадали
+func retryDelay(attempt int) time.Duration {
+	delay := maxRetryDelay
+	if attempt < 20 {
+		delay = min(baseRetryDelay<<(attempt-1), maxRetryDelay)
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/10+1))
+}
+
+func (d *Dispatcher) prune(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		count, err := d.db.PruneWebhookDeliveries(time.Now().Add(-d.retention))
+		if err != nil {
+			log.Printf("Webhooks: Error pruning deliveries: %v", err)
+		} else if count > 0 {
+			log.Printf("Webhooks: %d old deliveries deleted", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mock_service/database"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Заглушка БД: запоминает записанные попытки
+type recordingDB struct {
+	database.DBAdapter
+
+	mu       sync.Mutex
+	attempts []recordedAttempt
+}
+
+type recordedAttempt struct {
+	deliveryID int64
+	attempt    *database.WebhookAttempt
+	success    bool
+	retryAt    *time.Time
+}
+
+func (db *recordingDB) RecordWebhookAttempt(deliveryID int64, attempt *database.WebhookAttempt, success bool, retryAt *time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.attempts = append(db.attempts, recordedAttempt{deliveryID, attempt, success, retryAt})
+	return nil
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"93.184.216.34", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false}, // метаданные облака
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"100.64.0.1", false}, // CGNAT
+		{"100.127.255.254", false},
+		{"100.63.255.255", true},
+		{"100.128.0.1", true},
+		{"0.1.2.3", false},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"64:ff9b::a00:1", false}, // NAT64 для 10.0.0.1
+		{"2001:db8::1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ip == nil {
+				t.Fatalf("invalid test address %s", tt.ip)
+			}
+			if got := isPublic(ip); got != tt.public {
+				t.Errorf("isPublic(%s) = %v, want %v", tt.ip, got, tt.public)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	// Значение, посчитанное независимо: HMAC-SHA256("secret", `1700000000.{"id":1}`)
+	want := "sha256=3dd1b9aef568d75f6790a84bd2e5dfa1f44409eef3cbdbd3f10b837376100c11"
+	if got := Sign("secret", 1700000000, []byte(`{"id":1}`)); got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+
+	base := Sign("secret", 1700000000, []byte(`{"id":1}`))
+	for name, got := range map[string]string{
+		"other secret":    Sign("other", 1700000000, []byte(`{"id":1}`)),
+		"other timestamp": Sign("secret", 1700000001, []byte(`{"id":1}`)),
+		"other body":      Sign("secret", 1700000000, []byte(`{"id":2}`)),
+	} {
+		if got == base {
+			t.Errorf("%s: signature does not change", name)
+		}
+	}
+}
+
+func TestDispatcherHasNoProxy(t *testing.T) {
+	for _, allowPrivate := range []bool{false, true} {
+		d := NewDispatcher(&recordingDB{}, allowPrivate, time.Hour)
+		if d.client.Transport.(*http.Transport).Proxy != nil {
+			t.Errorf("allowPrivate=%v: transport uses a proxy", allowPrivate)
+		}
+	}
+}
+
+func TestSendBlocksPrivateAddress(t *testing.T) {
+	var called bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(&recordingDB{}, false, time.Hour)
+	// Имя разрешается в адрес loopback - запрет проверяется после разрешения
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	for _, u := range []string{server.URL, url} {
+		status, errText := d.send(context.Background(), &database.WebhookDelivery{ID: 1, URL: u, Payload: []byte(`{}`)})
+		if status != 0 || !strings.Contains(errText, errPrivateAddress.Error()) {
+			t.Errorf("send(%s) = %d, %q; want %q", u, status, errText, errPrivateAddress)
+		}
+	}
+	if called {
+		t.Errorf("private address was called")
+	}
+}
+
+func TestSendSignsRequest(t *testing.T) {
+	payload := []byte(`{"id":7,"type":"updated"}`)
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(&recordingDB{}, true, time.Hour)
+	delivery := &database.WebhookDelivery{ID: 42, EventType: "updated", Payload: payload, URL: server.URL, Secret: "s3cret"}
+	status, errText := d.send(context.Background(), delivery)
+	if status != http.StatusOK || errText != "" {
+		t.Fatalf("send() = %d, %q", status, errText)
+	}
+
+	r, body := <-requests, <-bodies
+	if r.Header.Get(HeaderDelivery) != "42" || r.Header.Get(HeaderEvent) != "updated" {
+		t.Errorf("delivery headers = %q, %q", r.Header.Get(HeaderDelivery), r.Header.Get(HeaderEvent))
+	}
+	if string(body) != string(payload) {
+		t.Errorf("body = %s, want %s", body, payload)
+	}
+
+	// Проверка так, как ее выполняет получатель
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)).Abs() > time.Minute {
+		t.Fatalf("invalid timestamp %q", r.Header.Get(HeaderTimestamp))
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	fmt.Fprintf(mac, "%d.%s", timestamp, body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get(HeaderSignature); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		attempts    int // неудачных попыток до этой
+		wantSuccess bool
+		wantRetry   bool
+	}{
+		{name: "delivered", status: http.StatusNoContent, wantSuccess: true},
+		{name: "server error", status: http.StatusInternalServerError, wantRetry: true},
+		{name: "redirect is not followed", status: http.StatusFound, attempts: 3, wantRetry: true},
+		{name: "last retry", status: http.StatusBadGateway, attempts: maxAttempts - 2, wantRetry: true},
+		{name: "dead", status: http.StatusBadGateway, attempts: maxAttempts - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "http://127.0.0.1:1/")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			db := &recordingDB{}
+			d := NewDispatcher(db, true, time.Hour)
+			started := time.Now()
+			d.deliver(context.Background(), &database.WebhookDelivery{ID: 5, URL: server.URL, Attempts: tt.attempts, Payload: []byte(`{}`)})
+
+			if len(db.attempts) != 1 {
+				t.Fatalf("recorded %d attempts, want 1", len(db.attempts))
+			}
+			got := db.attempts[0]
+			if got.deliveryID != 5 || got.success != tt.wantSuccess || got.attempt.StatusCode != tt.status {
+				t.Errorf("recorded delivery %d success=%v status=%d", got.deliveryID, got.success, got.attempt.StatusCode)
+			}
+			if tt.wantSuccess != (got.attempt.Error == "") {
+				t.Errorf("attempt error = %q", got.attempt.Error)
+			}
+			if (got.retryAt != nil) != tt.wantRetry {
+				t.Fatalf("retryAt = %v, want retry: %v", got.retryAt, tt.wantRetry)
+			}
+			if got.retryAt != nil {
+				delay := got.retryAt.Sub(started)
+				base := min(baseRetryDelay<<tt.attempts, maxRetryDelay)
+				if delay < base || delay > base+base/10+time.Second {
+					t.Errorf("retry in %s, want %s..%s", delay, base, base+base/10)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 30; attempt++ {
+		base := maxRetryDelay
+		if attempt < 20 {
+			base = min(baseRetryDelay<<(attempt-1), maxRetryDelay)
+		}
+		for i := 0; i < 20; i++ {
+			if delay := retryDelay(attempt); delay < base || delay > base+base/10 {
+				t.Fatalf("retryDelay(%d) = %s, want %s..%s", attempt, delay, base, base+base/10)
+			}
+		}
+	}
+}
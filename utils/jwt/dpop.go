@@ -0,0 +1,222 @@
+package jwt_utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoP (RFC 9449): токен привязывается к открытому ключу клиента через claim cnf.jkt,
+// и каждый запрос подписывается этим ключом (заголовок DPoP).
+
+// Допустимое расхождение iat доказательства с текущим временем
+const dpopProofMaxAge = time.Minute
+
+// Поддерживаемые алгоритмы подписи доказательств
+var dpopAlgorithms = []string{"ES256", "ES384", "RS256", "PS256"}
+
+// Confirmation - claim cnf
+type Confirmation struct {
+	JKT string `json:"jkt"` // SHA-256 отпечаток JWK клиента (RFC 7638)
+}
+
+// DPoPReplayStore - хранилище использованных jti доказательств
+type DPoPReplayStore interface {
+	// StoreDPoPJti - сохраняет jti; false, если он уже встречался
+	StoreDPoPJti(jti string, ttl time.Duration) (bool, error)
+}
+
+var dpop_replay_store DPoPReplayStore
+
+func InitDPoPReplayStore(store DPoPReplayStore) {
+	dpop_replay_store = store
+}
+
+type dpopClaims struct {
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	ATH string `json:"ath,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// VerifyDPoPProof - проверяет доказательство для запроса method на requestURL и возвращает
+// отпечаток ключа клиента. accessToken передается, если доказательство предъявлено вместе с токеном.
+func VerifyDPoPProof(proof string, method string, requestURL string, accessToken string) (string, error) {
+	var jkt string
+	claims := &dpopClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["typ"] != "dpop+jwt" {
+			return nil, fmt.Errorf("invalid proof type")
+		}
+		jwk, ok := token.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("proof jwk is missing")
+		}
+
+		key, thumbprint, err := parseJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+		jkt = thumbprint
+		return key, nil
+	}, jwt.WithValidMethods(dpopAlgorithms))
+	if err != nil {
+		return "", fmt.Errorf("invalid dpop proof: %v", err)
+	}
+
+	if claims.HTM != method {
+		return "", fmt.Errorf("dpop proof htm mismatch")
+	}
+	if normalizeHTU(claims.HTU) != normalizeHTU(requestURL) {
+		return "", fmt.Errorf("dpop proof htu mismatch")
+	}
+	if claims.IssuedAt == nil {
+		return "", fmt.Errorf("dpop proof iat is missing")
+	}
+	if age := time.Since(claims.IssuedAt.Time); age > dpopProofMaxAge || age < -dpopProofMaxAge {
+		return "", fmt.Errorf("dpop proof is expired")
+	}
+	if accessToken != "" {
+		hash := sha256.Sum256([]byte(accessToken))
+		if claims.ATH != base64.RawURLEncoding.EncodeToString(hash[:]) {
+			return "", fmt.Errorf("dpop proof ath mismatch")
+		}
+	}
+
+	if claims.ID == "" {
+		return "", fmt.Errorf("dpop proof jti is missing")
+	}
+	if dpop_replay_store == nil {
+		return "", fmt.Errorf("dpop replay store is not initialized")
+	}
+	// jti хранится дольше окна iat, чтобы повтор нельзя было предъявить ни в какой его момент
+	fresh, err := dpop_replay_store.StoreDPoPJti(jkt+":"+claims.ID, 2*dpopProofMaxAge)
+	if err != nil {
+		return "", fmt.Errorf("failed to check dpop proof replay: %v", err)
+	}
+	if !fresh {
+		return "", fmt.Errorf("dpop proof is replayed")
+	}
+
+	return jkt, nil
+}
+
+// RequestURL - адрес запроса для сравнения с htu. Хост - из Host (nginx передает исходный),
+// X-Forwarded-Host не учитывается: его может прислать сам клиент. X-Forwarded-Proto
+// nginx всегда перезаписывает.
+func RequestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+// htu сравнивается без query и fragment, схема и хост - без учета регистра
+func normalizeHTU(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath()
+}
+
+// Разбирает открытый JWK и считает его отпечаток по RFC 7638
+func parseJWK(jwk map[string]interface{}) (interface{}, string, error) {
+	field := func(name string) (string, []byte, error) {
+		s, ok := jwk[name].(string)
+		if !ok || s == "" {
+			return "", nil, fmt.Errorf("jwk %s is missing", name)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid jwk %s: %v", name, err)
+		}
+		return s, b, nil
+	}
+
+	if _, ok := jwk["d"]; ok {
+		return nil, "", fmt.Errorf("jwk must not contain private key")
+	}
+
+	var key interface{}
+	var members interface{}
+	switch jwk["kty"] {
+	case "EC":
+		crv, _ := jwk["crv"].(string)
+		var curve elliptic.Curve
+		switch crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, "", fmt.Errorf("unsupported jwk curve %s", crv)
+		}
+		x, xb, err := field("x")
+		if err != nil {
+			return nil, "", err
+		}
+		y, yb, err := field("y")
+		if err != nil {
+			return nil, "", err
+		}
+
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, "", fmt.Errorf("invalid jwk point")
+		}
+		key = pub
+		// Порядок полей важен: обязательные члены в лексикографическом порядке
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{crv, "EC", x, y}
+	case "RSA":
+		n, nb, err := field("n")
+		if err != nil {
+			return nil, "", err
+		}
+		e, eb, err := field("e")
+		if err != nil {
+			return nil, "", err
+		}
+
+		exp := new(big.Int).SetBytes(eb)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, "", fmt.Errorf("invalid jwk exponent")
+		}
+		key = &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{e, "RSA", n}
+	default:
+		return nil, "", fmt.Errorf("unsupported jwk kty %v", jwk["kty"])
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256(data)
+	return key, base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
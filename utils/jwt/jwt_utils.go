@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -24,11 +25,34 @@ func NewUserInfo() UserInfo {
 	}
 }
 
+// Организация, от имени которой действует пользователь
+type OrgClaim struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// Роли участников организации (OrgClaim.Role)
+const (
+	OrgRoleOwner  = "owner"  // полный доступ, управление организацией
+	OrgRoleAdmin  = "admin"  // управление участниками (кроме владельцев)
+	OrgRoleMember = "member" // чтение и запись данных организации
+	OrgRoleViewer = "viewer" // только чтение
+)
+
 type Claims struct {
 	UserInfo UserInfo
+	Org      *OrgClaim     `json:"org,omitempty"`
+	Cnf      *Confirmation `json:"cnf,omitempty"` // для токенов, привязанных к ключу клиента (DPoP)
+	// SHA-256 токена, из которого выпущен токен GenerateAudienceJWT: отзыв исходного токена
+	// отзывает и его
+	ParentHash string `json:"pth,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Время жизни выдаваемых токенов
+const TokenTTL = 5 * time.Minute
+
 var jwt_secret string
 
 func InitJwtSecret(secret string) {
@@ -38,41 +62,109 @@ func InitJwtSecret(secret string) {
 // TokenRevocationChecker - интерфейс для проверки отозванности токенов
 type TokenRevocationChecker interface {
 	IsTokenRevoked(token string) (bool, error)
+	// IsTokenHashRevoked - как IsTokenRevoked, но по HashToken(token)
+	IsTokenHashRevoked(hash string) (bool, error)
+	// IsUserRevoked - отозваны ли все токены пользователя, выданные до issuedAt включительно
+	IsUserRevoked(userHash string, issuedAt time.Time) (bool, error)
+}
+
+// HashToken - SHA-256 токена, под которым он хранится в списке отозванных
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
 }
 
-func hashUsername(username string) string {
+// HashUsername - идентификатор пользователя, который попадает в Subject токена
+func HashUsername(username string) string {
 	hash := sha256.Sum256([]byte(username)) // Вычисляем SHA-256
 	return hex.EncodeToString(hash[:])      // Конвертируем в строку
 }
 
-func GenerateJWT(username string) (string, error) {
-	claims := &Claims{
-		UserInfo: NewUserInfo(),
+// NewClaims - claims нового токена пользователя; перед подписью их можно дополнить
+func NewClaims(username string, userInfo UserInfo) *Claims {
+	return &Claims{
+		UserInfo: userInfo,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    "auth_service",                                      // Кто выдал токен
-			Subject:   hashUsername(username),                              // Кто является владельцем
-			IssuedAt:  jwt.NewNumericDate(time.Now()),                      // Время выдачи токена
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)), // Время истечения срока действия
+			Issuer:    "auth_service",                               // Кто выдал токен
+			Subject:   HashUsername(username),                       // Кто является владельцем
+			IssuedAt:  jwt.NewNumericDate(time.Now()),               // Время выдачи токена
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenTTL)), // Время истечения срока действия
 		},
 	}
+}
 
+func SignClaims(claims *Claims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(jwt_secret))
 }
 
+func GenerateJWT(username string, userInfo UserInfo) (string, error) {
+	return SignClaims(NewClaims(username, userInfo))
+}
+
+// GenerateDelegatedJWT - короткоживущий bearer-токен от имени того же пользователя
+// для вызовов между сервисами (токен клиента может быть привязан к его ключу).
+// Токен принимает только DelegatedMiddleware с тем же audience.
+func GenerateDelegatedJWT(claims *Claims, issuer string, audience string, ttl time.Duration) (string, error) {
+	delegated := &Claims{
+		UserInfo: claims.UserInfo,
+		Org:      claims.Org,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   claims.Subject,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+	return SignClaims(delegated)
+}
+
+// ErrTokenBound - токен привязан к ключу клиента (DPoP), и bearer-токен из него не выпускается
+var ErrTokenBound = errors.New("token is bound to a dpop key")
+
+// GenerateAudienceJWT - bearer-токен того же пользователя, который принимается только
+// QueryTokenMiddleware с этим audience. Срок действия и время выдачи - как у исходного
+// токена token, чтобы отзыв всех токенов пользователя действовал и на него; отзыв самого
+// token - тоже. Для токенов, привязанных к ключу, - ErrTokenBound: bearer-токен обошел бы привязку.
+func GenerateAudienceJWT(claims *Claims, token string, audience string) (string, error) {
+	if claims.Cnf != nil {
+		return "", ErrTokenBound
+	}
+	restricted := &Claims{
+		UserInfo:   claims.UserInfo,
+		Org:        claims.Org,
+		ParentHash: HashToken(token),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    claims.Issuer,
+			Subject:   claims.Subject,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  claims.IssuedAt,
+			ExpiresAt: claims.ExpiresAt,
+		},
+	}
+	return SignClaims(restricted)
+}
+
 func GetJwtTokenFromHeader(r *http.Request) (string, error) {
+	_, token, err := getAuthorization(r)
+	return token, err
+}
+
+// Возвращает схему ("Bearer" или "DPoP") и токен из заголовка Authorization
+func getAuthorization(r *http.Request) (string, string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return "", fmt.Errorf("authorization header is missing")
+		return "", "", fmt.Errorf("authorization header is missing")
 	}
 
-	// "Bearer <token>"
+	// "Bearer <token>" или "DPoP <token>"
 	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return "", fmt.Errorf("invalid authorization header format")
+	if len(parts) != 2 || (parts[0] != "Bearer" && parts[0] != "DPoP") {
+		return "", "", fmt.Errorf("invalid authorization header format")
 	}
 
-	return parts[1], nil
+	return parts[0], parts[1], nil
 }
 
 func GetJWTClaims(token_str string) (*Claims, error) {
@@ -98,35 +190,209 @@ func GetJWTClaims(token_str string) (*Claims, error) {
 	return nil, fmt.Errorf("Unable to extract claims from token")
 }
 
+// Параметр запроса и подпротокол WebSocket, в которых передается токен клиентами без
+// доступа к заголовкам (EventSource, WebSocket в браузере). WebSocket: подпротоколы
+// "access_token", "<токен>"; сервер выбирает подпротокол "access_token".
+const (
+	TokenQueryParam  = "access_token"
+	TokenSubprotocol = "access_token"
+)
+
+// Audience делегированного токена, с которым mock_service читает профиль в auth_service
+const ProfileAudience = "profile"
+
 func JwtMiddleware(next http.Handler, revocationChecker TokenRevocationChecker) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenSigned, err := GetJwtTokenFromHeader(r)
+		scheme, tokenSigned, err := getAuthorization(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		isRevoked, err := revocationChecker.IsTokenRevoked(tokenSigned)
+		authenticate(w, r, next, revocationChecker, scheme, tokenSigned, "")
+	})
+}
+
+// DelegatedMiddleware - как JwtMiddleware, но принимает еще и делегированные токены
+// с audience (GenerateDelegatedJWT). Обычные токены с другим audience не принимаются.
+func DelegatedMiddleware(next http.Handler, revocationChecker TokenRevocationChecker, audience string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, tokenSigned, err := getAuthorization(r)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to check token revocation: %v", err), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
-		if isRevoked {
-			http.Error(w, "token is revoked", http.StatusUnauthorized)
+
+		authenticate(w, r, next, revocationChecker, scheme, tokenSigned, "", audience)
+	})
+}
+
+// QueryTokenMiddleware - как JwtMiddleware, но токен с audience можно передать в параметре
+// access_token или в подпротоколе WebSocket. Токены без audience принимаются только из заголовка,
+// чтобы обычные токены не попадали в URL и журналы.
+func QueryTokenMiddleware(next http.Handler, revocationChecker TokenRevocationChecker, audience string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenSigned := getQueryToken(r)
+		if tokenSigned == "" {
+			scheme, token, err := getAuthorization(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			authenticate(w, r, next, revocationChecker, scheme, token, "")
 			return
 		}
 
-		claims, err := GetJWTClaims(tokenSigned)
+		authenticate(w, r, next, revocationChecker, "Bearer", tokenSigned, audience)
+	})
+}
+
+func getQueryToken(r *http.Request) string {
+	if token := r.URL.Query().Get(TokenQueryParam); token != "" {
+		return token
+	}
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(header, ",") {
+			protocols = append(protocols, strings.TrimSpace(p))
+		}
+	}
+	if len(protocols) == 2 && protocols[0] == TokenSubprotocol {
+		return protocols[1]
+	}
+	return ""
+}
+
+// authenticate - проверяет токен и передает запрос next с claims в контексте.
+// Токен должен подходить под один из audiences; "" - токен без audience.
+func authenticate(w http.ResponseWriter, r *http.Request, next http.Handler, revocationChecker TokenRevocationChecker,
+	scheme string, tokenSigned string, audiences ...string) {
+	isRevoked, err := revocationChecker.IsTokenRevoked(tokenSigned)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to check token revocation: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if isRevoked {
+		http.Error(w, "token is revoked", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := GetJWTClaims(tokenSigned)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !checkAudience(claims, audiences) {
+		http.Error(w, "token is not valid for this resource", http.StatusUnauthorized)
+		return
+	}
+
+	if err := checkDPoP(r, scheme, tokenSigned, claims); err != nil {
+		w.Header().Set("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Токены удаленного (или разлогиненного отовсюду) пользователя и токены из отозванного токена
+	isRevoked, err = IsUserTokenRevoked(revocationChecker, claims)
+	if err == nil && !isRevoked {
+		isRevoked, err = IsParentTokenRevoked(revocationChecker, claims)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to check token revocation: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if isRevoked {
+		http.Error(w, "token is revoked", http.StatusUnauthorized)
+		return
+	}
+	ctx := context.WithValue(r.Context(), "claims", claims)
+	ctx = context.WithValue(ctx, "token", tokenSigned)
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func checkAudience(claims *Claims, audiences []string) bool {
+	for _, audience := range audiences {
+		if audience == "" && len(claims.Audience) == 0 {
+			return true
+		}
+		for _, aud := range claims.Audience {
+			if audience != "" && aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUserTokenRevoked - отозваны ли все токены пользователя, выданные не позже этого токена
+func IsUserTokenRevoked(revocationChecker TokenRevocationChecker, claims *Claims) (bool, error) {
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	return revocationChecker.IsUserRevoked(claims.Subject, issuedAt)
+}
+
+// IsParentTokenRevoked - отозван ли токен, из которого выпущен этот (GenerateAudienceJWT)
+func IsParentTokenRevoked(revocationChecker TokenRevocationChecker, claims *Claims) (bool, error) {
+	if claims.ParentHash == "" {
+		return false, nil
+	}
+	return revocationChecker.IsTokenHashRevoked(claims.ParentHash)
+}
+
+// Токен, привязанный к ключу, принимается только со схемой DPoP и доказательством владения ключом
+func checkDPoP(r *http.Request, scheme string, token string, claims *Claims) error {
+	if claims.Cnf == nil {
+		if scheme == "DPoP" {
+			return fmt.Errorf("token is not bound to a dpop key")
+		}
+		return nil
+	}
+	if scheme != "DPoP" {
+		return fmt.Errorf("dpop-bound token requires DPoP authorization scheme")
+	}
+
+	jkt, err := VerifyDPoPProof(r.Header.Get("DPoP"), r.Method, RequestURL(r), token)
+	if err != nil {
+		return err
+	}
+	if jkt != claims.Cnf.JKT {
+		return fmt.Errorf("dpop proof key does not match token")
+	}
+	return nil
+}
+
+// AdminMiddleware - пропускает только администраторов. Ставится после JwtMiddleware.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := GetClaimsFromContext(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
-		ctx := context.WithValue(r.Context(), "claims", claims)
+		if !claims.UserInfo.IsAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
 
+// GetTokenFromContext - токен, с которым прошел запрос. Ставится JwtMiddleware.
+func GetTokenFromContext(req *http.Request) (string, error) {
+	token, ok := req.Context().Value("token").(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("Unable to extract token from context")
+	}
+
+	return token, nil
+}
+
 func GetClaimsFromContext(req *http.Request) (*Claims, error) {
 	claims, ok := req.Context().Value("claims").(*Claims)
 	if !ok || claims == nil {
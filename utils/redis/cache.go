@@ -0,0 +1,208 @@
+package redis_utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Кэшированное значение хранится в хэше, его поколение - в отдельном ключе: каждая
+// инвалидация увеличивает поколение, и значения, прочитанные из базы до инвалидации,
+// уже не записываются. Ключ поколения живет дольше хэша, срок которого задает запись поля.
+// В кластере ключ хэша и ключ поколения должны попадать в один слот (общий {hash tag}).
+
+// Запись поля, только если поколение не изменилось с момента чтения
+var setFieldScript = redis.NewScript(`
+local gen = redis.call('GET', KEYS[2])
+if (gen or '') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return 1`)
+
+// Удаление всех полей с увеличением поколения
+var invalidateScript = redis.NewScript(`
+redis.call('DEL', KEYS[1])
+local gen = redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[1])
+return gen`)
+
+// Снятие блокировки только ее владельцем
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+
+// Продление блокировки только ее владельцем
+var extendLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`)
+
+// Запись значения, только если текущее значение равно ожидаемому
+var compareAndSetScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+	return 1
+end
+return 0`)
+
+// GetCachedField - значение поля хэша (nil, если его нет) и текущее поколение из genKey
+func (r *RedisClient) GetCachedField(ctx context.Context, key, genKey, field string) ([]byte, string, error) {
+	// Ошибки смотрим по каждой команде: redis.Nil для отсутствующего ключа - не ошибка
+	var value, gen *redis.StringCmd
+	r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		value = pipe.HGet(ctx, key, field)
+		gen = pipe.Get(ctx, genKey)
+		return nil
+	})
+	for _, cmd := range []*redis.StringCmd{value, gen} {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			return nil, "", fmt.Errorf("failed to get cached field: %v", err)
+		}
+	}
+
+	var data []byte
+	if value.Err() == nil {
+		data = []byte(value.Val())
+	}
+	return data, gen.Val(), nil
+}
+
+// SetCachedField - записывает поле и продлевает хэш на ttl, если поколение все еще gen.
+// Срок ключа поколения не меняется.
+func (r *RedisClient) SetCachedField(ctx context.Context, key, genKey, field, gen string, value []byte, ttl time.Duration) error {
+	err := setFieldScript.Run(ctx, r.client, []string{key, genKey}, gen, field, value, ttl.Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set cached field: %v", err)
+	}
+	return nil
+}
+
+// InvalidateCached - удаляет все поля хэша и увеличивает поколение. ttl - сколько хранится
+// поколение, должно быть не меньше времени жизни значений, которые от него зависят.
+func (r *RedisClient) InvalidateCached(ctx context.Context, key, genKey string, ttl time.Duration) error {
+	if err := invalidateScript.Run(ctx, r.client, []string{key, genKey}, ttl.Milliseconds()).Err(); err != nil {
+		return fmt.Errorf("failed to invalidate cache: %v", err)
+	}
+	return nil
+}
+
+// CacheGetMany - значения ключей по порядку, "" - ключа нет. Ключи могут быть в разных слотах кластера.
+func (r *RedisClient) CacheGetMany(ctx context.Context, keys []string) ([]string, error) {
+	cmds := make([]*redis.StringCmd, len(keys))
+	r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		return nil
+	})
+
+	values := make([]string, len(keys))
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to get cached values: %v", err)
+		}
+		values[i] = cmd.Val()
+	}
+	return values, nil
+}
+
+// DeleteCachedFields - удаляет поле field во всех хэшах, подходящих под шаблон
+func (r *RedisClient) DeleteCachedFields(ctx context.Context, pattern, field string) error {
+	return r.scanKeys(ctx, pattern, func(key string) error {
+		return r.client.HDel(ctx, key, field).Err()
+	})
+}
+
+// CacheGet - значение ключа, nil - ключа нет
+func (r *RedisClient) CacheGet(ctx context.Context, key string) ([]byte, error) {
+	data, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cached value: %v", err)
+	}
+	return data, nil
+}
+
+func (r *RedisClient) CacheSet(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := r.client.Set(ctx, key, value, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set cached value: %v", err)
+	}
+	return nil
+}
+
+// CacheSetNX - записывает значение, только если ключа нет; false - ключ уже есть
+func (r *RedisClient) CacheSetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	ok, err := r.client.SetNX(ctx, key, value, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to set cached value: %v", err)
+	}
+	return ok, nil
+}
+
+// CacheCompareAndSet - записывает value на ttl, только если ключ все еще содержит expected;
+// false - значение изменилось или ключа нет
+func (r *RedisClient) CacheCompareAndSet(ctx context.Context, key string, expected, value []byte, ttl time.Duration) (bool, error) {
+	n, err := compareAndSetScript.Run(ctx, r.client, []string{key}, expected, value, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to set cached value: %v", err)
+	}
+	return n == 1, nil
+}
+
+// CacheIncr - увеличивает счетчик и продлевает его на ttl
+func (r *RedisClient) CacheIncr(ctx context.Context, key string, ttl time.Duration) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, key)
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to increment counter: %v", err)
+	}
+	return nil
+}
+
+// AcquireLock - блокировка на ttl; возвращает токен для ReleaseLock или "", если она занята
+func (r *RedisClient) AcquireLock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	ok, err := r.client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to acquire lock: %v", err)
+	}
+	if !ok {
+		return "", nil
+	}
+	return token, nil
+}
+
+func (r *RedisClient) ReleaseLock(ctx context.Context, key, token string) error {
+	if err := unlockScript.Run(ctx, r.client, []string{key}, token).Err(); err != nil {
+		return fmt.Errorf("failed to release lock: %v", err)
+	}
+	return nil
+}
+
+// ExtendLock - продлевает блокировку на ttl; false - она уже истекла или занята другим
+func (r *RedisClient) ExtendLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	n, err := extendLockScript.Run(ctx, r.client, []string{key}, token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to extend lock: %v", err)
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,229 @@
+package redis_utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCachedFieldGenerations(t *testing.T) {
+	ctx := context.Background()
+	const key, genKey = "cache:item:{1}", "cache:item_gen:{1}"
+
+	t.Run("Stores field while generation is unchanged", func(t *testing.T) {
+		r, mr := newTestClient(t)
+
+		data, gen, err := r.GetCachedField(ctx, key, genKey, "alice")
+		if err != nil || data != nil || gen != "" {
+			t.Fatalf("GetCachedField() = %q, %q, %v; want miss with empty generation", data, gen, err)
+		}
+		if err := r.SetCachedField(ctx, key, genKey, "alice", gen, []byte("v1"), time.Minute); err != nil {
+			t.Fatalf("SetCachedField: %v", err)
+		}
+
+		data, gen, err = r.GetCachedField(ctx, key, genKey, "alice")
+		if err != nil || string(data) != "v1" || gen != "" {
+			t.Fatalf("GetCachedField() = %q, %q, %v; want v1", data, gen, err)
+		}
+		if ttl := mr.TTL(key); ttl != time.Minute {
+			t.Errorf("hash TTL = %s, want 1m", ttl)
+		}
+	})
+
+	t.Run("Invalidation drops fields and rejects values read before it", func(t *testing.T) {
+		r, _ := newTestClient(t)
+
+		r.SetCachedField(ctx, key, genKey, "alice", "", []byte("v1"), time.Minute)
+		r.SetCachedField(ctx, key, genKey, "bob", "", []byte("v1"), time.Minute)
+		// Значение прочитано из базы до инвалидации
+		_, staleGen, _ := r.GetCachedField(ctx, key, genKey, "carol")
+
+		if err := r.InvalidateCached(ctx, key, genKey, time.Hour); err != nil {
+			t.Fatalf("InvalidateCached: %v", err)
+		}
+		for _, field := range []string{"alice", "bob"} {
+			if data, _, _ := r.GetCachedField(ctx, key, genKey, field); data != nil {
+				t.Errorf("field %s = %q after invalidation", field, data)
+			}
+		}
+
+		if err := r.SetCachedField(ctx, key, genKey, "carol", staleGen, []byte("stale"), time.Minute); err != nil {
+			t.Fatalf("SetCachedField: %v", err)
+		}
+		data, gen, _ := r.GetCachedField(ctx, key, genKey, "carol")
+		if data != nil {
+			t.Fatalf("stale value %q was stored", data)
+		}
+		if gen != "1" {
+			t.Fatalf("generation = %q, want 1", gen)
+		}
+
+		r.SetCachedField(ctx, key, genKey, "carol", gen, []byte("v2"), time.Minute)
+		if data, _, _ := r.GetCachedField(ctx, key, genKey, "carol"); string(data) != "v2" {
+			t.Errorf("field = %q, want v2", data)
+		}
+
+		r.InvalidateCached(ctx, key, genKey, time.Hour)
+		if _, gen, _ := r.GetCachedField(ctx, key, genKey, "carol"); gen != "2" {
+			t.Errorf("generation = %q, want 2", gen)
+		}
+	})
+
+	t.Run("Storing a field does not shorten generation TTL", func(t *testing.T) {
+		r, mr := newTestClient(t)
+
+		r.InvalidateCached(ctx, key, genKey, 24*time.Hour)
+		r.SetCachedField(ctx, key, genKey, "alice", "1", []byte("v1"), 5*time.Minute)
+
+		if ttl := mr.TTL(genKey); ttl != 24*time.Hour {
+			t.Fatalf("generation TTL = %s, want 24h", ttl)
+		}
+		if ttl := mr.TTL(key); ttl != 5*time.Minute {
+			t.Fatalf("hash TTL = %s, want 5m", ttl)
+		}
+
+		// Значения истекли, поколение осталось: старое значение не запишется
+		mr.FastForward(10 * time.Minute)
+		data, gen, _ := r.GetCachedField(ctx, key, genKey, "alice")
+		if data != nil || gen != "1" {
+			t.Fatalf("GetCachedField() = %q, %q; want miss with generation 1", data, gen)
+		}
+		r.SetCachedField(ctx, key, genKey, "alice", "", []byte("stale"), 5*time.Minute)
+		if data, _, _ := r.GetCachedField(ctx, key, genKey, "alice"); data != nil {
+			t.Fatalf("value with expired generation %q was stored", data)
+		}
+	})
+}
+
+func TestCacheGetMany(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestClient(t)
+
+	r.CacheSet(ctx, "a", []byte("1"), time.Minute)
+	r.CacheSet(ctx, "c", []byte("3"), time.Minute)
+
+	values, err := r.CacheGetMany(ctx, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("CacheGetMany: %v", err)
+	}
+	if len(values) != 3 || values[0] != "1" || values[1] != "" || values[2] != "3" {
+		t.Fatalf("CacheGetMany() = %q, want [1 \"\" 3]", values)
+	}
+
+	if values, err := r.CacheGetMany(ctx, nil); err != nil || len(values) != 0 {
+		t.Fatalf("CacheGetMany(nil) = %q, %v", values, err)
+	}
+}
+
+func TestCacheIncr(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestClient(t)
+
+	for i := 0; i < 2; i++ {
+		if err := r.CacheIncr(ctx, "gen", time.Hour); err != nil {
+			t.Fatalf("CacheIncr: %v", err)
+		}
+	}
+	if value, _ := r.CacheGet(ctx, "gen"); string(value) != "2" {
+		t.Errorf("counter = %q, want 2", value)
+	}
+	if ttl := mr.TTL("gen"); ttl != time.Hour {
+		t.Errorf("counter TTL = %s, want 1h", ttl)
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Only one holder", func(t *testing.T) {
+		r, _ := newTestClient(t)
+
+		token, err := r.AcquireLock(ctx, "lock", time.Minute)
+		if err != nil || token == "" {
+			t.Fatalf("AcquireLock() = %q, %v", token, err)
+		}
+		if other, err := r.AcquireLock(ctx, "lock", time.Minute); err != nil || other != "" {
+			t.Fatalf("second AcquireLock() = %q, %v; want busy", other, err)
+		}
+
+		r.ReleaseLock(ctx, "lock", token)
+		if again, _ := r.AcquireLock(ctx, "lock", time.Minute); again == "" || again == token {
+			t.Fatalf("AcquireLock() after release = %q", again)
+		}
+	})
+
+	t.Run("Release by another token keeps lock", func(t *testing.T) {
+		r, mr := newTestClient(t)
+
+		token, _ := r.AcquireLock(ctx, "lock", time.Minute)
+		if err := r.ReleaseLock(ctx, "lock", "not-"+token); err != nil {
+			t.Fatalf("ReleaseLock: %v", err)
+		}
+		if got, _ := mr.Get("lock"); got != token {
+			t.Fatalf("lock = %q, want %q", got, token)
+		}
+	})
+
+	t.Run("Expired lock can be taken and old holder cannot release it", func(t *testing.T) {
+		r, mr := newTestClient(t)
+
+		old, _ := r.AcquireLock(ctx, "lock", time.Second)
+		mr.FastForward(2 * time.Second)
+
+		token, _ := r.AcquireLock(ctx, "lock", time.Minute)
+		if token == "" {
+			t.Fatalf("expired lock is still held")
+		}
+		r.ReleaseLock(ctx, "lock", old)
+		if got, _ := mr.Get("lock"); got != token {
+			t.Fatalf("lock = %q, want new holder %q", got, token)
+		}
+	})
+
+	t.Run("Only holder extends lock", func(t *testing.T) {
+		r, mr := newTestClient(t)
+
+		token, _ := r.AcquireLock(ctx, "lock", time.Second)
+		if held, err := r.ExtendLock(ctx, "lock", token, time.Minute); err != nil || !held {
+			t.Fatalf("ExtendLock() = %v, %v; want true", held, err)
+		}
+		if ttl := mr.TTL("lock"); ttl != time.Minute {
+			t.Fatalf("lock TTL = %s, want 1m", ttl)
+		}
+
+		if held, _ := r.ExtendLock(ctx, "lock", "not-"+token, time.Hour); held {
+			t.Fatal("ExtendLock() by another token succeeded")
+		}
+		mr.FastForward(2 * time.Minute)
+		if held, _ := r.ExtendLock(ctx, "lock", token, time.Minute); held {
+			t.Fatal("ExtendLock() of expired lock succeeded")
+		}
+	})
+}
+
+func TestCacheCompareAndSet(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestClient(t)
+
+	r.CacheSet(ctx, "key", []byte("pending"), time.Minute)
+	if ok, err := r.CacheCompareAndSet(ctx, "key", []byte("other"), []byte("done"), time.Hour); err != nil || ok {
+		t.Fatalf("CacheCompareAndSet() with wrong value = %v, %v; want false", ok, err)
+	}
+	if got, _ := mr.Get("key"); got != "pending" {
+		t.Fatalf("value = %q, want pending", got)
+	}
+
+	if ok, err := r.CacheCompareAndSet(ctx, "key", []byte("pending"), []byte("done"), time.Hour); err != nil || !ok {
+		t.Fatalf("CacheCompareAndSet() = %v, %v; want true", ok, err)
+	}
+	if got, _ := mr.Get("key"); got != "done" {
+		t.Fatalf("value = %q, want done", got)
+	}
+	if ttl := mr.TTL("key"); ttl != time.Hour {
+		t.Fatalf("TTL = %s, want 1h", ttl)
+	}
+
+	if ok, _ := r.CacheCompareAndSet(ctx, "missing", []byte("pending"), []byte("done"), time.Hour); ok || mr.Exists("missing") {
+		t.Fatal("CacheCompareAndSet() created a missing key")
+	}
+}
@@ -0,0 +1,279 @@
+package redis_utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Режимы подключения к Redis
+const (
+	ModeSingle   = "single"
+	ModeSentinel = "sentinel"
+	ModeCluster  = "cluster"
+)
+
+// Duration - time.Duration, который в JSON задается строкой ("5s", "300ms")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type RedisConfig struct {
+	Mode  string   `json:"mode"`
+	Addrs []string `json:"addrs"` // адрес сервера, адреса sentinel или seed-узлы кластера
+	DB    int      `json:"db"`
+
+	// Только для sentinel
+	MasterName       string `json:"master_name"`
+	SentinelUsername string `json:"sentinel_username"`
+	SentinelPassword string `json:"sentinel_password"`
+
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	TLS                   bool   `json:"tls"`
+	TLSCAFile             string `json:"tls_ca_file"`
+	TLSServerName         string `json:"tls_server_name"`
+	TLSInsecureSkipVerify bool   `json:"tls_insecure_skip_verify"`
+
+	PoolSize     int      `json:"pool_size"`
+	MinIdleConns int      `json:"min_idle_conns"`
+	DialTimeout  Duration `json:"dial_timeout"`
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	PoolTimeout  Duration `json:"pool_timeout"`
+}
+
+// String - для логов, без паролей
+func (c RedisConfig) String() string {
+	mask := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "***"
+	}
+	c.Password = mask(c.Password)
+	c.SentinelPassword = mask(c.SentinelPassword)
+
+	type plain RedisConfig
+	return fmt.Sprintf("%+v", plain(c))
+}
+
+// ReadRedisConfig - читает настройки из JSON-файла REDIS_CONFIG_FILE, если он задан,
+// иначе из переменных окружения REDIS_*.
+func ReadRedisConfig() (*RedisConfig, error) {
+	if path := os.Getenv("REDIS_CONFIG_FILE"); path != "" {
+		return LoadRedisConfig(path)
+	}
+
+	cfg := &RedisConfig{
+		Mode:             os.Getenv("REDIS_MODE"),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		SentinelUsername: os.Getenv("REDIS_SENTINEL_USERNAME"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		Username:         os.Getenv("REDIS_USERNAME"),
+		Password:         os.Getenv("REDIS_PASSWORD"),
+		TLSCAFile:        os.Getenv("REDIS_TLS_CA_FILE"),
+		TLSServerName:    os.Getenv("REDIS_TLS_SERVER_NAME"),
+	}
+
+	if addrs := os.Getenv("REDIS_ADDRS"); addrs != "" {
+		for _, addr := range strings.Split(addrs, ",") {
+			cfg.Addrs = append(cfg.Addrs, strings.TrimSpace(addr))
+		}
+	} else {
+		cfg.Addrs = []string{os.Getenv("REDIS_HOST") + ":" + os.Getenv("REDIS_PORT")}
+	}
+
+	var err error
+	ints := map[string]*int{
+		"REDIS_DB":             &cfg.DB,
+		"REDIS_POOL_SIZE":      &cfg.PoolSize,
+		"REDIS_MIN_IDLE_CONNS": &cfg.MinIdleConns,
+	}
+	for name, dst := range ints {
+		if v := os.Getenv(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	bools := map[string]*bool{
+		"REDIS_TLS":                      &cfg.TLS,
+		"REDIS_TLS_INSECURE_SKIP_VERIFY": &cfg.TLSInsecureSkipVerify,
+	}
+	for name, dst := range bools {
+		if v := os.Getenv(name); v != "" {
+			if *dst, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	durations := map[string]*Duration{
+		"REDIS_DIAL_TIMEOUT":  &cfg.DialTimeout,
+		"REDIS_READ_TIMEOUT":  &cfg.ReadTimeout,
+		"REDIS_WRITE_TIMEOUT": &cfg.WriteTimeout,
+		"REDIS_POOL_TIMEOUT":  &cfg.PoolTimeout,
+	}
+	for name, dst := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*dst = Duration(d)
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+// LoadRedisConfig - читает настройки из JSON-файла
+func LoadRedisConfig(path string) (*RedisConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redis config: %v", err)
+	}
+
+	cfg := &RedisConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse redis config: %v", err)
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *RedisConfig) validate() error {
+	if c.Mode == "" {
+		c.Mode = ModeSingle
+	}
+	if len(c.Addrs) == 0 {
+		return fmt.Errorf("redis addrs are not set")
+	}
+
+	switch c.Mode {
+	case ModeSingle:
+		if len(c.Addrs) != 1 {
+			return fmt.Errorf("single mode requires exactly one redis address")
+		}
+	case ModeSentinel:
+		if c.MasterName == "" {
+			return fmt.Errorf("sentinel mode requires master name")
+		}
+	case ModeCluster:
+		if c.DB != 0 {
+			return fmt.Errorf("redis cluster supports only db 0")
+		}
+	default:
+		return fmt.Errorf("unknown redis mode %s", c.Mode)
+	}
+	return nil
+}
+
+func (c *RedisConfig) tlsConfig() (*tls.Config, error) {
+	if !c.TLS {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+	}
+	if c.TLSCAFile != "" {
+		ca, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read redis CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSCAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// NewRedisClient - подключение к Redis по полной конфигурации
+func NewRedisClient(cfg *RedisConfig) (*RedisClient, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var client redis.UniversalClient
+	switch cfg.Mode {
+	case ModeSingle:
+		client = redis.NewClient(&redis.Options{
+			Addr:         cfg.Addrs[0],
+			Username:     cfg.Username,
+			Password:     cfg.Password,
+			DB:           cfg.DB,
+			TLSConfig:    tlsCfg,
+			PoolSize:     cfg.PoolSize,
+			MinIdleConns: cfg.MinIdleConns,
+			DialTimeout:  time.Duration(cfg.DialTimeout),
+			ReadTimeout:  time.Duration(cfg.ReadTimeout),
+			WriteTimeout: time.Duration(cfg.WriteTimeout),
+			PoolTimeout:  time.Duration(cfg.PoolTimeout),
+		})
+	case ModeSentinel:
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.MasterName,
+			SentinelAddrs:    cfg.Addrs,
+			SentinelUsername: cfg.SentinelUsername,
+			SentinelPassword: cfg.SentinelPassword,
+			Username:         cfg.Username,
+			Password:         cfg.Password,
+			DB:               cfg.DB,
+			TLSConfig:        tlsCfg,
+			PoolSize:         cfg.PoolSize,
+			MinIdleConns:     cfg.MinIdleConns,
+			DialTimeout:      time.Duration(cfg.DialTimeout),
+			ReadTimeout:      time.Duration(cfg.ReadTimeout),
+			WriteTimeout:     time.Duration(cfg.WriteTimeout),
+			PoolTimeout:      time.Duration(cfg.PoolTimeout),
+		})
+	case ModeCluster:
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        cfg.Addrs,
+			Username:     cfg.Username,
+			Password:     cfg.Password,
+			TLSConfig:    tlsCfg,
+			PoolSize:     cfg.PoolSize,
+			MinIdleConns: cfg.MinIdleConns,
+			DialTimeout:  time.Duration(cfg.DialTimeout),
+			ReadTimeout:  time.Duration(cfg.ReadTimeout),
+			WriteTimeout: time.Duration(cfg.WriteTimeout),
+			PoolTimeout:  time.Duration(cfg.PoolTimeout),
+		})
+	}
+
+	return &RedisClient{client: client}, nil
+}
@@ -0,0 +1,236 @@
+package redis_utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Поток событий о пользователях, который публикует auth_service
+const StreamUserEvents = "events:users"
+
+// Типы событий в StreamUserEvents
+const EventUserDeleted = "user_deleted"
+
+// Сколько событий храним в потоке (приблизительно)
+const streamMaxLen = 100000
+
+// Пауза перед повторной обработкой событий, завершившихся ошибкой
+const eventsRetryDelay = 10 * time.Second
+
+// Сколько раз событие доставляется обработчику, прежде чем оно будет перенесено
+// в поток недоставленных событий <stream>:dead и подтверждено
+const maxEventDeliveries = 30
+
+// Суффикс потока недоставленных событий
+const deadLetterSuffix = ":dead"
+
+// Неподтвержденные события, которые дольше eventsClaimIdle не обрабатывались (например,
+// потребитель пропал вместе с контейнером), раз в eventsClaimInterval забираются себе
+const (
+	eventsClaimIdle     = 5 * time.Minute
+	eventsClaimInterval = time.Minute
+)
+
+// EventIDField - ID события у источника (например, в outbox). При повторной публикации
+// событие получает новый ID в потоке, а EventIDField не меняется.
+const EventIDField = "event_id"
+
+// EventHandler - обработчик события из потока. Событие подтверждается (XACK),
+// только если обработчик вернул nil, иначе оно будет обработано повторно.
+type EventHandler func(id string, values map[string]interface{}) error
+
+// PublishEvent - публикует событие в Redis Stream и возвращает его ID
+func (r *RedisClient) PublishEvent(stream string, values map[string]interface{}) (string, error) {
+	id, err := r.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: streamMaxLen,
+		Approx: true,
+		Values: values,
+	}).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to publish event to %s: %v", stream, err)
+	}
+	return id, nil
+}
+
+// ConsumeEvents - читает поток в составе группы потребителей до отмены ctx.
+// Сначала дочитываются неподтвержденные события этого потребителя (например, после падения),
+// затем новые. Неудачно обработанные события периодически перечитываются, а после
+// maxEventDeliveries доставок переносятся в <stream>:dead, чтобы не повторяться вечно.
+// Давно не обрабатываемые события других потребителей группы забираются (XCLAIM).
+func (r *RedisClient) ConsumeEvents(ctx context.Context, stream, group, consumer string, handler EventHandler) error {
+	err := r.client.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group %s: %v", group, err)
+	}
+
+	pending := true // читаем ли сейчас неподтвержденные события
+	cursor := "0"
+	var retryAt, claimedAt time.Time
+
+	for ctx.Err() == nil {
+		if !pending && !retryAt.IsZero() && time.Now().After(retryAt) {
+			pending, cursor, retryAt = true, "0", time.Time{}
+		}
+		if time.Since(claimedAt) >= eventsClaimInterval {
+			claimedAt = time.Now()
+			if r.claimIdleEvents(ctx, stream, group, consumer) > 0 {
+				pending, cursor = true, "0"
+			}
+		}
+
+		start := ">"
+		if pending {
+			start = cursor
+		}
+
+		res, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, start},
+			Count:    10,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("ConsumeEvents: failed to read %s: %v", stream, err)
+			time.Sleep(eventsRetryDelay)
+			continue
+		}
+
+		received := 0
+		for _, s := range res {
+			for _, msg := range s.Messages {
+				received++
+				cursor = msg.ID
+				if err := handler(msg.ID, msg.Values); err != nil {
+					log.Printf("ConsumeEvents: failed to handle event %s from %s: %v", msg.ID, stream, err)
+					if !r.deadLetter(ctx, stream, group, msg, err) {
+						retryAt = time.Now().Add(eventsRetryDelay)
+					}
+					continue
+				}
+				if err := r.client.XAck(ctx, stream, group, msg.ID).Err(); err != nil {
+					log.Printf("ConsumeEvents: failed to ack event %s: %v", msg.ID, err)
+				}
+			}
+		}
+
+		if pending && received == 0 {
+			pending = false
+		}
+	}
+
+	return nil
+}
+
+// claimIdleEvents - забирает события других потребителей, которые не подтверждены дольше
+// eventsClaimIdle. Возвращает число забранных событий.
+func (r *RedisClient) claimIdleEvents(ctx context.Context, stream, group, consumer string) int {
+	claimed := 0
+	start := "-"
+	for {
+		pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  group,
+			Start:  start,
+			End:    "+",
+			Count:  100,
+		}).Result()
+		if err != nil {
+			log.Printf("ConsumeEvents: failed to get pending events of %s: %v", stream, err)
+			return claimed
+		}
+
+		var ids []string
+		for _, p := range pending {
+			if p.Consumer != consumer && p.Idle >= eventsClaimIdle {
+				ids = append(ids, p.ID)
+			}
+		}
+		if len(ids) > 0 {
+			// XCLAIM сам перепроверяет простой: событие, которое только что обработали, не заберется
+			msgs, err := r.client.XClaimJustID(ctx, &redis.XClaimArgs{
+				Stream:   stream,
+				Group:    group,
+				Consumer: consumer,
+				MinIdle:  eventsClaimIdle,
+				Messages: ids,
+			}).Result()
+			if err != nil {
+				log.Printf("ConsumeEvents: failed to claim events of %s: %v", stream, err)
+				return claimed
+			}
+			claimed += len(msgs)
+		}
+
+		if len(pending) < 100 {
+			break
+		}
+		start = nextStreamID(pending[len(pending)-1].ID)
+	}
+
+	if claimed > 0 {
+		log.Printf("ConsumeEvents: %d idle events of %s claimed by %s", claimed, stream, consumer)
+	}
+	return claimed
+}
+
+// Следующий возможный ID потока: начало следующей страницы без исключающих диапазонов
+func nextStreamID(id string) string {
+	ms, seq, _ := strings.Cut(id, "-")
+	n, _ := strconv.ParseUint(seq, 10, 64)
+	return ms + "-" + strconv.FormatUint(n+1, 10)
+}
+
+// deadLetter - переносит событие в <stream>:dead, если оно доставлялось maxEventDeliveries
+// раз. Возвращает true, если событие перенесено и подтверждено.
+func (r *RedisClient) deadLetter(ctx context.Context, stream, group string, msg redis.XMessage, handlerErr error) bool {
+	pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  group,
+		Start:  msg.ID,
+		End:    msg.ID,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		log.Printf("ConsumeEvents: failed to get deliveries of event %s: %v", msg.ID, err)
+		return false
+	}
+	if len(pending) == 0 || pending[0].RetryCount < maxEventDeliveries {
+		return false
+	}
+
+	values := make(map[string]interface{}, len(msg.Values)+3)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["dead_event_id"] = msg.ID
+	values["dead_group"] = group
+	values["dead_error"] = handlerErr.Error()
+
+	// Потоки могут быть в разных слотах кластера, поэтому без MULTI: при сбое между
+	// командами событие попадет в <stream>:dead повторно
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: stream + deadLetterSuffix, MaxLen: streamMaxLen, Approx: true, Values: values})
+		pipe.XAck(ctx, stream, group, msg.ID)
+		return nil
+	})
+	if err != nil {
+		log.Printf("ConsumeEvents: failed to move event %s to dead letters: %v", msg.ID, err)
+		return false
+	}
+	log.Printf("ConsumeEvents: event %s moved to %s after %d deliveries", msg.ID, stream+deadLetterSuffix, pending[0].RetryCount)
+	return true
+}
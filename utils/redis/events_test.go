@@ -0,0 +1,105 @@
+package redis_utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestDeadLetter(t *testing.T) {
+	log.SetOutput(io.Discard)
+	ctx := context.Background()
+	r, _ := newTestClient(t)
+
+	const stream, group = "events:test", "test"
+	if err := r.client.XGroupCreateMkStream(ctx, stream, group, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := r.PublishEvent(stream, map[string]interface{}{"type": "user_deleted", "userhash": "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliver := func(start string) redis.XMessage {
+		res, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: group, Consumer: "c1", Streams: []string{stream, start}, Count: 1, Block: -1,
+		}).Result()
+		if err != nil || len(res) == 0 || len(res[0].Messages) == 0 {
+			t.Fatalf("no message delivered: %v", err)
+		}
+		return res[0].Messages[0]
+	}
+
+	handlerErr := errors.New("database unavailable")
+	msg := deliver(">")
+	for i := 1; i < maxEventDeliveries; i++ {
+		if r.deadLetter(ctx, stream, group, msg, handlerErr) {
+			t.Fatalf("event moved to dead letters after %d deliveries", i)
+		}
+		msg = deliver("0")
+	}
+
+	if !r.deadLetter(ctx, stream, group, msg, handlerErr) {
+		t.Fatal("event must be moved to dead letters")
+	}
+
+	pending, err := r.client.XPending(ctx, stream, group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Fatalf("event must be acknowledged, %d pending", pending.Count)
+	}
+
+	dead, err := r.client.XRange(ctx, stream+deadLetterSuffix, "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(dead))
+	}
+	if dead[0].Values["dead_event_id"] != id || dead[0].Values["userhash"] != "u1" || dead[0].Values["dead_error"] != handlerErr.Error() {
+		t.Fatalf("unexpected dead letter: %v", dead[0].Values)
+	}
+}
+
+func TestClaimIdleEvents(t *testing.T) {
+	log.SetOutput(io.Discard)
+	ctx := context.Background()
+	r, mr := newTestClient(t)
+
+	const stream, group = "events:test", "test"
+	if err := r.client.XGroupCreateMkStream(ctx, stream, group, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	// Больше одной страницы XPENDING
+	for i := 0; i < 150; i++ {
+		r.PublishEvent(stream, map[string]interface{}{"type": "user_deleted"})
+	}
+	// Потребитель получил события и пропал, не подтвердив их
+	if err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: group, Consumer: "old-host", Streams: []string{stream, ">"}, Count: 120, Block: -1,
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := r.claimIdleEvents(ctx, stream, group, "new-host"); n != 0 {
+		t.Fatalf("claimed %d recently delivered events", n)
+	}
+
+	mr.SetTime(time.Now().Add(eventsClaimIdle + time.Minute))
+	if n := r.claimIdleEvents(ctx, stream, group, "new-host"); n != 120 {
+		t.Fatalf("claimed %d events, want 120", n)
+	}
+	pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream, Group: group, Start: "-", End: "+", Count: 200, Consumer: "new-host",
+	}).Result()
+	if err != nil || len(pending) != 120 {
+		t.Fatalf("pending of new consumer = %v, %v", pending, err)
+	}
+}
@@ -2,23 +2,34 @@ package redis_utils
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
-type RedisClient struct {
-	client *redis.Client
-}
+// Префиксы ключей списка отзыва
+const (
+	revokedTokenPrefix       = "revoked:"
+	revokedTokenHashedPrefix = "revoked:sha256:"
+	revokedUserPrefix        = "revoked_user:"
+)
 
-func InitRedisClient(addr, password string) *RedisClient {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       0,
-	})
-	return &RedisClient{client: rdb}
+// Учет действующих ключей отзыва для статистики: ключ отзыва с оценкой, равной
+// времени истечения. Имена не должны попадать под шаблон revoked:*.
+const (
+	revocationStatsTokensKey = "revocation_stats:tokens"
+	revocationStatsUsersKey  = "revocation_stats:users"
+)
+
+type RedisClient struct {
+	client redis.UniversalClient
 }
 
 func (r *RedisClient) RevokeToken(token string, expiresAt time.Time) error {
@@ -27,7 +38,8 @@ func (r *RedisClient) RevokeToken(token string, expiresAt time.Time) error {
 		return fmt.Errorf("token already expired")
 	}
 
-	_, err := r.client.Set(context.Background(), "revoked:"+token, "true", ttl).Result()
+	key := revokedTokenKey(token)
+	err := r.setAndPublish(key, "true", ttl, revocationStatsTokensKey, revocationMessage{Key: key, ExpiresAt: expiresAt.Unix()})
 	if err != nil {
 		return fmt.Errorf("failed to revoke token: %v", err)
 	}
@@ -35,7 +47,33 @@ func (r *RedisClient) RevokeToken(token string, expiresAt time.Time) error {
 }
 
 func (r *RedisClient) IsTokenRevoked(token string) (bool, error) {
-	val, err := r.client.Get(context.Background(), "revoked:"+token).Result()
+	// Ключи старого формата (с токеном целиком) учитываем, пока они не истекут
+	// Ошибки смотрим по каждой команде: redis.Nil для отсутствующего ключа - не ошибка
+	cmds, _ := r.client.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Get(context.Background(), revokedTokenKey(token))
+		pipe.Get(context.Background(), legacyRevokedTokenKey(token))
+		return nil
+	})
+
+	for _, cmd := range cmds {
+		val, err := cmd.(*redis.StringCmd).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get revoked token status: %v", err)
+		}
+		if val == "true" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// IsTokenHashRevoked - отозван ли токен с этим SHA-256 (hex). Ключи старого формата
+// по хэшу не найти, поэтому они здесь не учитываются.
+func (r *RedisClient) IsTokenHashRevoked(hash string) (bool, error) {
+	val, err := r.client.Get(context.Background(), revokedTokenHashKey(hash)).Result()
 	if err == redis.Nil {
 		return false, nil
 	}
@@ -44,3 +82,167 @@ func (r *RedisClient) IsTokenRevoked(token string) (bool, error) {
 	}
 	return val == "true", nil
 }
+
+// RevokeUserTokens - отзывает все токены пользователя, выданные до текущего момента.
+// ttl должен быть не меньше времени жизни токена.
+func (r *RedisClient) RevokeUserTokens(userHash string, ttl time.Duration) error {
+	now := time.Now()
+	key := revokedUserKey(userHash)
+	msg := revocationMessage{Key: key, RevokedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()}
+	err := r.setAndPublish(key, strconv.FormatInt(now.Unix(), 10), ttl, revocationStatsUsersKey, msg)
+	if err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %v", err)
+	}
+	return nil
+}
+
+func (r *RedisClient) IsUserRevoked(userHash string, issuedAt time.Time) (bool, error) {
+	val, err := r.client.Get(context.Background(), revokedUserKey(userHash)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get revoked user status: %v", err)
+	}
+
+	revokedAt, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid revoked user value: %v", err)
+	}
+	return issuedAt.Unix() <= revokedAt, nil
+}
+
+// Сохраняет ключ отзыва, учитывает его в statsKey и оповещает локальные кэши
+// других экземпляров сервисов
+func (r *RedisClient) setAndPublish(key string, value string, ttl time.Duration, statsKey string, msg revocationMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Set(context.Background(), key, value, ttl)
+		pipe.ZAdd(context.Background(), statsKey, &redis.Z{Score: float64(msg.ExpiresAt), Member: key})
+		pipe.Publish(context.Background(), revocationChannel, payload)
+		return nil
+	})
+	return err
+}
+
+// Ключ отзыва строится по SHA-256 токена, чтобы дамп Redis не содержал действующих токенов
+func revokedTokenKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return revokedTokenHashKey(hex.EncodeToString(hash[:]))
+}
+
+func revokedTokenHashKey(hash string) string {
+	return revokedTokenHashedPrefix + hash
+}
+
+// Старый формат ключа, до перехода на хэши
+func legacyRevokedTokenKey(token string) string {
+	return revokedTokenPrefix + token
+}
+
+func revokedUserKey(userHash string) string {
+	return revokedUserPrefix + userHash
+}
+
+// Перебирает ключи по шаблону; в режиме кластера - на всех master-узлах
+func (r *RedisClient) scanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	scan := func(ctx context.Context, client redis.UniversalClient) error {
+		iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scan(ctx, node)
+		})
+	}
+	return scan(ctx, r.client)
+}
+
+// Состояние списка отзыва для администратора
+type RevocationStats struct {
+	RevokedTokens   int64 `json:"revoked_tokens"`
+	RevokedUsers    int64 `json:"revoked_users"`
+	UsedMemoryBytes int64 `json:"used_memory_bytes"` // used_memory всего Redis (сумма по узлам кластера)
+}
+
+// GetRevocationStats - число действующих ключей отзыва по учету в revocation_stats:*.
+// Истекшие ключи удаляются из учета при каждом запросе; ключи старого формата не учитываются.
+func (r *RedisClient) GetRevocationStats(ctx context.Context) (*RevocationStats, error) {
+	stats, err := r.countRevocations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect revocation stats: %v", err)
+	}
+
+	var mu sync.Mutex // в кластере узлы обходятся параллельно
+
+	info := func(ctx context.Context, client redis.UniversalClient) error {
+		val, err := client.Info(ctx, "memory").Result()
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(val, "\r\n") {
+			if v, ok := strings.CutPrefix(line, "used_memory:"); ok {
+				used, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				stats.UsedMemoryBytes += used
+				mu.Unlock()
+			}
+		}
+		return nil
+	}
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return info(ctx, node)
+		})
+	} else {
+		err = info(ctx, r.client)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get redis memory info: %v", err)
+	}
+
+	return stats, nil
+}
+
+func (r *RedisClient) countRevocations(ctx context.Context) (*RevocationStats, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	counts := make(map[string]*redis.IntCmd)
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range []string{revocationStatsTokensKey, revocationStatsUsersKey} {
+			pipe.ZRemRangeByScore(ctx, key, "-inf", now)
+			counts[key] = pipe.ZCard(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &RevocationStats{
+		RevokedTokens: counts[revocationStatsTokensKey].Val(),
+		RevokedUsers:  counts[revocationStatsUsersKey].Val(),
+	}, nil
+}
+
+// StoreDPoPJti - хранилище использованных jti доказательств DPoP (jwt_utils.DPoPReplayStore)
+func (r *RedisClient) StoreDPoPJti(jti string, ttl time.Duration) (bool, error) {
+	hash := sha256.Sum256([]byte(jti))
+	ok, err := r.client.SetNX(context.Background(), "dpop:jti:"+hex.EncodeToString(hash[:]), "1", ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to store dpop jti: %v", err)
+	}
+	return ok, nil
+}
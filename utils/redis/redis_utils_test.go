@@ -0,0 +1,65 @@
+package redis_utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestCountRevocations(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestClient(t)
+
+	for _, token := range []string{"t1", "t2"} {
+		if err := r.RevokeToken(token, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Повторный отзыв учитывается один раз
+	for i := 0; i < 2; i++ {
+		if err := r.RevokeUserTokens("user", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Ключ, срок которого уже истек, из учета удаляется
+	expired := &redis.Z{Score: float64(time.Now().Add(-time.Minute).Unix()), Member: revokedTokenKey("t3")}
+	if err := r.client.ZAdd(ctx, revocationStatsTokensKey, expired).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := r.countRevocations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RevokedTokens != 2 || stats.RevokedUsers != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestIsTokenHashRevoked(t *testing.T) {
+	r, _ := newTestClient(t)
+	if err := r.RevokeToken("t1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	hash := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+
+	cache := NewRevocationCache(r, FailClosed)
+	cache.resync(context.Background())
+	for name, checker := range map[string]interface {
+		IsTokenHashRevoked(hash string) (bool, error)
+	}{"redis": r, "cache": cache} {
+		if revoked, err := checker.IsTokenHashRevoked(hash("t1")); err != nil || !revoked {
+			t.Errorf("%s: t1 revoked=%v err=%v", name, revoked, err)
+		}
+		if revoked, err := checker.IsTokenHashRevoked(hash("t2")); err != nil || revoked {
+			t.Errorf("%s: t2 revoked=%v err=%v", name, revoked, err)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package redis_utils
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Канал, в который публикуются новые отзывы токенов
+const revocationChannel = "revocations"
+
+// Верхняя граница размера локального кэша. При переполнении вытесняются записи,
+// которые истекают раньше других, кэш перестает считаться полным и отсутствующие
+// в нем токены проверяются в Redis.
+const revocationCacheMaxEntries = 100000
+
+// Как часто проверяем живость подписки и чистим истекшие записи
+const revocationHealthCheckInterval = 30 * time.Second
+
+// FailPolicy - поведение при недоступности Redis
+type FailPolicy int
+
+const (
+	FailClosed FailPolicy = iota // отклонять запросы
+	FailOpen                     // пропускать запросы, если токен не отозван по данным локального кэша
+)
+
+func ParseFailPolicy(s string) (FailPolicy, error) {
+	switch s {
+	case "", "closed":
+		return FailClosed, nil
+	case "open":
+		return FailOpen, nil
+	default:
+		return FailClosed, fmt.Errorf("unknown fail policy %s", s)
+	}
+}
+
+func (p FailPolicy) String() string {
+	if p == FailOpen {
+		return "open"
+	}
+	return "closed"
+}
+
+// Сообщение в revocationChannel
+type revocationMessage struct {
+	Key       string `json:"key"`
+	RevokedAt int64  `json:"revoked_at,omitempty"` // только для отзыва всех токенов пользователя
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type revocationEntry struct {
+	key       string
+	revokedAt int64
+	expiresAt time.Time
+	index     int // позиция в expiryHeap
+}
+
+// Записи кэша, ограниченные по количеству
+type revocationEntries struct {
+	max    int
+	byKey  map[string]*revocationEntry
+	expiry expiryHeap
+}
+
+func newRevocationEntries(max int) *revocationEntries {
+	return &revocationEntries{max: max, byKey: make(map[string]*revocationEntry)}
+}
+
+func (e *revocationEntries) get(key string) (*revocationEntry, bool) {
+	entry, ok := e.byKey[key]
+	return entry, ok
+}
+
+// set - добавляет или обновляет запись. Возвращает false, если ради нее пришлось
+// вытеснить еще действующую запись.
+func (e *revocationEntries) set(key string, revokedAt int64, expiresAt time.Time) bool {
+	if entry, ok := e.byKey[key]; ok {
+		entry.revokedAt, entry.expiresAt = revokedAt, expiresAt
+		heap.Fix(&e.expiry, entry.index)
+		return true
+	}
+
+	complete := true
+	for len(e.byKey) >= e.max {
+		evicted := heap.Pop(&e.expiry).(*revocationEntry)
+		delete(e.byKey, evicted.key)
+		if time.Now().Before(evicted.expiresAt) {
+			complete = false
+		}
+	}
+
+	entry := &revocationEntry{key: key, revokedAt: revokedAt, expiresAt: expiresAt}
+	heap.Push(&e.expiry, entry)
+	e.byKey[key] = entry
+	return complete
+}
+
+func (e *revocationEntries) removeExpired(now time.Time) {
+	for len(e.expiry) > 0 && !now.Before(e.expiry[0].expiresAt) {
+		evicted := heap.Pop(&e.expiry).(*revocationEntry)
+		delete(e.byKey, evicted.key)
+	}
+}
+
+// expiryHeap - записи по возрастанию expiresAt (container/heap)
+type expiryHeap []*revocationEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*revocationEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// RevocationCache - локальная копия списка отзыва токенов.
+// Кэш прогревается из Redis при каждой (пере)подписке на revocationChannel и дальше
+// обновляется сообщениями из канала, поэтому пока подписка жива, Redis на каждый запрос не нужен.
+// Реализует jwt_utils.TokenRevocationChecker.
+type RevocationCache struct {
+	redis      *RedisClient
+	policy     FailPolicy
+	maxEntries int
+
+	mu      sync.RWMutex
+	entries *revocationEntries
+	synced  bool // кэш полон: отсутствие ключа означает, что токен не отозван
+}
+
+func NewRevocationCache(r *RedisClient, policy FailPolicy) *RevocationCache {
+	return &RevocationCache{
+		redis:      r,
+		policy:     policy,
+		maxEntries: revocationCacheMaxEntries,
+		entries:    newRevocationEntries(revocationCacheMaxEntries),
+	}
+}
+
+// Run - подписка на обновления списка отзыва, блокирует до отмены ctx
+func (c *RevocationCache) Run(ctx context.Context) {
+	pubsub := c.redis.client.Subscribe(ctx, revocationChannel)
+	defer pubsub.Close()
+
+	lastCleanup := time.Now()
+	for ctx.Err() == nil {
+		if time.Since(lastCleanup) > revocationHealthCheckInterval {
+			c.cleanup()
+			lastCleanup = time.Now()
+		}
+
+		msg, err := pubsub.ReceiveTimeout(ctx, revocationHealthCheckInterval)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if err = pubsub.Ping(ctx); err == nil {
+					if !c.isSynced() {
+						c.resync(ctx)
+					}
+					continue
+				}
+			}
+
+			// Пока подписки нет, сообщения теряются - кэш больше не полон
+			c.setSynced(false)
+			log.Printf("RevocationCache: subscription error: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind != "subscribe" {
+				continue
+			}
+			// (Пере)подключились - за время отключения могли пропустить отзывы
+			c.resync(ctx)
+		case *redis.Message:
+			c.apply(m.Payload)
+		}
+	}
+}
+
+func (c *RevocationCache) IsTokenRevoked(token string) (bool, error) {
+	revoked, known := c.lookup(revokedTokenKey(token))
+	if revoked || known {
+		return revoked, nil
+	}
+
+	revoked, err := c.redis.IsTokenRevoked(token)
+	return c.applyPolicy(revoked, err)
+}
+
+func (c *RevocationCache) IsTokenHashRevoked(hash string) (bool, error) {
+	revoked, known := c.lookup(revokedTokenHashKey(hash))
+	if revoked || known {
+		return revoked, nil
+	}
+
+	revoked, err := c.redis.IsTokenHashRevoked(hash)
+	return c.applyPolicy(revoked, err)
+}
+
+func (c *RevocationCache) IsUserRevoked(userHash string, issuedAt time.Time) (bool, error) {
+	c.mu.RLock()
+	entry, ok := c.entries.get(revokedUserKey(userHash))
+	var revokedAt int64
+	if ok && time.Now().Before(entry.expiresAt) {
+		revokedAt = entry.revokedAt
+	} else {
+		ok = false
+	}
+	synced := c.synced
+	c.mu.RUnlock()
+
+	if ok {
+		return issuedAt.Unix() <= revokedAt, nil
+	}
+	if synced {
+		return false, nil
+	}
+
+	revoked, err := c.redis.IsUserRevoked(userHash, issuedAt)
+	return c.applyPolicy(revoked, err)
+}
+
+// Возвращает (отозван, ответ точный)
+func (c *RevocationCache) lookup(key string) (bool, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if entry, ok := c.entries.get(key); ok && time.Now().Before(entry.expiresAt) {
+		return true, true
+	}
+	return false, c.synced
+}
+
+func (c *RevocationCache) applyPolicy(revoked bool, err error) (bool, error) {
+	if err == nil {
+		return revoked, nil
+	}
+	if c.policy == FailOpen {
+		log.Printf("RevocationCache: redis unavailable, fail open: %v", err)
+		return false, nil
+	}
+	return false, err
+}
+
+func (c *RevocationCache) resync(ctx context.Context) {
+	complete, err := c.warm(ctx)
+	if err != nil {
+		log.Printf("RevocationCache: failed to warm cache: %v", err)
+		c.setSynced(false)
+		return
+	}
+	if !complete {
+		log.Printf("RevocationCache: more than %d revoked tokens, cache is partial", c.maxEntries)
+	}
+	c.setSynced(complete)
+}
+
+// Загружает действующие ключи отзыва из Redis. Возвращает false, если все ключи
+// не поместились в кэш.
+func (c *RevocationCache) warm(ctx context.Context) (bool, error) {
+	entries := newRevocationEntries(c.maxEntries)
+	complete := true
+
+	var mu sync.Mutex // в кластере узлы обходятся параллельно
+	for _, prefix := range []string{revokedTokenPrefix, revokedUserPrefix} {
+		prefix := prefix
+		err := c.redis.scanKeys(ctx, prefix+"*", func(key string) error {
+			// revoked:* совпадает и с revoked_user:*, такие ключи разберем во втором проходе
+			if prefix == revokedTokenPrefix && strings.HasPrefix(key, revokedUserPrefix) {
+				return nil
+			}
+
+			val, err := c.redis.client.Get(ctx, key).Result()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			ttl, err := c.redis.client.PTTL(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if ttl <= 0 {
+				return nil
+			}
+
+			var revokedAt int64
+			if prefix == revokedUserPrefix {
+				revokedAt, _ = strconv.ParseInt(val, 10, 64)
+			} else if !strings.HasPrefix(key, revokedTokenHashedPrefix) {
+				// Ключ старого формата - в кэше храним только хэш
+				key = revokedTokenKey(strings.TrimPrefix(key, revokedTokenPrefix))
+			}
+			mu.Lock()
+			if !entries.set(key, revokedAt, time.Now().Add(ttl)) {
+				complete = false
+			}
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	c.mu.Lock()
+	// Уже известные записи сохраняем
+	for key, entry := range c.entries.byKey {
+		if _, ok := entries.get(key); !ok && !entries.set(key, entry.revokedAt, entry.expiresAt) {
+			complete = false
+		}
+	}
+	c.entries = entries
+	c.mu.Unlock()
+
+	return complete, nil
+}
+
+func (c *RevocationCache) apply(payload string) {
+	var msg revocationMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Printf("RevocationCache: invalid message: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.entries.set(msg.Key, msg.RevokedAt, time.Unix(msg.ExpiresAt, 0)) {
+		c.synced = false
+	}
+}
+
+func (c *RevocationCache) cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries.removeExpired(time.Now())
+}
+
+func (c *RevocationCache) isSynced() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.synced
+}
+
+func (c *RevocationCache) setSynced(synced bool) {
+	c.mu.Lock()
+	c.synced = synced
+	c.mu.Unlock()
+}
@@ -0,0 +1,162 @@
+package redis_utils
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestClient(t *testing.T) (*RedisClient, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &RedisClient{client: client}, mr
+}
+
+func TestRevocationEntries(t *testing.T) {
+	now := time.Now()
+
+	t.Run("Evicts entry that expires first", func(t *testing.T) {
+		e := newRevocationEntries(2)
+		e.set("a", 0, now.Add(time.Hour))
+		e.set("b", 0, now.Add(time.Minute))
+
+		if e.set("c", 0, now.Add(2*time.Hour)) {
+			t.Fatal("eviction of a live entry must be reported")
+		}
+		if _, ok := e.get("b"); ok {
+			t.Fatal("entry expiring first must be evicted")
+		}
+		for _, key := range []string{"a", "c"} {
+			if _, ok := e.get(key); !ok {
+				t.Fatalf("entry %s must be kept", key)
+			}
+		}
+	})
+
+	t.Run("Evicting expired entry keeps cache complete", func(t *testing.T) {
+		e := newRevocationEntries(1)
+		e.set("a", 0, now.Add(-time.Second))
+
+		if !e.set("b", 0, now.Add(time.Hour)) {
+			t.Fatal("eviction of an expired entry must not be reported")
+		}
+	})
+
+	t.Run("Update does not evict", func(t *testing.T) {
+		e := newRevocationEntries(2)
+		e.set("a", 1, now.Add(time.Minute))
+		e.set("b", 0, now.Add(time.Hour))
+
+		if !e.set("a", 2, now.Add(2*time.Hour)) {
+			t.Fatal("update must not evict")
+		}
+		e.set("c", 0, now.Add(3*time.Hour))
+		if _, ok := e.get("b"); ok {
+			t.Fatal("updated expiry must change eviction order")
+		}
+		if entry, ok := e.get("a"); !ok || entry.revokedAt != 2 {
+			t.Fatalf("updated entry must be kept, got %+v", entry)
+		}
+	})
+
+	t.Run("Removes expired entries", func(t *testing.T) {
+		e := newRevocationEntries(10)
+		e.set("a", 0, now.Add(-time.Minute))
+		e.set("b", 0, now.Add(time.Hour))
+		e.set("c", 0, now.Add(-time.Second))
+
+		e.removeExpired(now)
+		if len(e.byKey) != 1 || len(e.expiry) != 1 {
+			t.Fatalf("expected 1 entry, got %d", len(e.byKey))
+		}
+		if _, ok := e.get("b"); !ok {
+			t.Fatal("live entry must be kept")
+		}
+	})
+}
+
+func TestRevocationCacheApply(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	c := NewRevocationCache(nil, FailClosed)
+	c.maxEntries = 2
+	c.entries = newRevocationEntries(2)
+	c.synced = true
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	c.apply(`{"key":"` + revokedTokenKey("t1") + `","expires_at":` + strconv.FormatInt(expiresAt, 10) + `}`)
+	if revoked, known := c.lookup(revokedTokenKey("t1")); !revoked || !known {
+		t.Fatalf("t1: revoked=%v known=%v", revoked, known)
+	}
+	if revoked, known := c.lookup(revokedTokenKey("t2")); revoked || !known {
+		t.Fatalf("t2 must be known as not revoked while cache is complete")
+	}
+
+	c.apply(`{"key":"` + revokedTokenKey("t2") + `","expires_at":` + strconv.FormatInt(expiresAt, 10) + `}`)
+	c.apply(`{"key":"` + revokedTokenKey("t3") + `","expires_at":` + strconv.FormatInt(expiresAt+1, 10) + `}`)
+	if len(c.entries.byKey) != 2 {
+		t.Fatalf("cache must stay bounded, got %d entries", len(c.entries.byKey))
+	}
+	if _, known := c.lookup(revokedTokenKey("t4")); known {
+		t.Fatal("after eviction a missing key must be checked in redis")
+	}
+}
+
+func TestRevocationCacheWarm(t *testing.T) {
+	log.SetOutput(io.Discard)
+	ctx := context.Background()
+
+	r, _ := newTestClient(t)
+	for _, token := range []string{"t1", "t2", "t3"} {
+		if err := r.RevokeToken(token, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.RevokeUserTokens("user", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("All keys fit", func(t *testing.T) {
+		c := NewRevocationCache(r, FailClosed)
+		c.resync(ctx)
+
+		if !c.isSynced() {
+			t.Fatal("cache must be complete")
+		}
+		if revoked, err := c.IsTokenRevoked("t2"); err != nil || !revoked {
+			t.Fatalf("t2: revoked=%v err=%v", revoked, err)
+		}
+		if revoked, err := c.IsUserRevoked("user", time.Now().Add(-time.Minute)); err != nil || !revoked {
+			t.Fatalf("user: revoked=%v err=%v", revoked, err)
+		}
+	})
+
+	t.Run("Partial cache falls back to redis", func(t *testing.T) {
+		c := NewRevocationCache(r, FailClosed)
+		c.maxEntries = 2
+		c.resync(ctx)
+
+		if c.isSynced() {
+			t.Fatal("cache must be partial")
+		}
+		if len(c.entries.byKey) != 2 {
+			t.Fatalf("expected 2 entries, got %d", len(c.entries.byKey))
+		}
+		for _, token := range []string{"t1", "t2", "t3"} {
+			if revoked, err := c.IsTokenRevoked(token); err != nil || !revoked {
+				t.Fatalf("%s: revoked=%v err=%v", token, revoked, err)
+			}
+		}
+		if revoked, err := c.IsTokenRevoked("t4"); err != nil || revoked {
+			t.Fatalf("t4: revoked=%v err=%v", revoked, err)
+		}
+	})
+}